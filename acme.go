@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager obtains and renews the certificates of the comma separated domains from the ACME directory,
+// e.g. Let's Encrypt, accepting its terms of service. Certificates are kept in the cache directory across
+// restarts.
+func newACMEManager(domains string, email string, cacheDir string, directoryURL string) *autocert.Manager {
+	var hosts []string
+	for _, domain := range strings.Split(domains, ",") {
+		hosts = append(hosts, strings.TrimSpace(domain))
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+		Client:     &acme.Client{DirectoryURL: directoryURL},
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// adminTokenMinLength keeps the admin tokens from being guessed.
+const adminTokenMinLength = 16
+
+// adminRole is what a client of the admin port may do, every role may do what the roles below it may.
+type adminRole int
+
+const (
+	roleViewer adminRole = iota + 1
+	roleOperator
+	roleAdmin
+)
+
+var adminRoleNames = map[string]adminRole{"viewer": roleViewer, "operator": roleOperator, "admin": roleAdmin}
+
+func (r adminRole) String() string {
+	for name, role := range adminRoleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// adminPrincipal is the client of an admin request, named after its token or the subject of its OIDC token.
+type adminPrincipal struct {
+	Name string
+	Role adminRole
+}
+
+type adminPrincipalKey struct{}
+
+// principalOf returns the client of an admin request that passed the role check.
+func principalOf(req *http.Request) (adminPrincipal, bool) {
+	principal, found := req.Context().Value(adminPrincipalKey{}).(adminPrincipal)
+	return principal, found
+}
+
+// adminToken is a static bearer token of the admin port, e.g. {"name":"ci","role":"operator","token":"..."}.
+type adminToken struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	Token string `json:"token"`
+	role  adminRole
+}
+
+// adminAuth authenticates the clients of the admin port by static bearer tokens, or by JWTs of an OpenID
+// Connect issuer naming the roles of the client in a claim, and checks their role per endpoint and method.
+type adminAuth struct {
+	tokens []adminToken
+	// audit records the requests changing the server, if set
+	audit *adminAuditLog
+
+	issuer     string
+	audience   string
+	rolesClaim string
+	client     *http.Client
+
+	// the issuer is discovered on first use, so the server starts while the identity provider is down
+	mutex    sync.Mutex
+	verifier *oidc.IDTokenVerifier
+}
+
+// newAdminAuth sets up the authentication of the admin port. The admin token has the admin role, the json
+// array of tokens names a role per token. With an issuer, bearer JWTs for the audience are accepted too,
+// the highest role listed in their roles claim applies.
+func newAdminAuth(adminTokenValue string, tokensJSON string, issuer string, audience string, rolesClaim string) (*adminAuth, error) {
+	a := &adminAuth{
+		issuer:     strings.TrimSuffix(issuer, "/"),
+		audience:   audience,
+		rolesClaim: rolesClaim,
+		client:     &http.Client{Timeout: oidcRequestTimeout},
+	}
+	if adminTokenValue != "" {
+		a.tokens = append(a.tokens, adminToken{Name: "admin", Role: "admin", Token: adminTokenValue})
+	}
+	if strings.TrimSpace(tokensJSON) != "" {
+		var tokens []adminToken
+		if err := json.Unmarshal([]byte(tokensJSON), &tokens); err != nil {
+			return nil, fmt.Errorf("invalid admin tokens: %w", err)
+		}
+		a.tokens = append(a.tokens, tokens...)
+	}
+	names := make(map[string]bool)
+	for i, token := range a.tokens {
+		role, found := adminRoleNames[token.Role]
+		if !found {
+			return nil, fmt.Errorf("admin token %q has the unknown role %q, it must be viewer, operator or admin", token.Name, token.Role)
+		}
+		if token.Name == "" || names[token.Name] {
+			return nil, fmt.Errorf("admin token %q needs a unique name", token.Name)
+		}
+		if len(token.Token) < adminTokenMinLength {
+			return nil, fmt.Errorf("admin token %q must have at least %d characters", token.Name, adminTokenMinLength)
+		}
+		names[token.Name] = true
+		a.tokens[i].role = role
+	}
+	if a.issuer != "" && a.audience == "" {
+		return nil, fmt.Errorf("the admin OIDC issuer needs an audience")
+	}
+	if len(a.tokens) == 0 && a.issuer == "" {
+		return nil, fmt.Errorf("no admin tokens and no admin OIDC issuer")
+	}
+	return a, nil
+}
+
+// authenticate returns the client presenting the bearer token of the request.
+func (a *adminAuth) authenticate(req *http.Request) (adminPrincipal, bool) {
+	presented, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || presented == "" {
+		return adminPrincipal{}, false
+	}
+	// every token is compared, so the time taken tells nothing about which one matched
+	var principal adminPrincipal
+	for _, token := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token.Token)) == 1 {
+			principal = adminPrincipal{Name: token.Name, Role: token.role}
+		}
+	}
+	if principal.Role != 0 || a.issuer == "" || strings.Count(presented, ".") != 2 {
+		return principal, principal.Role != 0
+	}
+	verifier, err := a.discover(req.Context())
+	if err != nil {
+		slog.Error("Could not discover the admin OpenID Connect issuer", "issuer", a.issuer, "err", err)
+		return adminPrincipal{}, false
+	}
+	token, err := verifier.Verify(req.Context(), presented)
+	if err != nil {
+		slog.Warn("Refused admin token", "issuer", a.issuer, "err", err)
+		return adminPrincipal{}, false
+	}
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return adminPrincipal{}, false
+	}
+	// a dotted claim reaches into nested claims, e.g. realm_access.roles
+	var claim interface{} = claims
+	for _, name := range strings.Split(a.rolesClaim, ".") {
+		nested, _ := claim.(map[string]interface{})
+		claim = nested[name]
+	}
+	role := roleOfClaim(claim)
+	return adminPrincipal{Name: token.Subject, Role: role}, role != 0
+}
+
+// roleOfClaim returns the highest role named by the roles claim, a string or an array of strings.
+func roleOfClaim(claim interface{}) adminRole {
+	var names []string
+	switch claim := claim.(type) {
+	case string:
+		names = strings.Fields(claim)
+	case []interface{}:
+		for _, name := range claim {
+			if name, ok := name.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	var highest adminRole
+	for _, name := range names {
+		if role := adminRoleNames[name]; role > highest {
+			highest = role
+		}
+	}
+	return highest
+}
+
+func (a *adminAuth) discover(ctx context.Context) (*oidc.IDTokenVerifier, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.verifier != nil {
+		return a.verifier, nil
+	}
+	// the key set of the provider fetches the JWKS with the context it was created with
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.WithoutCancel(ctx), a.client), a.issuer)
+	if err != nil {
+		return nil, err
+	}
+	a.verifier = provider.Verifier(&oidc.Config{ClientID: a.audience})
+	slog.Info("Discovered the admin OpenID Connect issuer", "issuer", a.issuer)
+	return a.verifier, nil
+}
+
+// require lets the requests of clients through whose role is at least the one of the request method.
+// Methods not listed are left to the endpoint to refuse, for clients with any role. Requests changing the
+// server are recorded in the audit log, whether they were let through or not.
+func (a *adminAuth) require(roles map[string]adminRole, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		principal, found := a.authenticate(req)
+		if !found {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(w, req, http.StatusUnauthorized, "the admin endpoints require an admin token")
+			return
+		}
+		if a.audit != nil && audited(req.Method) {
+			recorder := newStatusRecorder(w)
+			body := &hashingReader{ReadCloser: req.Body, hash: sha256.New()}
+			req.Body = body
+			w = recorder
+			defer func() { a.audit.recordRequest(req, principal, recorder.status, body) }()
+		}
+		if role, listed := roles[req.Method]; listed && principal.Role < role {
+			slog.Warn("Refused admin request", "principal", principal.Name, "role", principal.Role, "method", req.Method, "path", req.URL.Path)
+			writeProblem(w, req, http.StatusForbidden, fmt.Sprintf("%s %s requires the %s role", req.Method, req.URL.Path, role))
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), adminPrincipalKey{}, principal)))
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminRoles(t *testing.T) {
+	admin, err := newAdminAuth("admin-0123456789", `[
+		{"name":"dashboard","role":"viewer","token":"viewer-0123456789"},
+		{"name":"ci","role":"operator","token":"operator-0123456789"}]`, "", "", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := admin.require(map[string]adminRole{http.MethodGet: roleViewer, http.MethodPut: roleOperator},
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if principal, found := principalOf(req); !found || principal.Name == "" {
+				t.Errorf("the endpoint got no principal")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "unknown-0123456789", http.StatusUnauthorized},
+		{"viewer reads", http.MethodGet, "viewer-0123456789", http.StatusNoContent},
+		{"viewer writes", http.MethodPut, "viewer-0123456789", http.StatusForbidden},
+		{"operator writes", http.MethodPut, "operator-0123456789", http.StatusNoContent},
+		{"admin writes", http.MethodPut, "admin-0123456789", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost/routing", nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestAdminTokensAreValidated(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens string
+	}{
+		{"unknown role", `[{"name":"ci","role":"owner","token":"operator-0123456789"}]`},
+		{"short token", `[{"name":"ci","role":"operator","token":"short"}]`},
+		{"no name", `[{"role":"operator","token":"operator-0123456789"}]`},
+		{"duplicate name", `[{"name":"admin","role":"viewer","token":"viewer-0123456789"}]`},
+		{"no tokens", ``},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			adminToken := "admin-0123456789"
+			if test.tokens == "" {
+				adminToken = ""
+			}
+			if _, err := newAdminAuth(adminToken, test.tokens, "", "", "roles"); err == nil {
+				t.Errorf("the tokens were accepted")
+			}
+		})
+	}
+}
+
+func TestRoleOfClaim(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim interface{}
+		want  adminRole
+	}{
+		{"array", []interface{}{"viewer", "operator", "billing"}, roleOperator},
+		{"space separated", "viewer admin", roleAdmin},
+		{"unknown roles", []interface{}{"billing"}, 0},
+		{"missing", nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := roleOfClaim(test.claim); got != test.want {
+				t.Errorf("role = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// adminAuditMemoryEntries bounds the entries kept in memory, the file keeps all of them.
+const adminAuditMemoryEntries = 10000
+
+// adminAuditGenesis is the previous hash of the first entry of a log.
+var adminAuditGenesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+// adminAuditEntry is an admin request that changed the server or was refused for its role. Every entry
+// holds the hash of the one before it, so an edited, removed or reordered entry breaks the chain.
+type adminAuditEntry struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal"`
+	Role       string    `json:"role"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	BodySHA256 string    `json:"bodySha256,omitempty"`
+	RequestID  string    `json:"requestId"`
+	Prev       string    `json:"prev"`
+	Hash       string    `json:"hash"`
+}
+
+// sum is the hash of the entry, the SHA-256 of its json without the hash.
+func (e adminAuditEntry) sum() string {
+	e.Hash = ""
+	entryJSON, _ := json.Marshal(e)
+	sum := sha256.Sum256(entryJSON)
+	return hex.EncodeToString(sum[:])
+}
+
+// adminAuditLog is the append-only, hash-chained log of the admin actions, kept in memory and, with a
+// path, appended to a file of json lines that survives restarts.
+type adminAuditLog struct {
+	path string
+
+	mutex   sync.Mutex
+	file    *os.File
+	entries []adminAuditEntry
+	// anchor is the previous hash of the first entry kept in memory
+	anchor string
+	last   string
+	seq    int64
+}
+
+// openAdminAuditLog continues the log of the file at the path, after verifying its chain. An empty path
+// keeps the log in memory only.
+func openAdminAuditLog(path string) (*adminAuditLog, error) {
+	l := &adminAuditLog{path: path, anchor: adminAuditGenesis, last: adminAuditGenesis}
+	if path == "" {
+		return l, nil
+	}
+	entries, err := readAdminAuditFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAdminAudit(adminAuditGenesis, entries); err != nil {
+		return nil, fmt.Errorf("the audit log %s was tampered with: %w", path, err)
+	}
+	if len(entries) > 0 {
+		l.last = entries[len(entries)-1].Hash
+		l.seq = entries[len(entries)-1].Seq
+	}
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Continuing the admin audit log", "path", path, "entries", len(entries))
+	return l, nil
+}
+
+func readAdminAuditFile(path string) ([]adminAuditEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []adminAuditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry adminAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d of %s: %w", len(entries)+1, path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAdminAudit checks that the entries follow each other, starting after the previous hash.
+func verifyAdminAudit(prev string, entries []adminAuditEntry) error {
+	for i, entry := range entries {
+		if i > 0 && entry.Seq != entries[i-1].Seq+1 {
+			return fmt.Errorf("entry %d follows entry %d", entry.Seq, entries[i-1].Seq)
+		}
+		if entry.Prev != prev {
+			return fmt.Errorf("entry %d does not follow the entry before it", entry.Seq)
+		}
+		if entry.Hash != entry.sum() {
+			return fmt.Errorf("entry %d does not match its hash", entry.Seq)
+		}
+		prev = entry.Hash
+	}
+	return nil
+}
+
+// record appends the entry to the chain and returns it with its hash.
+func (l *adminAuditLog) record(entry adminAuditEntry) (adminAuditEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entry.Seq = l.seq + 1
+	entry.Prev = l.last
+	entry.Hash = entry.sum()
+	var err error
+	if l.file != nil {
+		entryJSON, _ := json.Marshal(entry)
+		if _, err = l.file.Write(append(entryJSON, '\n')); err != nil {
+			return entry, err
+		}
+		// the entry is in the file, even if it may not have reached the disk
+		err = l.file.Sync()
+	}
+	l.seq = entry.Seq
+	l.last = entry.Hash
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > adminAuditMemoryEntries {
+		l.anchor = l.entries[0].Hash
+		l.entries = l.entries[1:]
+	}
+	return entry, err
+}
+
+// recordRequest records the admin request of the principal answered with the status.
+func (l *adminAuditLog) recordRequest(req *http.Request, principal adminPrincipal, status int, body *hashingReader) {
+	entry := adminAuditEntry{
+		Time:      time.Now().UTC(),
+		Principal: principal.Name,
+		Role:      principal.Role.String(),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Status:    status,
+		RequestID: req.Header.Get("X-Request-Id"),
+	}
+	if body.bytes > 0 {
+		entry.BodySHA256 = hex.EncodeToString(body.hash.Sum(nil))
+	}
+	entry, err := l.record(entry)
+	if err != nil {
+		slog.Error("Could not record the admin action in the audit log", "path", l.path, "err", err)
+	}
+	// the hash in the server log shows whether the newest entries were cut off the audit log
+	slog.Info("Admin action", "principal", entry.Principal, "method", entry.Method, "path", entry.Path, "status", entry.Status, "seq", entry.Seq, "hash", entry.Hash)
+}
+
+// read returns the entries after the sequence number, and why the chain is broken if it is. With a file
+// the file is read and verified, so a change to it after the start shows.
+func (l *adminAuditLog) read(after int64) (entries []adminAuditEntry, broken error, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entries, anchor := l.entries, l.anchor
+	if l.path != "" {
+		entries, err = readAdminAuditFile(l.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		anchor = adminAuditGenesis
+	}
+	broken = verifyAdminAudit(anchor, entries)
+	for len(entries) > 0 && entries[0].Seq <= after {
+		entries = entries[1:]
+	}
+	return entries, broken, nil
+}
+
+// hashingReader hashes what the endpoint reads of the request body.
+type hashingReader struct {
+	io.ReadCloser
+	hash  hash.Hash
+	bytes int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	r.bytes += int64(n)
+	return n, err
+}
+
+// audited tells if a request of the method changes the server, so it is recorded.
+func audited(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// newAdminAuditHandler answers GET /audit with the entries after the sequence number of the query
+// parameter after, and whether the chain is intact. A broken chain is answered with a 409 listing the
+// entries anyway, so the tampered entry can be found.
+func newAdminAuditHandler(log *adminAuditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeProblem(w, req, http.StatusMethodNotAllowed, "the audit log is read with GET")
+			return
+		}
+		var after int64
+		if value := req.URL.Query().Get("after"); value != "" {
+			var err error
+			after, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				writeProblem(w, req, http.StatusBadRequest, "after must be a sequence number")
+				return
+			}
+		}
+		entries, broken, err := log.read(after)
+		if err != nil {
+			writeProblem(w, req, http.StatusInternalServerError, fmt.Sprintf("could not read the audit log: %v", err))
+			return
+		}
+		report := struct {
+			Verified bool              `json:"verified"`
+			Error    string            `json:"error,omitempty"`
+			Entries  []adminAuditEntry `json:"entries"`
+		}{Verified: broken == nil, Entries: entries}
+		status := http.StatusOK
+		if broken != nil {
+			report.Error = broken.Error()
+			status = http.StatusConflict
+			slog.Error("The admin audit log is broken", "err", broken)
+		}
+		if report.Entries == nil {
+			report.Entries = []adminAuditEntry{}
+		}
+		body, _ := json.Marshal(report)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	})
+}
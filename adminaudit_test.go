@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuditRecordsChanges(t *testing.T) {
+	admin, err := newAdminAuth("", `[
+		{"name":"dashboard","role":"viewer","token":"viewer-0123456789"},
+		{"name":"ci","role":"operator","token":"operator-0123456789"}]`, "", "", "roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.audit, err = openAdminAuditLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := admin.require(map[string]adminRole{http.MethodGet: roleViewer, http.MethodPut: roleOperator},
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = req.Body.Read(make([]byte, 64))
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	send := func(method string, token string, body string) {
+		req := httptest.NewRequest(method, "http://localhost/routing", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send(http.MethodGet, "viewer-0123456789", "")
+	send(http.MethodPut, "viewer-0123456789", `{"redirects":[]}`)
+	send(http.MethodPut, "operator-0123456789", `{"rewrites":[]}`)
+
+	entries, broken, err := admin.audit.read(0)
+	if err != nil || broken != nil {
+		t.Fatal(err, broken)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want the 2 changes", len(entries))
+	}
+	if entries[0].Principal != "dashboard" || entries[0].Status != http.StatusForbidden {
+		t.Errorf("first entry = %+v, want the refused change of the viewer", entries[0])
+	}
+	sum := sha256.Sum256([]byte(`{"rewrites":[]}`))
+	if entries[1].Principal != "ci" || entries[1].Status != http.StatusNoContent || entries[1].BodySHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("second entry = %+v, want the change of the operator", entries[1])
+	}
+	if entries[1].Prev != entries[0].Hash {
+		t.Errorf("the entries are not chained")
+	}
+}
+
+func TestAdminAuditFileDetectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := openAdminAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []int{http.StatusOK, http.StatusForbidden} {
+		if _, err := log.record(adminAuditEntry{Principal: "ci", Method: http.MethodPut, Path: "/routing", Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a restart continues the chain
+	log, err = openAdminAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := log.record(adminAuditEntry{Principal: "ci", Method: http.MethodPut, Path: "/routing", Status: http.StatusOK}); err != nil {
+		t.Fatal(err)
+	}
+	entries, broken, err := log.read(1)
+	if err != nil || broken != nil {
+		t.Fatal(err, broken)
+	}
+	if len(entries) != 2 || entries[1].Seq != 3 {
+		t.Fatalf("entries after 1 = %+v, want 2 and 3", entries)
+	}
+
+	// the refused change is turned into a successful one
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Replace(string(content), `"status":403`, `"status":200`, 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, broken, _ := log.read(0); broken == nil || !strings.Contains(broken.Error(), "entry 2") {
+		t.Errorf("broken = %v, want entry 2 reported", broken)
+	}
+	if _, err := openAdminAuditLog(path); err == nil {
+		t.Errorf("the tampered log was continued")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// archiveRoute serves a zip of all files of the bundle below the prefix at the path, built on the fly
+// instead of shipping prebuilt archives in the image.
+type archiveRoute struct {
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"`
+}
+
+func parseArchiveRoutes(routesJSON string) ([]archiveRoute, error) {
+	var routes []archiveRoute
+	err := json.Unmarshal([]byte(routesJSON), &routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/") || !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("archive route path %q and prefix %q must start with /", route.Path, route.Prefix)
+		}
+	}
+	return routes, nil
+}
+
+// archiveEntries returns the sorted paths of the files of the bundle within the prefix, the prefix ends at
+// a path segment.
+func archiveEntries(files map[string]loadedFile, prefix string) []string {
+	var entries []string
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	for filePath := range files {
+		if strings.HasPrefix(filePath, prefix) && filePath != indexFileName && filePath != configFileName {
+			entries = append(entries, filePath)
+		}
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// newArchiveHandler streams the zip of an archive route for GET requests of its path, all other requests
+// are passed to the next handler. The archive holds the files of the bundle served at the time of the
+// request, source maps only for clients the source map policy permits them to.
+func newArchiveHandler(routes []archiveRoute, bundle func() map[string]loadedFile, sourcemaps *sourcemapPolicy, next http.Handler) http.Handler {
+	// the files of the bundle have no modification time, they are as old as the server
+	modified := time.Now()
+	prefixes := make(map[string]string, len(routes))
+	for _, route := range routes {
+		prefixes[route.Path] = route.Prefix
+		slog.Info("Serving archive", "path", route.Path, "prefix", route.Prefix, "files", len(archiveEntries(bundle(), route.Prefix)))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prefix, found := prefixes[req.URL.Path]
+		if !found {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeProblem(w, req, http.StatusMethodNotAllowed, "archives only serve GET and HEAD requests")
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(req.URL.Path)}))
+		w.Header().Set("Cache-Control", "no-cache")
+		if req.Method == http.MethodHead {
+			return
+		}
+
+		files := bundle()
+		withSourcemaps := sourcemaps.permits(req)
+		archive := zip.NewWriter(w)
+		for _, filePath := range archiveEntries(files, prefix) {
+			if isSourcemap(filePath) && !withSourcemaps {
+				continue
+			}
+			file := files[filePath]
+			method := zip.Store
+			if compressible(file.mime) {
+				method = zip.Deflate
+			}
+			entry, err := archive.CreateHeader(&zip.FileHeader{
+				Name:     strings.TrimPrefix(filePath, strings.TrimSuffix(prefix, "/")+"/"),
+				Method:   method,
+				Modified: modified,
+			})
+			var content []byte
+			if err == nil {
+				content, err = file.content()
+			}
+			if err == nil {
+				_, err = entry.Write(content)
+			}
+			if err != nil {
+				// the status is sent already, the client receives a truncated archive
+				slog.Error("Could not stream archive", "path", req.URL.Path, "file", filePath, "err", err)
+				return
+			}
+		}
+		err := archive.Close()
+		if err != nil {
+			slog.Error("Could not stream archive", "path", req.URL.Path, "err", err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+type auditFinding struct {
+	path   string
+	kind   string
+	detail string
+}
+
+// secretPatterns are checked in this order, so the report is the same on every run and can be diffed.
+var secretPatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"aws access key", regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`)},
+	{"private key", regexp.MustCompile(`-----BEGIN (RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`)},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	{"google api key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"github token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+	{"slack token", regexp.MustCompile(`\bxox[abprs]-[0-9A-Za-z-]{10,}`)},
+	{"stripe live key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+}
+
+// auditBundle scans the bundle for files that should not be shipped: likely secrets, source maps and
+// assets larger than maxSize bytes. The findings are ordered by path.
+func auditBundle(source bundleSource, maxSize int) ([]auditFinding, error) {
+	var findings []auditFinding
+	paths, err := source.list()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		file, err := readFile(source, path)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Ext(path) == ".map" {
+			findings = append(findings, auditFinding{path, "source map", "source maps expose the original sources"})
+		}
+		if maxSize > 0 && len(file) > maxSize {
+			findings = append(findings, auditFinding{path, "oversized asset", fmt.Sprintf("%d bytes exceed the limit of %d bytes", len(file), maxSize)})
+		}
+		for _, secret := range secretPatterns {
+			if match := secret.pattern.Find(file); match != nil {
+				findings = append(findings, auditFinding{path, "possible secret", fmt.Sprintf("%s %s", secret.kind, redact(string(match)))})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// redact keeps just enough of a secret to find it in the bundle.
+func redact(secret string) string {
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return secret[:8] + "****"
+}
+
+// runAudit implements the audit subcommand. It returns the exit code, which is 1 when there are findings,
+// so the subcommand can be used as a gate in CI pipelines.
+func runAudit(args []string) int {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	maxSize := flags.Int("max-size", 5*1024*1024, "report assets larger than this number of bytes, 0 disables the check")
+	_ = flags.Parse(args)
+
+	source, err := newBundleSource(getenvString("STATIC_DIR", ""), getenvString("OVERLAY_DIR", ""))
+	if err != nil {
+		fmt.Printf("Could not open the bundle. err: %v\n", err)
+		return 2
+	}
+	findings, err := auditBundle(source, *maxSize)
+	if err != nil {
+		fmt.Printf("Could not audit the bundle. err: %v\n", err)
+		return 2
+	}
+	for _, finding := range findings {
+		fmt.Printf("%s: %s: %s\n", finding.path, finding.kind, finding.detail)
+	}
+	if len(findings) > 0 {
+		fmt.Printf("Found %d issues in the bundle\n", len(findings))
+		return 1
+	}
+	fmt.Println("No issues found in the bundle")
+	return 0
+}
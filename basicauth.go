@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthCacheTTL is how long verified credentials are remembered. A bcrypt comparison takes tens of
+// milliseconds by design, too long to repeat for every asset of the SPA.
+const basicAuthCacheTTL = 5 * time.Minute
+const basicAuthCacheMaxEntries = 10000
+
+// basicAuthGate asks for the credentials of one of the users before serving any request, except for the
+// paths with an excluded prefix.
+type basicAuthGate struct {
+	users    map[string][]byte
+	realm    string
+	excluded []string
+	// anyHash is compared for unknown users, so the time taken does not tell which users exist
+	anyHash []byte
+
+	mutex    sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// parseHtpasswd parses the users of an htpasswd file, one user:hash per line or separated by commas. Only
+// bcrypt hashes are accepted, e.g. created with htpasswd -nB user.
+func parseHtpasswd(htpasswd string) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	for _, line := range strings.FieldsFunc(htpasswd, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("htpasswd entry %q must be of the form user:hash", line)
+		}
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") && !strings.HasPrefix(hash, "$2y$") {
+			return nil, fmt.Errorf("the hash of user %s must be a bcrypt hash", user)
+		}
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("the hash of user %s is invalid: %w", user, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no users found")
+	}
+	return users, nil
+}
+
+// newPasswordGate protects all paths with the single user and password, e.g. those of the preview mode. The
+// password is hashed like those of an htpasswd file, so both are checked the same way.
+func newPasswordGate(username string, password string, realm string) (*basicAuthGate, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return newBasicAuthGate(map[string][]byte{username: hash}, realm, ""), nil
+}
+
+// newBasicAuthGate protects all paths except those starting with one of the comma separated excluded prefixes.
+func newBasicAuthGate(users map[string][]byte, realm string, excluded string) *basicAuthGate {
+	gate := &basicAuthGate{
+		users:    users,
+		realm:    realm,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}
+	for _, prefix := range strings.Split(excluded, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			gate.excluded = append(gate.excluded, prefix)
+		}
+	}
+	for _, hash := range users {
+		gate.anyHash = hash
+		break
+	}
+	return gate
+}
+
+// verify tells if the password is the one of the user, remembering successful verifications for a while.
+func (g *basicAuthGate) verify(user string, password string) bool {
+	hash, found := g.users[user]
+	if !found {
+		_ = bcrypt.CompareHashAndPassword(g.anyHash, []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + string(hash)))
+	now := time.Now()
+	g.mutex.Lock()
+	expires, cached := g.verified[key]
+	g.mutex.Unlock()
+	if cached && now.Before(expires) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.verified) >= basicAuthCacheMaxEntries {
+		for k, expires := range g.verified {
+			if now.After(expires) {
+				delete(g.verified, k)
+			}
+		}
+		if len(g.verified) >= basicAuthCacheMaxEntries {
+			return true
+		}
+	}
+	g.verified[key] = now.Add(basicAuthCacheTTL)
+	return true
+}
+
+// authorize tells if the request carries the credentials of one of the users, otherwise it answers with a
+// 401 asking for them.
+func (g *basicAuthGate) authorize(w http.ResponseWriter, req *http.Request) bool {
+	user, password, found := req.BasicAuth()
+	if !found || !g.verify(user, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", g.realm))
+		writeProblem(w, req, http.StatusUnauthorized, "this server requires credentials")
+		return false
+	}
+	return true
+}
+
+// underAnyPrefix tells if the cleaned path lies under one of the prefixes, matching whole path segments. The
+// prefix /public covers /public/logo.svg, but neither /publicity nor /public/../admin, which a proxied
+// backend may resolve to /admin.
+func underAnyPrefix(p string, prefixes []string) bool {
+	p = path.Clean(p)
+	for _, prefix := range prefixes {
+		if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handler lets only requests with valid credentials through, and those of the excluded paths.
+func (g *basicAuthGate) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if underAnyPrefix(req.URL.Path, g.excluded) || g.authorize(w, req) {
+			next.ServeHTTP(w, req)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuthGateExcludedPaths(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := newBasicAuthGate(map[string][]byte{"alice": hash}, "Restricted", "/public, /assets/")
+	handler := gate.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/public", http.StatusOK},
+		{"/public/logo.svg", http.StatusOK},
+		{"/assets/main.js", http.StatusOK},
+		{"/publicity", http.StatusUnauthorized},
+		{"/public/../admin", http.StatusUnauthorized},
+		{"/public/%2e%2e/admin", http.StatusUnauthorized},
+		{"/assets", http.StatusUnauthorized},
+		{"/admin", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chaosRule degrades the responses of all paths starting with the prefix, to test the loading states and
+// retries of the SPA. Every request is delayed by LatencyMs plus up to JitterMs, ErrorPercent of the
+// requests fail with ErrorStatus, and the body of the others is sent with at most BytesPerSecond.
+type chaosRule struct {
+	Prefix         string  `json:"prefix"`
+	LatencyMs      uint64  `json:"latencyMs"`
+	JitterMs       uint64  `json:"jitterMs"`
+	ErrorPercent   float64 `json:"errorPercent"`
+	ErrorStatus    int     `json:"errorStatus"`
+	BytesPerSecond int     `json:"bytesPerSecond"`
+}
+
+func parseChaosRules(rulesJSON string) ([]chaosRule, error) {
+	var rules []chaosRule
+	err := json.Unmarshal([]byte(rulesJSON), &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return nil, fmt.Errorf("chaos rule prefix %q must start with /", rule.Prefix)
+		}
+		if rule.ErrorPercent < 0 || rule.ErrorPercent > 100 {
+			return nil, fmt.Errorf("chaos rule error percent %v must be between 0 and 100", rule.ErrorPercent)
+		}
+		if rule.ErrorStatus == 0 {
+			rules[i].ErrorStatus = http.StatusServiceUnavailable
+		}
+		if rules[i].ErrorStatus < 500 || rules[i].ErrorStatus > 599 {
+			return nil, fmt.Errorf("chaos rule error status %d must be a 5xx status", rule.ErrorStatus)
+		}
+		if rule.BytesPerSecond < 0 {
+			return nil, fmt.Errorf("chaos rule bytes per second %d must not be negative", rule.BytesPerSecond)
+		}
+	}
+	return rules, nil
+}
+
+// throttledWriter sends the body in slices of a tenth of the bandwidth, each followed by a tenth of a second.
+type throttledWriter struct {
+	http.ResponseWriter
+	controller *http.ResponseController
+	slice      int
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), w.slice)
+		n, err := w.ResponseWriter.Write(b[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+		_ = w.controller.Flush()
+		time.Sleep(100 * time.Millisecond)
+	}
+	return written, nil
+}
+
+// Unwrap allows http.ResponseController to reach the original response writer.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// newChaosHandler applies the first chaos rule whose prefix matches the path, all other requests are
+// passed to the next handler unchanged.
+func newChaosHandler(rules []chaosRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rule := range rules {
+			if !strings.HasPrefix(req.URL.Path, rule.Prefix) {
+				continue
+			}
+			delay := time.Duration(rule.LatencyMs) * time.Millisecond
+			if rule.JitterMs > 0 {
+				delay += time.Duration(rand.Int63n(int64(rule.JitterMs)+1)) * time.Millisecond
+			}
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return
+			}
+			if rand.Float64()*100 < rule.ErrorPercent {
+				writeProblem(w, req, rule.ErrorStatus, "injected by a chaos rule")
+				return
+			}
+			if rule.BytesPerSecond > 0 {
+				w = &throttledWriter{
+					ResponseWriter: w,
+					controller:     http.NewResponseController(w),
+					slice:          max(rule.BytesPerSecond/10, 1),
+				}
+			}
+			break
+		}
+		next.ServeHTTP(w, req)
+	})
+}
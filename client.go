@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client that issued the request. The X-Forwarded-For header is only
+// considered when the server runs behind trusted proxies, otherwise clients could spoof their address. Every
+// proxy appends the address it received the request from, so the client is the entry added by the first of
+// the trusted proxies, counted from the right. Entries further left are sent by the client itself.
+func clientIP(req *http.Request, trustedProxyHops int) string {
+	if trustedProxyHops > 0 {
+		var entries []string
+		for _, forwarded := range req.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(forwarded, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		if len(entries) > 0 {
+			return entries[max(len(entries)-trustedProxyHops, 0)]
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// isHTTPS tells if the client connected with https, to the server or, if the proxy headers are trusted, to
+// the proxy in front of it.
+func isHTTPS(req *http.Request, trustedProxyHops int) bool {
+	return req.TLS != nil || trustedProxyHops > 0 && req.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// parseIPNets parses a comma separated list of ip addresses and cidr ranges.
+func parseIPNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name             string
+		trustedProxyHops int
+		forwardedFor     []string
+		want             string
+	}{
+		{"no proxy", 0, nil, "192.0.2.1"},
+		{"untrusted header", 0, []string{"203.0.113.7"}, "192.0.2.1"},
+		{"one trusted proxy", 1, []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entry before one trusted proxy", 1, []string{"198.51.100.66, 203.0.113.7"}, "203.0.113.7"},
+		{"spoofed header line before one trusted proxy", 1, []string{"198.51.100.66", "203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entry before two trusted proxies", 2, []string{"198.51.100.66, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"fewer entries than trusted proxies", 3, []string{"203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"empty entries", 1, []string{" , "}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			req.RemoteAddr = "192.0.2.1:41234"
+			for _, forwarded := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwarded)
+			}
+			if got := clientIP(req, test.trustedProxyHops); got != test.want {
+				t.Errorf("clientIP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsHTTPS(t *testing.T) {
+	tests := []struct {
+		name             string
+		trustedProxyHops int
+		forwardedProto   string
+		want             bool
+	}{
+		{"plain http", 0, "", false},
+		{"untrusted forwarded https", 0, "https", false},
+		{"trusted forwarded https", 1, "https", true},
+		{"trusted forwarded http", 1, "http", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			if test.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+			}
+			if got := isHTTPS(req, test.trustedProxyHops); got != test.want {
+				t.Errorf("isHTTPS = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
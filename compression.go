@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// lazyContent holds the content of a file that is kept compressed in memory and decompressed on first use.
+type lazyContent struct {
+	once sync.Once
+	file []byte
+	err  error
+}
+
+// content returns the uncompressed content of the file, lazily compressed files are decompressed once and
+// kept in memory from then on.
+func (f loadedFile) content() ([]byte, error) {
+	if f.lazy == nil {
+		return f.file, nil
+	}
+	f.lazy.once.Do(func() {
+		f.lazy.file, f.lazy.err = gunzip(f.encoded["gzip"])
+		if f.lazy.err != nil {
+			f.lazy.err = fmt.Errorf("could not decompress file: %w", f.lazy.err)
+		}
+	})
+	return f.lazy.file, f.lazy.err
+}
+
+// uncompressed returns the uncompressed content of the file without keeping it in memory, for computations
+// done once at startup.
+func (f loadedFile) uncompressed() ([]byte, error) {
+	if f.lazy == nil {
+		return f.file, nil
+	}
+	file, err := gunzip(f.encoded["gzip"])
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress file: %w", err)
+	}
+	return file, nil
+}
+
+// compressibleTypes are the mime type prefixes worth compressing, images, fonts and media are compressed
+// already.
+var compressibleTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xml",
+	"image/svg+xml",
+	"font/otf",
+	"font/ttf",
+}
+
+// supportedEncodings are the content encodings assets can be precompressed with, in order of preference.
+var supportedEncodings = []string{"br", "gzip"}
+
+// siblingEncodings maps the extensions of files precompressed by the build to their content encoding.
+var siblingEncodings = map[string]string{
+	".br": "br",
+	".gz": "gzip",
+}
+
+// attachPrecompressedSiblings serves files like main.js.gz and main.js.br emitted by the build as the
+// compressed content of main.js, instead of compressing main.js at startup. Only files of a compressible
+// type have siblings, so an archive like backup.tar.gz stays a file of its own, and the siblings are still
+// served under their own path as well. A sibling that does not decompress to the file, e.g. a stale one of
+// a previous build, is left out and the file is compressed at startup instead.
+func attachPrecompressedSiblings(files map[string]loadedFile) {
+	for path, sibling := range files {
+		encoding, found := siblingEncodings[filepath.Ext(path)]
+		if !found {
+			continue
+		}
+		sourcePath := strings.TrimSuffix(path, filepath.Ext(path))
+		file, found := files[sourcePath]
+		if !found || !compressible(file.mime) {
+			continue
+		}
+		decompressed, err := decompress(encoding, sibling.file)
+		if err != nil {
+			slog.Warn("Ignoring precompressed file that does not decompress", "file", path, "err", err)
+			continue
+		}
+		if !bytes.Equal(decompressed, file.file) {
+			slog.Warn("Ignoring precompressed file that does not match its source", "file", path, "source", sourcePath)
+			continue
+		}
+		if file.encoded == nil {
+			file.encoded = make(map[string][]byte, len(supportedEncodings))
+		}
+		file.encoded[encoding] = sibling.file
+		files[sourcePath] = file
+	}
+}
+
+// parseEncodings parses the comma separated content encodings to precompress the assets with.
+func parseEncodings(list string) (map[string]bool, error) {
+	encodings := make(map[string]bool)
+	if list == "none" {
+		return encodings, nil
+	}
+	for _, encoding := range strings.Split(list, ",") {
+		encoding = strings.TrimSpace(encoding)
+		if !containsString(supportedEncodings, encoding) {
+			return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+		encodings[encoding] = true
+	}
+	return encodings, nil
+}
+
+func compressible(mimeType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// precompress adds the content compressed with each of the encodings to the file, unless compression does
+// not make the file smaller or the build precompressed it already. With lazy decompression, only the
+// compressed content is kept in memory, so gzip is always added.
+func precompress(file loadedFile, encodings map[string]bool, lazy bool) (loadedFile, error) {
+	if !compressible(file.mime) && !lazy {
+		return file, nil
+	}
+	if file.encoded == nil {
+		file.encoded = make(map[string][]byte, len(supportedEncodings))
+	}
+	for _, encoding := range supportedEncodings {
+		if !encodings[encoding] && !(lazy && encoding == "gzip") {
+			continue
+		}
+		if _, found := file.encoded[encoding]; found {
+			continue
+		}
+		compressed, err := compress(encoding, file.file)
+		if err != nil {
+			return file, err
+		}
+		if len(compressed) < len(file.file) {
+			file.encoded[encoding] = compressed
+		}
+	}
+	if lazy && file.encoded["gzip"] != nil {
+		file.file = nil
+		file.lazy = &lazyContent{}
+	}
+	return file, nil
+}
+
+func compress(encoding string, content []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "br":
+		writer = brotli.NewWriterLevel(&compressed, brotli.BestCompression)
+	case "gzip":
+		gzipWriter, err := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		writer = gzipWriter
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	_, err := writer.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func decompress(encoding string, compressed []byte) ([]byte, error) {
+	switch encoding {
+	case "br":
+		return io.ReadAll(brotli.NewReader(bytes.NewReader(compressed)))
+	case "gzip":
+		return gunzip(compressed)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+func gunzip(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// acceptsEncoding tells if the client accepts the content encoding, an encoding with q=0 is refused. Content
+// codings are case-insensitive, and an entry naming the encoding takes precedence over *, wherever it is
+// listed, so "*;q=0, gzip" accepts gzip.
+func acceptsEncoding(req *http.Request, encoding string) bool {
+	exact, wildcard := -1.0, -1.0
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, accepted := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(accepted, ";")
+			name = strings.TrimSpace(name)
+			quality := 1.0
+			if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				var err error
+				quality, err = strconv.ParseFloat(q, 64)
+				if err != nil {
+					quality = 0
+				}
+			}
+			switch {
+			case strings.EqualFold(name, encoding):
+				exact = quality
+			case name == "*":
+				wildcard = quality
+			}
+		}
+	}
+	if exact >= 0 {
+		return exact > 0
+	}
+	return wildcard > 0
+}
+
+// negotiateEncoding picks the smallest of the precompressed contents the client accepts, an empty encoding
+// means the client accepts none of them.
+func negotiateEncoding(req *http.Request, encoded map[string][]byte) string {
+	negotiated := ""
+	for _, encoding := range supportedEncodings {
+		content, found := encoded[encoding]
+		if !found || !acceptsEncoding(req, encoding) {
+			continue
+		}
+		if negotiated == "" || len(content) < len(encoded[negotiated]) {
+			negotiated = encoding
+		}
+	}
+	return negotiated
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAttachPrecompressedSiblings(t *testing.T) {
+	content := []byte(`console.log("main");`)
+	gzipped, err := compress("gzip", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brotlied, err := compress("br", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := compress("gzip", []byte(`console.log("previous build");`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		source   loadedFile
+		sibling  string
+		content  []byte
+		attached bool
+	}{
+		{"gzip", loadedFile{file: content, mime: "text/javascript"}, "/main.js.gz", gzipped, true},
+		{"brotli", loadedFile{file: content, mime: "text/javascript"}, "/main.js.br", brotlied, true},
+		{"stale", loadedFile{file: content, mime: "text/javascript"}, "/main.js.gz", stale, false},
+		{"corrupt gzip", loadedFile{file: content, mime: "text/javascript"}, "/main.js.gz", []byte("not gzip"), false},
+		{"corrupt brotli", loadedFile{file: content, mime: "text/javascript"}, "/main.js.br", []byte("not brotli"), false},
+		{"incompressible source", loadedFile{file: content, mime: "application/x-tar"}, "/main.js.gz", gzipped, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := map[string]loadedFile{
+				"/main.js":   test.source,
+				test.sibling: {file: test.content, mime: "application/gzip"},
+			}
+			attachPrecompressedSiblings(files)
+			if _, found := files[test.sibling]; !found {
+				t.Errorf("%s is no longer served on its own", test.sibling)
+			}
+			if attached := len(files["/main.js"].encoded) == 1; attached != test.attached {
+				t.Errorf("%s attached = %v, want %v", test.sibling, attached, test.attached)
+			}
+		})
+	}
+
+	// an archive without an uncompressed source stays a file of its own
+	files := map[string]loadedFile{"/backup.tar.gz": {file: gzipped, mime: "application/gzip"}}
+	attachPrecompressedSiblings(files)
+	if _, found := files["/backup.tar.gz"]; !found || len(files) != 1 {
+		t.Errorf("/backup.tar.gz is no longer served")
+	}
+}
+
+func TestLazyContentReportsCorruptContent(t *testing.T) {
+	file := loadedFile{encoded: map[string][]byte{"gzip": []byte("not gzip")}, lazy: &lazyContent{}}
+	for i := 0; i < 2; i++ {
+		if _, err := file.content(); err == nil {
+			t.Fatalf("content() of call %d returned no error", i+1)
+		}
+	}
+	if _, err := file.uncompressed(); err == nil {
+		t.Fatal("uncompressed() returned no error")
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		want           bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"br, gzip", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"Br;q=0.8", "br", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip;q=0.0", "gzip", false},
+		{"gzip;q=invalid", "gzip", false},
+		{"deflate", "gzip", false},
+		{"*", "gzip", true},
+		{"*;q=0", "gzip", false},
+		{"*;q=0, gzip", "gzip", true},
+		{"gzip, *;q=0", "gzip", true},
+		{"*, gzip;q=0", "gzip", false},
+		{"gzip;q=0, *", "gzip", false},
+		{"*;q=0, GZip;q=0.5", "gzip", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/main.js", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		if got := acceptsEncoding(req, test.encoding); got != test.want {
+			t.Errorf("acceptsEncoding(%q, %s) = %v, want %v", test.acceptEncoding, test.encoding, got, test.want)
+		}
+	}
+}
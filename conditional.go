@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// shellETag identifies the html shell served for a mount, from the rendered index.html and the headers
+// sent along with it. The nonce is not part of it, so revalidation works across responses.
+func shellETag(index []byte, headers ...string) string {
+	hash := sha256.New()
+	hash.Write(index)
+	for _, header := range headers {
+		fmt.Fprintf(hash, "\n%s", header)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)[:16])
+}
+
+// themedETag adds the theme of the host to the etag of the shell.
+func themedETag(etag string, injection themeInjection) string {
+	hash := sha256.New()
+	hash.Write(injection.head)
+	hash.Write(injection.title)
+	return fmt.Sprintf("%s-%x", etag, hash.Sum(nil)[:4])
+}
+
+// notModified tells if the If-None-Match header of the request matches the etag.
+func notModified(req *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// contentETag is the strong etag of the content, a truncated sha256 hash.
+func contentETag(content []byte) string {
+	hash := sha256.Sum256(content)
+	return fmt.Sprintf("\"%x\"", hash[:16])
+}
+
+// encodedETag derives the etag of a compressed variant, as a strong etag must differ between the encodings.
+func encodedETag(etag string, encoding string) string {
+	return fmt.Sprintf("%s-%s\"", strings.TrimSuffix(etag, "\""), encoding)
+}
+
+// writeNotModified answers a matching revalidation, the client keeps using the content and the headers it
+// received with it.
+func writeNotModified(w http.ResponseWriter) {
+	for _, name := range []string{"Content-Type", "Content-Encoding", "Content-Disposition", "Priority"} {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// buildTime is the modification time of the executable, the files embedded into it have none of their own.
+func buildTime() time.Time {
+	executable, err := os.Executable()
+	if err == nil {
+		info, err := os.Stat(executable)
+		if err == nil {
+			return info.ModTime()
+		}
+	}
+	return time.Now()
+}
+
+// notModifiedSince tells if the content was not modified after the If-Modified-Since header of the request.
+// The header is ignored when the request has an If-None-Match header.
+func notModifiedSince(req *http.Request, modified time.Time) bool {
+	if req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// loadConfigJSON returns the runtime config. When CONFIG_JSON_ENCRYPTED is set, it is decrypted in memory
+// with the age identity, so no plaintext config has to be placed in the manifests. Without CONFIG_JSON,
+// the config.json of the overlay directory is used if there is one.
+func loadConfigJSON(overlayDir string) ([]byte, error) {
+	encrypted := getenvString("CONFIG_JSON_ENCRYPTED", "")
+	if encrypted == "" && os.Getenv("CONFIG_JSON") == "" && overlayDir != "" {
+		config, err := os.ReadFile(filepath.Join(overlayDir, configFileName))
+		if err == nil && !json.Valid(config) {
+			return nil, errors.New("the config.json of the overlay directory is not valid json")
+		}
+		if err == nil {
+			return config, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if encrypted == "" {
+		return []byte(getenvString("CONFIG_JSON", "{}")), nil
+	}
+
+	identity := getenvString("AGE_IDENTITY", "")
+	if identityFile := getenvString("AGE_IDENTITY_FILE", ""); identityFile != "" {
+		content, err := os.ReadFile(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		identity = string(content)
+	}
+	if identity == "" {
+		return nil, errors.New("CONFIG_JSON_ENCRYPTED needs AGE_IDENTITY or AGE_IDENTITY_FILE")
+	}
+	identities, err := age.ParseIdentities(strings.NewReader(identity))
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := age.Decrypt(armor.NewReader(strings.NewReader(encrypted)), identities...)
+	if err != nil {
+		return nil, err
+	}
+	config, err := io.ReadAll(decrypted)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(config) {
+		return nil, errors.New("the decrypted config is not valid json")
+	}
+	return config, nil
+}
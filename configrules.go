@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// configMatch holds the conditions of a config rule, all of them must be met by a request.
+type configMatch struct {
+	Headers map[string]string `json:"headers"`
+	Cookies map[string]string `json:"cookies"`
+	Query   map[string]string `json:"query"`
+	IPs     []string          `json:"ips"`
+	ipNets  []*net.IPNet
+}
+
+// configRule merges its config over the runtime config for requests matching the conditions.
+type configRule struct {
+	Match  configMatch            `json:"match"`
+	Config map[string]interface{} `json:"config"`
+}
+
+func parseConfigRules(rulesJSON string) ([]configRule, error) {
+	var rules []configRule
+	err := json.Unmarshal([]byte(rulesJSON), &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rules[i].Match.ipNets, err = parseIPNets(strings.Join(rules[i].Match.IPs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("config rule %d: %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (m configMatch) matches(req *http.Request, trustedProxyHops int) bool {
+	for name, value := range m.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	for name, value := range m.Cookies {
+		cookie, err := req.Cookie(name)
+		if err != nil || cookie.Value != value {
+			return false
+		}
+	}
+	query := req.URL.Query()
+	for name, value := range m.Query {
+		if query.Get(name) != value {
+			return false
+		}
+	}
+	if len(m.ipNets) > 0 && !containsIP(m.ipNets, clientIP(req, trustedProxyHops)) {
+		return false
+	}
+	return true
+}
+
+// applyConfigRules merges the config of every rule matching the request over the runtime config, in the
+// order of the rules.
+func applyConfigRules(config []byte, rules []configRule, req *http.Request, trustedProxyHops int) ([]byte, error) {
+	var doc map[string]interface{}
+	for _, rule := range rules {
+		if !rule.Match.matches(req, trustedProxyHops) {
+			continue
+		}
+		if doc == nil {
+			err := json.Unmarshal(config, &doc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		mergeJSON(doc, rule.Config)
+	}
+	if doc == nil {
+		return config, nil
+	}
+	return json.Marshal(doc)
+}
+
+// mergeJSON merges the override into the base object, nested objects are merged recursively and all other
+// values are replaced.
+func mergeJSON(base map[string]interface{}, override map[string]interface{}) {
+	for key, value := range override {
+		overrideObject, overrideIsObject := value.(map[string]interface{})
+		baseObject, baseIsObject := base[key].(map[string]interface{})
+		if overrideIsObject && !baseIsObject {
+			// copy the object, so later rules never modify the config of this rule
+			baseObject = make(map[string]interface{}, len(overrideObject))
+			base[key] = baseObject
+		}
+		if overrideIsObject {
+			mergeJSON(baseObject, overrideObject)
+		} else {
+			base[key] = value
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestResponseConformance runs the checks of the smoke subcommand against the handler chain, for every
+// compression mode and content encoding: HEAD, ranged and unsatisfiable requests must be answered with
+// headers consistent with the full response.
+func TestResponseConformance(t *testing.T) {
+	modes := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"gzip", map[string]string{"COMPRESSION": "gzip"}},
+		{"gzip and brotli", map[string]string{"COMPRESSION": "gzip,br"}},
+		{"uncompressed", map[string]string{"COMPRESSION": "none"}},
+		{"lazy decompression", map[string]string{"COMPRESSION": "gzip", "LAZY_DECOMPRESSION": "true"}},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			server := httptest.NewServer(newTestServer(t, mode.env))
+			defer server.Close()
+
+			for _, result := range smokeTest(server.Client(), server.URL, "", true) {
+				if result.failed {
+					t.Errorf("%s: %s", result.check, result.detail)
+				}
+			}
+			for _, asset := range []string{"/assets/main.3f2a1b9c.css", "/logo.svg", configFileName, "/"} {
+				for _, encoding := range []string{"identity", "gzip", "br"} {
+					if failure := smokeHeaders(server.Client(), server.URL, asset, encoding); failure != "" {
+						t.Errorf("%s (%s): %s", asset, encoding, failure)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestNotModifiedConformance checks that revalidations are answered with a 304 without a body and without
+// the headers describing one.
+func TestNotModifiedConformance(t *testing.T) {
+	handler := newTestServer(t, map[string]string{"COMPRESSION": "gzip"})
+	for _, path := range []string{"/assets/main.3f2a1b9c.js", "/logo.svg", "/"} {
+		for _, encoding := range []string{"identity", "gzip"} {
+			t.Run(fmt.Sprintf("%s %s", path, encoding), func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set("Accept-Encoding", encoding)
+				full := httptest.NewRecorder()
+				handler.ServeHTTP(full, req)
+				etag := full.Result().Header.Get("ETag")
+				if etag == "" {
+					t.Fatalf("no ETag")
+				}
+
+				req = httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set("Accept-Encoding", encoding)
+				req.Header.Set("If-None-Match", etag)
+				revalidated := httptest.NewRecorder()
+				handler.ServeHTTP(revalidated, req)
+				response := revalidated.Result()
+				body, _ := io.ReadAll(response.Body)
+				if response.StatusCode != http.StatusNotModified {
+					t.Fatalf("status = %d, want 304", response.StatusCode)
+				}
+				if len(body) > 0 {
+					t.Errorf("304 with a body of %d bytes", len(body))
+				}
+				for _, name := range []string{"Content-Length", "Content-Encoding", "Content-Type"} {
+					if value := response.Header.Get(name); value != "" {
+						t.Errorf("304 with %s %q", name, value)
+					}
+				}
+				if response.Header.Get("ETag") != etag {
+					t.Errorf("ETag = %q, want %q", response.Header.Get("ETag"), etag)
+				}
+			})
+		}
+	}
+}
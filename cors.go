@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// corsPolicy allows the SPA, its config and the proxied routes to be fetched from other origins, e.g. by a
+// site embedding the SPA. An allowed origin is either "*", an exact origin like https://example.com or
+// one with a wildcard subdomain like https://*.example.com.
+type corsPolicy struct {
+	origins          []string
+	methods          string
+	headers          string
+	allowCredentials bool
+	maxAge           uint64
+}
+
+func newCORSPolicy(origins string, methods string, headers string, allowCredentials bool, maxAge uint64) (*corsPolicy, error) {
+	policy := &corsPolicy{
+		methods:          methods,
+		headers:          headers,
+		allowCredentials: allowCredentials,
+		maxAge:           maxAge,
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return nil, fmt.Errorf("cors origin %q must be * or start with http:// or https://", origin)
+		}
+		if origin == "*" && allowCredentials {
+			return nil, fmt.Errorf("cors origin * must not allow credentials, it would let any site read the responses of signed in users")
+		}
+		policy.origins = append(policy.origins, origin)
+	}
+	return policy, nil
+}
+
+// allows tells if the origin is one of the allowed origins.
+func (p *corsPolicy) allows(origin string) bool {
+	for _, allowed := range p.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		scheme, host, found := strings.Cut(allowed, "://*.")
+		if found && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+host) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin for the origin.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if len(p.origins) == 1 && p.origins[0] == "*" {
+		return "*"
+	}
+	return origin
+}
+
+// handler answers the preflight requests of allowed origins itself, also for proxied routes, and adds the
+// CORS headers to the other responses to them. Requests of other origins are passed on without CORS
+// headers, so the browser blocks their responses. Every response varies by Origin, so a shared cache does
+// not serve a response without CORS headers to another origin.
+func (p *corsPolicy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := req.Header.Get("Origin")
+		if origin == "" || !p.allows(origin) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+		if p.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if req.Method != http.MethodOptions || req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-Id, X-Config-Signature, X-Config-Version")
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", p.methods)
+		headers := p.headers
+		if headers == "" {
+			// without a list, the headers the client asks for are allowed
+			headers = req.Header.Get("Access-Control-Request-Headers")
+		}
+		if headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprint(p.maxAge))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewCORSPolicyRefusesAnyOriginWithCredentials(t *testing.T) {
+	if _, err := newCORSPolicy("*", "GET", "", true, 600); err == nil {
+		t.Error("newCORSPolicy accepted * with credentials")
+	}
+	if _, err := newCORSPolicy("example.com", "GET", "", false, 600); err == nil {
+		t.Error("newCORSPolicy accepted an origin without scheme")
+	}
+}
+
+func TestCORSPolicyOrigins(t *testing.T) {
+	policy, err := newCORSPolicy("https://app.example.com, https://*.example.org", "GET, HEAD", "", true, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := policy.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"https://shop.example.org", true},
+		{"https://a.b.example.org", true},
+		{"", false},
+		{"null", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://evilapp.example.com", false},
+		{"https://example.org", false},
+		{"https://evil-example.org", false},
+		{"http://shop.example.org", false},
+	}
+	for _, test := range tests {
+		t.Run(test.origin, func(t *testing.T) {
+			for _, preflight := range []bool{false, true} {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/config.json", nil)
+				if preflight {
+					req.Method = http.MethodOptions
+					req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+				}
+				if test.origin != "" {
+					req.Header.Set("Origin", test.origin)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+
+				allowOrigin := rec.Header().Get("Access-Control-Allow-Origin")
+				if test.allowed && allowOrigin != test.origin {
+					t.Errorf("preflight %v: Access-Control-Allow-Origin = %q, want %q", preflight, allowOrigin, test.origin)
+				}
+				if !test.allowed && (allowOrigin != "" || rec.Header().Get("Access-Control-Allow-Credentials") != "") {
+					t.Errorf("preflight %v: disallowed origin received CORS headers", preflight)
+				}
+				if !test.allowed && preflight && rec.Header().Get("Access-Control-Allow-Methods") != "" {
+					t.Errorf("disallowed origin received an answered preflight")
+				}
+				if !varies(rec.Header(), "Origin") {
+					t.Errorf("preflight %v: response does not vary by Origin", preflight)
+				}
+			}
+		})
+	}
+}
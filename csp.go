@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// defaultCSP is used when no CSP_HEADER is configured, %[1]s is replaced with the nonce of the response.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'strict-dynamic' 'nonce-%[1]s'; " +
+	"style-src 'self' 'nonce-%[1]s'; " +
+	"img-src 'self' data:; " +
+	"font-src 'self' data:; "
+
+type cspDirective struct {
+	name  string
+	value string
+}
+
+// cspRoute overrides directives of the base policy for all paths starting with the prefix.
+type cspRoute struct {
+	Prefix     string            `json:"prefix"`
+	Directives map[string]string `json:"directives"`
+	policy     string
+}
+
+func parseCSP(policy string) []cspDirective {
+	var directives []cspDirective
+	for _, directive := range strings.Split(policy, ";") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(directive, " ")
+		directives = append(directives, cspDirective{strings.ToLower(name), strings.TrimSpace(value)})
+	}
+	return directives
+}
+
+func formatCSP(directives []cspDirective) string {
+	policy := &strings.Builder{}
+	for _, directive := range directives {
+		policy.WriteString(directive.name)
+		if directive.value != "" {
+			policy.WriteString(" ")
+			policy.WriteString(directive.value)
+		}
+		policy.WriteString("; ")
+	}
+	return policy.String()
+}
+
+// escapeFormat keeps a % of a source from being read as a verb when the nonce is formatted into the policy.
+func escapeFormat(source string) string {
+	return strings.ReplaceAll(source, "%", "%%")
+}
+
+// mergeCSP replaces the directives of the base policy with the overrides, directives missing in the base
+// policy are appended. An override with an empty value removes the directive. The policies are formats of
+// the nonce, so a % in an override is escaped.
+func mergeCSP(base string, overrides map[string]string) string {
+	directives := parseCSP(base)
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := escapeFormat(strings.TrimSpace(overrides[name]))
+		name = strings.ToLower(name)
+		replaced := false
+		for i := 0; i < len(directives); i++ {
+			if directives[i].name != name {
+				continue
+			}
+			if value == "" {
+				directives = append(directives[:i], directives[i+1:]...)
+				i--
+			} else {
+				directives[i].value = value
+			}
+			replaced = true
+		}
+		if !replaced && value != "" {
+			directives = append(directives, cspDirective{name, value})
+		}
+	}
+	return formatCSP(directives)
+}
+
+func parseCSPRoutes(routesJSON string, basePolicy string) ([]cspRoute, error) {
+	var routes []cspRoute
+	err := json.Unmarshal([]byte(routesJSON), &routes)
+	if err != nil {
+		return nil, err
+	}
+	for i := range routes {
+		if !strings.HasPrefix(routes[i].Prefix, "/") {
+			return nil, fmt.Errorf("csp route prefix %q must start with /", routes[i].Prefix)
+		}
+		routes[i].policy = mergeCSP(basePolicy, routes[i].Directives)
+	}
+	return routes, nil
+}
+
+// cspForPath returns the policy of the first route matching the path, or the base policy.
+func cspForPath(basePolicy string, routes []cspRoute, path string) string {
+	for _, route := range routes {
+		if strings.HasPrefix(path, route.Prefix) {
+			return route.policy
+		}
+	}
+	return basePolicy
+}
+
+// configOrigins collects the origins of all absolute http(s) and websocket urls in the json config, so
+// they can be allowed in the connect-src directive.
+func configOrigins(config []byte) ([]string, error) {
+	var doc interface{}
+	err := json.Unmarshal(config, &doc)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		case string:
+			u, err := url.Parse(v)
+			if err != nil || u.Host == "" {
+				return
+			}
+			switch u.Scheme {
+			case "http", "https", "ws", "wss":
+				found[u.Scheme+"://"+u.Host] = true
+			}
+		}
+	}
+	walk(doc)
+
+	origins := make([]string, 0, len(found))
+	for origin := range found {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return origins, nil
+}
+
+// withConnectSources adds the sources to the connect-src directive of the policy. As a missing connect-src
+// falls back to default-src, its sources are kept when the directive is created. A % of a source is escaped
+// like in mergeCSP.
+func withConnectSources(policy string, sources []string) string {
+	if len(sources) == 0 {
+		return policy
+	}
+	escaped := make([]string, 0, len(sources))
+	for _, source := range sources {
+		escaped = append(escaped, escapeFormat(source))
+	}
+	directives := parseCSP(policy)
+	for i, directive := range directives {
+		if directive.name == "connect-src" {
+			directives[i].value = strings.TrimSpace(directive.value + " " + strings.Join(escaped, " "))
+			return formatCSP(directives)
+		}
+	}
+	value := "'self'"
+	for _, directive := range directives {
+		if directive.name == "default-src" {
+			value = directive.value
+		}
+	}
+	directives = append(directives, cspDirective{"connect-src", value + " " + strings.Join(escaped, " ")})
+	return formatCSP(directives)
+}
+
+// xFrameOptions returns the X-Frame-Options equivalent of the frame-ancestors sources for browsers without
+// support for CSP level 2. Lists of origins have no equivalent, as ALLOW-FROM is not supported anymore.
+func xFrameOptions(frameAncestors string) string {
+	switch strings.TrimSpace(frameAncestors) {
+	case "'none'":
+		return "DENY"
+	case "'self'":
+		return "SAMEORIGIN"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMergeCSPEscapesPercent(t *testing.T) {
+	policy := mergeCSP(defaultCSP, map[string]string{"img-src": "'self' https://cdn.example.com/%s/ https://cdn.example.com/100%25"})
+	header := fmt.Sprintf(policy, "NONCE")
+	if !strings.Contains(header, "img-src 'self' https://cdn.example.com/%s/ https://cdn.example.com/100%25;") {
+		t.Errorf("img-src is corrupted: %s", header)
+	}
+	if !strings.Contains(header, "'nonce-NONCE'") || strings.Contains(header, "%!") {
+		t.Errorf("nonce is not formatted into the policy: %s", header)
+	}
+}
+
+func TestWithConnectSourcesEscapesPercent(t *testing.T) {
+	header := fmt.Sprintf(withConnectSources(defaultCSP, []string{"https://api.example.com/%s"}), "NONCE")
+	if !strings.Contains(header, " https://api.example.com/%s;") {
+		t.Errorf("connect-src is corrupted: %s", header)
+	}
+	if !strings.Contains(header, "'nonce-NONCE'") || strings.Contains(header, "%!") {
+		t.Errorf("nonce is not formatted into the policy: %s", header)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// policySetup holds the configuration the file handler and its wrappers apply per path, to explain the
+// effective policy of a path without serving it.
+type policySetup struct {
+	files              map[string]loadedFile
+	mounts             []string
+	remotes            []remote
+	routes             *routeTable
+	missingAssets      string
+	fallbackExclude    *regexp.Regexp
+	fallbackAccept     string
+	csp                string
+	cspRoutes          []cspRoute
+	preconnect         string
+	frameOptions       string
+	htmlRenderMode     string
+	htmlCacheControl   string
+	configCacheControl string
+	assetCacheControl  string
+	downloadRoutes     []downloadRoute
+	writeTimeoutRoutes []writeTimeoutRoute
+	htmlVary           []string
+	configVary         []string
+}
+
+// pathPolicy is the effective policy of a path. The class is one of the response classes, "remote",
+// "proxy", "redirect", "missing" for assets answered with a 404 or "outside-mounts".
+type pathPolicy struct {
+	Path                string            `json:"path"`
+	Mount               string            `json:"mount,omitempty"`
+	Remote              string            `json:"remote,omitempty"`
+	Proxy               string            `json:"proxy,omitempty"`
+	Redirect            string            `json:"redirect,omitempty"`
+	RewrittenTo         string            `json:"rewrittenTo,omitempty"`
+	Class               string            `json:"class"`
+	Encodings           []string          `json:"encodings,omitempty"`
+	Headers             map[string]string `json:"headers"`
+	WriteTimeoutSeconds *uint64           `json:"writeTimeoutSeconds,omitempty"`
+}
+
+func (s *policySetup) policyFor(path string) pathPolicy {
+	policy := pathPolicy{Path: path, Headers: make(map[string]string)}
+	for _, route := range s.writeTimeoutRoutes {
+		if strings.HasPrefix(path, route.Prefix) {
+			seconds := route.Seconds
+			policy.WriteTimeoutSeconds = &seconds
+			break
+		}
+	}
+
+	routes := s.routes.current.Load()
+	for _, rule := range routes.redirects {
+		if rule.Host != "" {
+			// only the path is explained, rules for a host depend on the request
+			continue
+		}
+		if location, found := rule.target("", path); found {
+			policy.Redirect = location
+			policy.Class = "redirect"
+			return policy
+		}
+	}
+
+	for _, rule := range routes.proxies {
+		if strings.HasPrefix(path, rule.prefix) {
+			policy.Proxy = rule.target.String()
+			policy.Class = "proxy"
+			return policy
+		}
+	}
+
+	if len(s.mounts) > 1 || s.mounts[0] != "/" {
+		for _, mount := range s.mounts {
+			if strings.HasPrefix(path, mount) {
+				policy.Mount = mount
+				path = "/" + strings.TrimPrefix(path, mount)
+				break
+			}
+		}
+		if policy.Mount == "" {
+			policy.Class = "outside-mounts"
+			return policy
+		}
+	}
+
+	if rewritten, found := rewritePath(routes.rewrites, path); found {
+		policy.RewrittenTo = rewritten
+		path = rewritten
+	}
+
+	for _, r := range s.remotes {
+		if strings.HasPrefix(path, r.Prefix) {
+			policy.Remote = r.Prefix
+			policy.Class = "remote"
+			policy.Headers["Cache-Control"] = fmt.Sprintf("public, max-age=%d", r.CacheSeconds)
+			return policy
+		}
+	}
+
+	file, exists := s.files[path]
+	switch {
+	case !exists && excludedFromFallback(path, s.missingAssets, s.fallbackExclude):
+		policy.Class = "missing"
+		return policy
+	case !exists:
+		policy.Class = classFallback
+	case path == indexFileName:
+		policy.Class = classIndex
+	case path == configFileName:
+		policy.Class = classConfig
+		policy.Headers["Cache-Control"] = s.configCacheControl
+		if len(s.configVary) > 0 {
+			policy.Headers["Vary"] = strings.Join(s.configVary, ", ")
+		}
+		return policy
+	default:
+		policy.Class = classAsset
+		policy.Headers["Cache-Control"] = s.assetCacheControl
+		if disposition := contentDisposition(s.downloadRoutes, path); disposition != "" {
+			policy.Headers["Content-Disposition"] = disposition
+		}
+		for encoding := range file.encoded {
+			policy.Encodings = append(policy.Encodings, encoding)
+		}
+		sort.Strings(policy.Encodings)
+		return policy
+	}
+
+	policy.Headers["Cache-Control"] = s.htmlCacheControl
+	if s.csp != "false" {
+		policy.Headers["Content-Security-Policy"] = fmt.Sprintf(cspForPath(s.csp, s.cspRoutes, path), "{nonce}")
+	}
+	if s.preconnect != "" {
+		policy.Headers["Link"] = s.preconnect
+	}
+	if s.frameOptions != "" {
+		policy.Headers["X-Frame-Options"] = s.frameOptions
+	}
+	vary := s.htmlVary
+	if !exists && path != "/" && s.fallbackAccept == "html" {
+		// only requests accepting text/html fall back, all others receive a 404
+		vary = append([]string{"Accept"}, vary...)
+	}
+	if len(vary) > 0 {
+		policy.Headers["Vary"] = strings.Join(vary, ", ")
+	}
+	if s.htmlRenderMode == "per-response" {
+		policy.Headers["Vary"] = "*"
+	}
+	return policy
+}
+
+// newPolicyDebugHandler explains the effective policy of the path in the query parameter "path" as json
+// at the debug path, all other requests are passed to the next handler.
+func newPolicyDebugHandler(debugPath string, setup *policySetup, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != debugPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+		path := req.URL.Query().Get("path")
+		if !strings.HasPrefix(path, "/") {
+			writeProblem(w, req, http.StatusBadRequest, "the query parameter path must start with /")
+			return
+		}
+		body, err := json.Marshal(setup.policyFor(path))
+		if err != nil {
+			writeProblem(w, req, http.StatusInternalServerError, "the policy could not be encoded")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+)
+
+// contentStore keeps a single prepared copy of every file content, so files with the same content share
+// their memory and their precompressed variants, both within a bundle and across the bundles loaded one
+// after the other, e.g. on reloads in dev mode.
+type contentStore struct {
+	mutex sync.Mutex
+	// files are the prepared files by etag and mime type
+	files map[string]loadedFile
+}
+
+func newContentStore() *contentStore {
+	return &contentStore{files: make(map[string]loadedFile)}
+}
+
+// intern returns the prepared file with the same content and mime type if there is one, otherwise it prepares
+// the file and keeps it. Files with precompressed siblings are prepared every time, the siblings need not be
+// the same for the same content.
+func (s *contentStore) intern(file loadedFile, prepare func(loadedFile) (loadedFile, error)) (loadedFile, bool, error) {
+	if file.encoded != nil {
+		prepared, err := prepare(file)
+		return prepared, false, err
+	}
+	key := file.etag + " " + file.mime
+	s.mutex.Lock()
+	stored, found := s.files[key]
+	s.mutex.Unlock()
+	if found {
+		stored.modified = file.modified
+		return stored, true, nil
+	}
+	prepared, err := prepare(file)
+	if err != nil {
+		return prepared, false, err
+	}
+	s.mutex.Lock()
+	s.files[key] = prepared
+	s.mutex.Unlock()
+	return prepared, false, nil
+}
+
+// retain forgets the contents no longer part of the files, the bundles still in use keep their own references.
+func (s *contentStore) retain(files map[string]loadedFile) {
+	used := make(map[string]bool, len(files))
+	for _, file := range files {
+		used[file.etag+" "+file.mime] = true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range s.files {
+		if !used[key] {
+			delete(s.files, key)
+		}
+	}
+}
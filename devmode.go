@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const liveReloadPath = "/__dev/reload"
+
+// liveReloadScript reloads the page when the server announces a reloaded bundle. The EventSource reconnects
+// by itself, e.g. after the write timeout of the server closed the stream.
+const liveReloadScript = `<script>new EventSource("` + liveReloadPath + `").addEventListener("reload", function () { location.reload() })</script>`
+
+// injectLiveReload adds the live-reload script to the end of the body of the html document.
+func injectLiveReload(document []byte) []byte {
+	if !bytes.Contains(document, []byte("</body>")) {
+		return append(append([]byte{}, document...), liveReloadScript...)
+	}
+	return bytes.Replace(document, []byte("</body>"), []byte(liveReloadScript+"</body>"), 1)
+}
+
+// liveReload announces reloads of the bundle to the browsers with the SPA open, as server-sent events.
+type liveReload struct {
+	mutex   sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func newLiveReload() *liveReload {
+	return &liveReload{clients: make(map[chan struct{}]bool)}
+}
+
+// notify tells every connected browser to reload the page.
+func (l *liveReload) notify() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for client := range l.clients {
+		select {
+		case client <- struct{}{}:
+		default:
+			// a reload is pending for the client already
+		}
+	}
+}
+
+// handler streams the reload events at the live-reload path, all other requests are passed to the next
+// handler.
+func (l *liveReload) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != liveReloadPath {
+			next.ServeHTTP(w, req)
+			return
+		}
+		client := make(chan struct{}, 1)
+		l.mutex.Lock()
+		l.clients[client] = true
+		l.mutex.Unlock()
+		defer func() {
+			l.mutex.Lock()
+			delete(l.clients, client)
+			l.mutex.Unlock()
+		}()
+
+		controller := http.NewResponseController(w)
+		_ = controller.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = fmt.Fprint(w, ": connected\n\n")
+		_ = controller.Flush()
+		for {
+			select {
+			case <-client:
+				_, err := fmt.Fprint(w, "event: reload\ndata: \n\n")
+				if err != nil {
+					return
+				}
+				_ = controller.Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
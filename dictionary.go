@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/singleflight"
+)
+
+// dczHeader starts every dcz response, it is a zstd skippable frame holding the SHA-256 of the dictionary.
+var dczHeader = []byte{0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00}
+
+// dczWindowSize stays within the 8 MiB every client must support, whatever the size of the dictionary.
+const dczWindowSize = 8 << 20
+
+const dictionaryMaxCacheEntries = 1000
+
+// dictionaryPattern is a path pattern of Use-As-Dictionary, * matches any part of the path.
+type dictionaryPattern struct {
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+// dictionaryCompression serves the files matching its patterns compressed against a previous version the
+// browser kept as dictionary, following Compression Dictionary Transport (RFC 9842). The files are sent
+// with Use-As-Dictionary, so the browser keeps them and announces them with Available-Dictionary when it
+// fetches the next version, e.g. main.*.js after a release. The dictionaries known to the server are the
+// matching files of the bundle and the files of a directory, e.g. the assets of the previous release.
+type dictionaryCompression struct {
+	patterns []dictionaryPattern
+	// dictionaries are the contents usable as dictionary by their SHA-256
+	dictionaries map[[sha256.Size]byte][]byte
+
+	mutex sync.Mutex
+	// cache holds the dcz content per etag of the file and dictionary
+	cache map[string][]byte
+	// encodes coalesces simultaneous compressions of the same file against the same dictionary
+	encodes singleflight.Group
+}
+
+// newDictionaryCompression sets up the comma separated patterns, e.g. /assets/main.*.js. The matching
+// files of the bundle and all files below dir are the dictionaries, dir may be empty.
+func newDictionaryCompression(patterns string, dir string, files map[string]loadedFile) (*dictionaryCompression, error) {
+	d := &dictionaryCompression{
+		dictionaries: make(map[[sha256.Size]byte][]byte),
+		cache:        make(map[string][]byte),
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("dictionary pattern %q must start with /", pattern)
+		}
+		expression := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		d.patterns = append(d.patterns, dictionaryPattern{pattern: pattern, regexp: regexp.MustCompile(expression)})
+	}
+	if len(d.patterns) == 0 {
+		return nil, fmt.Errorf("no dictionary patterns in %q", patterns)
+	}
+	for path, file := range files {
+		if d.match(path) == "" {
+			continue
+		}
+		content, err := file.uncompressed()
+		if err != nil {
+			return nil, err
+		}
+		d.dictionaries[sha256.Sum256(content)] = content
+	}
+	if dir != "" {
+		err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			d.dictionaries[sha256.Sum256(content)] = content
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("Loaded compression dictionaries", "dictionaries", len(d.dictionaries))
+	return d, nil
+}
+
+// match returns the first pattern matching the path, or an empty string.
+func (d *dictionaryCompression) match(path string) string {
+	for _, pattern := range d.patterns {
+		if pattern.regexp.MatchString(path) {
+			return pattern.pattern
+		}
+	}
+	return ""
+}
+
+// availableDictionary parses the SHA-256 of an Available-Dictionary header, a structured field byte
+// sequence like :pZGm1Av0IEBKARczz7exkNYsZb8LzaMrV7J32a2fFG4=:.
+func availableDictionary(header string) ([sha256.Size]byte, bool) {
+	var hash [sha256.Size]byte
+	header = strings.TrimSpace(header)
+	if len(header) < 2 || header[0] != ':' || header[len(header)-1] != ':' {
+		return hash, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[1 : len(header)-1])
+	if err != nil || len(decoded) != sha256.Size {
+		return hash, false
+	}
+	copy(hash[:], decoded)
+	return hash, true
+}
+
+// negotiate returns the file compressed against the dictionary the client has, with the hex SHA-256 of the
+// dictionary, if the client accepts dcz and the dictionary is known.
+func (d *dictionaryCompression) negotiate(req *http.Request, file loadedFile) ([]byte, string, bool) {
+	if !acceptsEncoding(req, "dcz") {
+		return nil, "", false
+	}
+	hash, found := availableDictionary(req.Header.Get("Available-Dictionary"))
+	if !found {
+		return nil, "", false
+	}
+	dictionary, found := d.dictionaries[hash]
+	if !found {
+		return nil, "", false
+	}
+	dictionaryID := hex.EncodeToString(hash[:])
+	key := file.etag + dictionaryID
+	d.mutex.Lock()
+	encoded, found := d.cache[key]
+	d.mutex.Unlock()
+	if found {
+		return encoded, dictionaryID, true
+	}
+	result, err, _ := d.encodes.Do(key, func() (interface{}, error) {
+		content, err := file.content()
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := encodeDCZ(content, hash, dictionary)
+		if err != nil {
+			return nil, err
+		}
+		d.mutex.Lock()
+		if len(d.cache) < dictionaryMaxCacheEntries {
+			d.cache[key] = encoded
+		}
+		d.mutex.Unlock()
+		return encoded, nil
+	})
+	if err != nil {
+		slog.Error("Could not compress file with dictionary", "path", req.URL.Path, "err", err)
+		return nil, "", false
+	}
+	return result.([]byte), dictionaryID, true
+}
+
+// encodeDCZ compresses the content with zstd against the raw dictionary, after the header naming the
+// dictionary.
+func encodeDCZ(content []byte, hash [sha256.Size]byte, dictionary []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithWindowSize(dczWindowSize),
+		zstd.WithEncoderDictRaw(0, dictionary))
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	encoded := make([]byte, 0, len(dczHeader)+len(hash)+len(content)/4)
+	encoded = append(encoded, dczHeader...)
+	encoded = append(encoded, hash[:]...)
+	return encoder.EncodeAll(content, encoded), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDictionaryCompression(t *testing.T) {
+	// the main script of the previous release, kept by the browser as dictionary
+	previous := []byte(`console.log("previous");` + strings.Repeat(`console.log("padding");`, 200))
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "assets"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "assets", "main.0a1b2c3d.js"), previous, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestServer(t, map[string]string{
+		"COMPRESSION_DICTIONARIES":   "/assets/main.*.js",
+		"COMPRESSION_DICTIONARY_DIR": dir,
+	})
+	hash := sha256.Sum256(previous)
+	unknown := sha256.Sum256([]byte("unknown"))
+
+	tests := []struct {
+		name       string
+		path       string
+		dictionary string
+		encoding   string
+	}{
+		{"known dictionary", "/assets/main.3f2a1b9c.js", ":" + base64.StdEncoding.EncodeToString(hash[:]) + ":", "dcz"},
+		{"unknown dictionary", "/assets/main.3f2a1b9c.js", ":" + base64.StdEncoding.EncodeToString(unknown[:]) + ":", "gzip"},
+		{"invalid dictionary", "/assets/main.3f2a1b9c.js", "sha-256=:abc:", "gzip"},
+		{"no dictionary", "/assets/main.3f2a1b9c.js", "", "gzip"},
+		{"not matching the patterns", "/logo.svg", ":" + base64.StdEncoding.EncodeToString(hash[:]) + ":", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip, dcz")
+			if test.dictionary != "" {
+				req.Header.Set("Available-Dictionary", test.dictionary)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			if encoding := rec.Header().Get("Content-Encoding"); encoding != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", encoding, test.encoding)
+			}
+			if test.path != "/assets/main.3f2a1b9c.js" {
+				return
+			}
+			if match := rec.Header().Get("Use-As-Dictionary"); match != `match="/assets/main.*.js"` {
+				t.Errorf("Use-As-Dictionary = %q", match)
+			}
+			if vary := strings.Join(rec.Header().Values("Vary"), ", "); !strings.Contains(vary, "Available-Dictionary") {
+				t.Errorf("Vary = %q, want it to contain Available-Dictionary", vary)
+			}
+			if test.encoding != "dcz" {
+				return
+			}
+			body := rec.Body.Bytes()
+			if !bytes.HasPrefix(body, append(append([]byte{}, dczHeader...), hash[:]...)) {
+				t.Fatalf("the body does not start with the dcz header and the hash of the dictionary")
+			}
+			decoder, err := zstd.NewReader(nil, zstd.WithDecoderDictRaw(0, previous))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer decoder.Close()
+			decoded, err := decoder.DecodeAll(body[len(dczHeader)+sha256.Size:], nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != testBundle[test.path] {
+				t.Errorf("decoded content differs from the file")
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const dns01AccountKeyFile = "dns01-account.key"
+const dns01CertFile = "dns01-cert.pem"
+
+// dns01RenewBefore renews the certificate 30 days before it expires, like autocert does.
+const dns01RenewBefore = 30 * 24 * time.Hour
+const dns01CheckInterval = 12 * time.Hour
+
+// dns01RetryInterval keeps failed attempts well below the rate limit of Let's Encrypt for failed validations.
+const dns01RetryInterval = 15 * time.Minute
+
+// dnsProvider publishes the TXT records of DNS-01 challenges. The fqdn ends with a dot.
+type dnsProvider interface {
+	present(ctx context.Context, fqdn string, value string) error
+	cleanup(ctx context.Context, fqdn string, value string) error
+}
+
+// newDNSProvider creates the provider of the name, "cloudflare" with an api token allowed to edit the
+// zones, or "exec" with a command called as "<command> present|cleanup <fqdn> <value>", e.g. a script
+// for Route53 or any other dns api.
+func newDNSProvider(name string, cloudflareToken string, command string) (dnsProvider, error) {
+	switch name {
+	case "cloudflare":
+		if cloudflareToken == "" {
+			return nil, errors.New("the cloudflare dns provider needs an api token")
+		}
+		return &cloudflareDNS{token: cloudflareToken, records: make(map[string]cloudflareRecord)}, nil
+	case "exec":
+		if command == "" {
+			return nil, errors.New("the exec dns provider needs a command")
+		}
+		return execDNS{command: command}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q", name)
+	}
+}
+
+// execDNS delegates the records to a command, compatible with the exec provider of lego.
+type execDNS struct {
+	command string
+}
+
+func (p execDNS) run(ctx context.Context, action string, fqdn string, value string) error {
+	output, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w, output: %s", p.command, action, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+func (p execDNS) present(ctx context.Context, fqdn string, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p execDNS) cleanup(ctx context.Context, fqdn string, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+type cloudflareRecord struct {
+	zoneID   string
+	recordID string
+}
+
+// cloudflareDNS creates the records through the api of Cloudflare, in the zone of the longest matching name.
+type cloudflareDNS struct {
+	token string
+
+	mutex   sync.Mutex
+	records map[string]cloudflareRecord
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// call sends the request to the api and decodes the result into the result if it succeeded.
+func (p *cloudflareDNS) call(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		bodyJSON, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(bodyJSON)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		Success bool            `json:"success"`
+		Errors  json.RawMessage `json:"errors"`
+		Result  json.RawMessage `json:"result"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("cloudflare answered %s with status %d: %w", path, resp.StatusCode, err)
+	}
+	if !response.Success {
+		return fmt.Errorf("cloudflare answered %s with status %d, errors: %s", path, resp.StatusCode, response.Errors)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// zoneID returns the id of the zone of the name, trying the parent domains down to the top level domain.
+func (p *cloudflareDNS) zoneID(ctx context.Context, fqdn string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		err := p.call(ctx, http.MethodGet, "/zones?name="+strings.Join(labels[i:], "."), nil, &zones)
+		if err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no cloudflare zone found for %s", fqdn)
+}
+
+func (p *cloudflareDNS) present(ctx context.Context, fqdn string, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	err = p.call(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", map[string]interface{}{
+		"type":    "TXT",
+		"name":    strings.TrimSuffix(fqdn, "."),
+		"content": value,
+		"ttl":     120,
+	}, &record)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.records[fqdn+" "+value] = cloudflareRecord{zoneID: zoneID, recordID: record.ID}
+	p.mutex.Unlock()
+	return nil
+}
+
+func (p *cloudflareDNS) cleanup(ctx context.Context, fqdn string, value string) error {
+	p.mutex.Lock()
+	record, found := p.records[fqdn+" "+value]
+	delete(p.records, fqdn+" "+value)
+	p.mutex.Unlock()
+	if !found {
+		return nil
+	}
+	return p.call(ctx, http.MethodDelete, "/zones/"+record.zoneID+"/dns_records/"+record.recordID, nil, nil)
+}
+
+// dnsACMEManager obtains and renews a single certificate for all domains with DNS-01 challenges, so
+// wildcard domains and servers not reachable from the internet get certificates as well. The certificate
+// and the account key are kept in the cache directory across restarts.
+type dnsACMEManager struct {
+	client      *acme.Client
+	domains     []string
+	email       string
+	cacheDir    string
+	provider    dnsProvider
+	propagation time.Duration
+
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func newDNSACMEManager(domains string, email string, cacheDir string, directoryURL string, provider dnsProvider, propagation time.Duration) (*dnsACMEManager, error) {
+	m := &dnsACMEManager{
+		email:       email,
+		cacheDir:    cacheDir,
+		provider:    provider,
+		propagation: propagation,
+	}
+	for _, domain := range strings.Split(domains, ",") {
+		m.domains = append(m.domains, strings.TrimSpace(domain))
+	}
+	err := os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	m.client = &acme.Client{Key: key, DirectoryURL: directoryURL}
+	m.cert = m.cachedCert()
+	return m, nil
+}
+
+// accountKey loads the key of the ACME account from the cache, or creates it.
+func (m *dnsACMEManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.cacheDir, dns01AccountKeyFile)
+	keyPEM, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// cachedCert returns the certificate of the cache if it covers the domains.
+func (m *dnsACMEManager) cachedCert() *tls.Certificate {
+	certPEM, err := os.ReadFile(filepath.Join(m.cacheDir, dns01CertFile))
+	if err != nil {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(certPEM, certPEM)
+	if err != nil {
+		slog.Error("Could not load cached ACME certificate", "err", err)
+		return nil
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	for _, domain := range m.domains {
+		// a wildcard domain is covered if any of its subdomains is
+		if cert.Leaf.VerifyHostname(strings.Replace(domain, "*", "wildcard-check", 1)) != nil {
+			return nil
+		}
+	}
+	return &cert
+}
+
+func (m *dnsACMEManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("the ACME certificate is not available yet")
+	}
+	return m.cert, nil
+}
+
+// TLSConfig serves the certificate of the manager.
+func (m *dnsACMEManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.getCertificate,
+	}
+}
+
+// needsRenewal tells if there is no certificate yet or it expires within dns01RenewBefore.
+func (m *dnsACMEManager) needsRenewal() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.cert == nil || time.Until(m.cert.Leaf.NotAfter) < dns01RenewBefore
+}
+
+// run obtains the certificate if needed and then checks for renewal periodically. A failed attempt is
+// retried after dns01RetryInterval, the current certificate is served meanwhile.
+func (m *dnsACMEManager) run(ctx context.Context) {
+	for {
+		interval := dns01CheckInterval
+		if m.needsRenewal() {
+			err := m.obtain(ctx)
+			if err != nil {
+				slog.Error("Could not obtain ACME certificate with DNS-01", "domains", strings.Join(m.domains, ","), "err", err)
+				interval = dns01RetryInterval
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// obtain orders a new certificate, answering the DNS-01 challenge of every domain.
+func (m *dnsACMEManager) obtain(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	account := &acme.Account{}
+	if m.email != "" {
+		account.Contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("could not register account: %w", err)
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.domains...))
+	if err != nil {
+		return fmt.Errorf("could not create order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		err = m.authorize(ctx, authzURL)
+		if err != nil {
+			return err
+		}
+	}
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("order did not become ready: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.domains}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("could not finalize order: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	var certPEM bytes.Buffer
+	_ = pem.Encode(&certPEM, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, der := range chain {
+		_ = pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	err = os.WriteFile(filepath.Join(m.cacheDir, dns01CertFile), certPEM.Bytes(), 0600)
+	if err != nil {
+		slog.Error("Could not cache ACME certificate", "err", err)
+	}
+
+	m.mutex.Lock()
+	m.cert = &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}
+	m.mutex.Unlock()
+	slog.Info("Obtained ACME certificate with DNS-01", "domains", strings.Join(m.domains, ","), "expires", leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// authorize answers the DNS-01 challenge of the authorization, unless it is valid already.
+func (m *dnsACMEManager) authorize(ctx context.Context, authzURL string) error {
+	authz, err := m.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no DNS-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	value, err := m.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	// the challenge of a wildcard domain is the one of its base domain
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	err = m.provider.present(ctx, fqdn, value)
+	if err != nil {
+		return fmt.Errorf("could not publish the challenge record of %s: %w", authz.Identifier.Value, err)
+	}
+	defer func() {
+		err := m.provider.cleanup(context.Background(), fqdn, value)
+		if err != nil {
+			slog.Error("Could not remove the ACME challenge record", "fqdn", fqdn, "err", err)
+		}
+	}()
+	waitForTXT(ctx, fqdn, value, m.propagation)
+
+	_, err = m.client.Accept(ctx, challenge)
+	if err != nil {
+		return fmt.Errorf("could not accept the challenge of %s: %w", authz.Identifier.Value, err)
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		return fmt.Errorf("authorization of %s failed: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// waitForTXT waits until the resolver sees the record or the propagation time passed, as the ACME server
+// fails the challenge for good if it does not find the record.
+func waitForTXT(ctx context.Context, fqdn string, value string, propagation time.Duration) {
+	deadline := time.Now().Add(propagation)
+	for time.Now().Before(deadline) {
+		records, _ := net.DefaultResolver.LookupTXT(ctx, fqdn)
+		for _, record := range records {
+			if record == value {
+				return
+			}
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+	slog.Warn("The ACME challenge record is not visible yet, trying anyway", "fqdn", fqdn)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// downloadRoute serves all files with a path starting with the prefix as attachments, e.g. PDFs or CSV
+// templates shipped alongside the app. The filename defaults to the name of the file.
+type downloadRoute struct {
+	Prefix   string `json:"prefix"`
+	Filename string `json:"filename"`
+}
+
+func parseDownloadRoutes(routesJSON string) ([]downloadRoute, error) {
+	var routes []downloadRoute
+	err := json.Unmarshal([]byte(routesJSON), &routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("download route prefix %q must start with /", route.Prefix)
+		}
+	}
+	return routes, nil
+}
+
+// contentDisposition returns the Content-Disposition header of the first route matching the path, or an
+// empty string if no route matches.
+func contentDisposition(routes []downloadRoute, filePath string) string {
+	for _, route := range routes {
+		if !strings.HasPrefix(filePath, route.Prefix) {
+			continue
+		}
+		filename := route.Filename
+		if filename == "" {
+			filename = path.Base(filePath)
+		}
+		// non-ascii names are encoded as filename*=utf-8''...
+		return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const eventsQueueSize = 256
+const eventsSendTimeout = 10 * time.Second
+
+// eventSink forwards a batch of analytics events, encoded as compact json, to its destination.
+type eventSink interface {
+	send(ctx context.Context, batch []byte) error
+}
+
+type stdoutEventSink struct{}
+
+func (stdoutEventSink) send(ctx context.Context, batch []byte) error {
+	_, err := os.Stdout.Write(append(batch, '\n'))
+	return err
+}
+
+type httpEventSink struct {
+	url string
+}
+
+func (s httpEventSink) send(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func newEventSink(kind string, url string) (eventSink, error) {
+	switch kind {
+	case "stdout":
+		return stdoutEventSink{}, nil
+	case "http":
+		if url == "" {
+			return nil, fmt.Errorf("the http event sink needs an url")
+		}
+		return httpEventSink{url: url}, nil
+	default:
+		return nil, fmt.Errorf("unknown event sink %q", kind)
+	}
+}
+
+// newEventsHandler accepts batches of analytics events posted by the SPA to the given path and forwards them
+// to the sink in the background, until the context is done. Serving the collector first-party keeps the
+// events away from ad-blockers.
+func newEventsHandler(ctx context.Context, path string, sink eventSink, maxBytes int64, next http.Handler) http.Handler {
+	queue := make(chan []byte, eventsQueueSize)
+	go func() {
+		for {
+			select {
+			case batch := <-queue:
+				sendCtx, cancel := context.WithTimeout(ctx, eventsSendTimeout)
+				err := sink.send(sendCtx, batch)
+				cancel()
+				if err != nil {
+					slog.Error("Could not forward analytics events", "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeProblem(w, req, http.StatusMethodNotAllowed, "analytics events must be posted")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBytes))
+		if err != nil {
+			writeProblem(w, req, http.StatusRequestEntityTooLarge, fmt.Sprintf("analytics events must not exceed %d bytes", maxBytes))
+			return
+		}
+		batch := &bytes.Buffer{}
+		if json.Compact(batch, body) != nil {
+			writeProblem(w, req, http.StatusBadRequest, "analytics events must be json")
+			return
+		}
+		select {
+		case queue <- batch.Bytes():
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			slog.Warn("Dropping analytics events, the queue is full")
+			w.Header().Set("Retry-After", "10")
+			writeProblem(w, req, http.StatusServiceUnavailable, "the queue of analytics events is full")
+		}
+	})
+}
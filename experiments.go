@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+const experimentCookiePrefix = "spa-experiment-"
+const experimentCookieMaxAge = 365 * 24 * 60 * 60
+
+type experiment struct {
+	Name     string   `json:"name"`
+	Variants []string `json:"variants"`
+	Weights  []int64  `json:"weights"`
+}
+
+func parseExperiments(experimentsJSON string) ([]experiment, error) {
+	var experiments []experiment
+	err := json.Unmarshal([]byte(experimentsJSON), &experiments)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range experiments {
+		if e.Name == "" || len(e.Variants) == 0 {
+			return nil, fmt.Errorf("experiment %d needs a name and at least one variant", i)
+		}
+		// the name and the variants end up in a cookie, which http.SetCookie drops silently if invalid
+		if !isCookieToken(e.Name) {
+			return nil, fmt.Errorf("experiment name %q may only contain letters, digits and !#$%%&'*+-.^_`|~", e.Name)
+		}
+		for _, variant := range e.Variants {
+			if variant == "" || strings.IndexFunc(variant, func(r rune) bool { return !isCookieValueChar(r) }) >= 0 {
+				return nil, fmt.Errorf("experiment %s has a variant %q that can not be stored in a cookie", e.Name, variant)
+			}
+		}
+		if len(e.Weights) == 0 {
+			e.Weights = make([]int64, len(e.Variants))
+			for j := range e.Weights {
+				e.Weights[j] = 1
+			}
+			experiments[i] = e
+		}
+		if len(e.Weights) != len(e.Variants) {
+			return nil, fmt.Errorf("experiment %s has %d variants but %d weights", e.Name, len(e.Variants), len(e.Weights))
+		}
+		var total int64
+		for _, weight := range e.Weights {
+			if weight < 0 {
+				return nil, fmt.Errorf("experiment %s has a negative weight", e.Name)
+			}
+			total += weight
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("experiment %s has no variant with a weight above 0", e.Name)
+		}
+	}
+	return experiments, nil
+}
+
+// isCookieToken tells if the value is a token, the grammar of cookie names (RFC 6265, RFC 7230).
+func isCookieToken(value string) bool {
+	return value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	}) < 0
+}
+
+// isCookieValueChar tells if the character may be part of a cookie value (RFC 6265).
+func isCookieValueChar(r rune) bool {
+	return r > ' ' && r < 0x7f && r != '"' && r != ',' && r != ';' && r != '\\'
+}
+
+// pick draws a variant with a probability proportional to its weight.
+func (e experiment) pick() (string, error) {
+	var total int64
+	for _, weight := range e.Weights {
+		total += weight
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(total))
+	if err != nil {
+		return "", err
+	}
+	draw := n.Int64()
+	for i, weight := range e.Weights {
+		if draw < weight {
+			return e.Variants[i], nil
+		}
+		draw -= weight
+	}
+	return e.Variants[len(e.Variants)-1], nil
+}
+
+// assignExperiments returns the variant of every experiment for the visitor. Variants stored in the
+// cookies of the request are kept, new assignments are stored in cookies so the visitor stays in the bucket.
+func assignExperiments(w http.ResponseWriter, req *http.Request, experiments []experiment) (map[string]string, error) {
+	assignments := make(map[string]string, len(experiments))
+	for _, e := range experiments {
+		cookie, err := req.Cookie(experimentCookiePrefix + e.Name)
+		if err == nil && containsString(e.Variants, cookie.Value) {
+			assignments[e.Name] = cookie.Value
+			continue
+		}
+		variant, err := e.pick()
+		if err != nil {
+			return nil, err
+		}
+		assignments[e.Name] = variant
+		http.SetCookie(w, &http.Cookie{
+			Name:     experimentCookiePrefix + e.Name,
+			Value:    variant,
+			Path:     "/",
+			MaxAge:   experimentCookieMaxAge,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return assignments, nil
+}
+
+// withExperiments adds the assignments to the runtime config under the key "experiments".
+func withExperiments(config []byte, assignments map[string]string) ([]byte, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(config, &doc)
+	if err != nil {
+		return nil, err
+	}
+	doc["experiments"] = assignments
+	return json.Marshal(doc)
+}
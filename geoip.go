@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type geoipRule struct {
+	Countries []string `json:"countries"`
+	Action    string   `json:"action"`
+	Target    string   `json:"target"`
+	Status    int      `json:"status"`
+}
+
+func parseGeoipRules(rulesJSON string) ([]geoipRule, error) {
+	var rules []geoipRule
+	err := json.Unmarshal([]byte(rulesJSON), &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		switch rules[i].Action {
+		case "block":
+		case "redirect":
+			if rules[i].Target == "" {
+				return nil, fmt.Errorf("redirect rule for countries %v has no target", rules[i].Countries)
+			}
+			if rules[i].Status == 0 {
+				rules[i].Status = http.StatusFound
+			}
+		default:
+			return nil, fmt.Errorf("unknown geoip rule action %q", rules[i].Action)
+		}
+		for j, country := range rules[i].Countries {
+			rules[i].Countries[j] = strings.ToUpper(country)
+		}
+	}
+	return rules, nil
+}
+
+// newGeoipHandler looks up the country of the client in the MaxMind database and applies the first
+// matching rule. Requests from clients that can't be located are always passed to the next handler.
+func newGeoipHandler(dbPath string, rulesJSON string, trustedProxyHops int, next http.Handler) (http.Handler, error) {
+	rules, err := parseGeoipRules(rulesJSON)
+	if err != nil {
+		return nil, err
+	}
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Loaded geoip database", "path", dbPath, "rules", len(rules))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := net.ParseIP(clientIP(req, trustedProxyHops))
+		if ip == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		record, err := db.Country(ip)
+		if err != nil {
+			slog.Error("Could not look up country of client", "ip", ip, "err", err)
+			next.ServeHTTP(w, req)
+			return
+		}
+		for _, rule := range rules {
+			if !containsString(rule.Countries, record.Country.IsoCode) {
+				continue
+			}
+			if rule.Action == "block" {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			http.Redirect(w, req, strings.TrimRight(rule.Target, "/")+req.URL.RequestURI(), rule.Status)
+			return
+		}
+		next.ServeHTTP(w, req)
+	}), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
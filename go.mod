@@ -1,3 +1,46 @@
 module spa-server
 
-go 1.18
+go 1.21
+
+require (
+	filippo.io/age v1.2.1
+	github.com/alicebob/miniredis/v2 v2.34.0
+	github.com/andybalholm/brotli v1.1.1
+	github.com/coreos/go-oidc/v3 v3.10.0
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/getsentry/sentry-go v0.27.0
+	github.com/klauspost/compress v1.17.11
+	github.com/oschwald/geoip2-golang v1.9.0
+	github.com/prometheus/client_golang v1.19.1
+	github.com/quic-go/quic-go v0.41.0
+	github.com/redis/go-redis/v9 v9.7.3
+	go.uber.org/automaxprocs v1.6.0
+	golang.org/x/crypto v0.24.0
+	golang.org/x/oauth2 v0.21.0
+	golang.org/x/sync v0.7.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20230218143504-906a9b012302 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/go-jose/go-jose/v4 v4.0.1 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/oschwald/maxminddb-golang v1.12.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/quic-go/qpack v0.4.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	go.uber.org/mock v0.3.0 // indirect
+	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+)
@@ -0,0 +1,67 @@
+package main
+
+import "net/http"
+
+// singletonHeaders must be sent at most once per response. With several handlers and features setting
+// them, a second value would otherwise confuse caches and browsers, e.g. two Cache-Control headers.
+var singletonHeaders = []string{
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Origin",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Range",
+	"Content-Security-Policy",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+	"Priority",
+	"Retry-After",
+	"X-Frame-Options",
+}
+
+// headerPolicyWriter normalizes the headers right before they are sent: of every singleton header only
+// the value set last is kept.
+type headerPolicyWriter struct {
+	http.ResponseWriter
+	normalized bool
+}
+
+func (w *headerPolicyWriter) normalize() {
+	if w.normalized {
+		return
+	}
+	w.normalized = true
+	header := w.Header()
+	for _, name := range singletonHeaders {
+		if values := header.Values(name); len(values) > 1 {
+			header.Set(name, values[len(values)-1])
+		}
+	}
+}
+
+func (w *headerPolicyWriter) WriteHeader(status int) {
+	w.normalize()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerPolicyWriter) Write(b []byte) (int, error) {
+	w.normalize()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to reach the original response writer.
+func (w *headerPolicyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// newHeaderPolicyHandler applies the header policy to all responses, it must wrap all other handlers.
+func newHeaderPolicyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		policyWriter := &headerPolicyWriter{ResponseWriter: w}
+		next.ServeHTTP(policyWriter, req)
+		// responses without a body are only sent after the handler returned
+		policyWriter.normalize()
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBundle is the bundle the handler chain is tested with.
+var testBundle = map[string]string{
+	"/index.html":                  `<!doctype html><html><head><base href="/"><script src="/assets/main.3f2a1b9c.js"></script></head><body></body></html>`,
+	"/assets/main.3f2a1b9c.js":     `console.log("main");` + strings.Repeat(`console.log("padding");`, 200),
+	"/assets/main.3f2a1b9c.css":    `body { margin: 0; }`,
+	"/assets/main.3f2a1b9c.js.map": `{"version":3,"sources":["main.ts"],"mappings":""}`,
+	"/logo.svg":                    `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+}
+
+// newTestServer builds the handler chain of the server for the test bundle, configured by the env variables.
+func newTestServer(t *testing.T, env map[string]string) http.Handler {
+	t.Helper()
+	return newTestSPAServer(t, env).handler
+}
+
+// newTestSPAServer sets up the server for the test bundle, configured by the env variables.
+func newTestSPAServer(t *testing.T, env map[string]string) *spaServer {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range testBundle {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("STATIC_DIR", dir)
+	t.Setenv("ACCESS_LOG", "false")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return setupServer(ctx, time.Now(), newLogBroadcast())
+}
+
+func TestHeaderPolicyPerRouteClass(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// a backend setting the singleton headers repeatedly
+		w.Header().Add("Cache-Control", "no-cache")
+		w.Header().Add("Cache-Control", "private")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer backend.Close()
+	handler := newTestServer(t, map[string]string{
+		"PROXY_RULES": "/api/=>" + backend.URL,
+	})
+
+	tests := []struct {
+		name         string
+		path         string
+		accept       string
+		status       int
+		contentType  string
+		cacheControl string
+		csp          bool
+	}{
+		{"html", "/", "text/html", http.StatusOK, "text/html; charset=utf-8", "public, max-age=60", true},
+		{"html fallback", "/orders/42", "text/html", http.StatusOK, "text/html; charset=utf-8", "public, max-age=60", true},
+		{"config", "/config.json", "application/json", http.StatusOK, "application/json", "public, max-age=60", false},
+		{"hashed asset", "/assets/main.3f2a1b9c.js", "*/*", http.StatusOK, "text/javascript; charset=utf-8", "public, max-age=604800, immutable", false},
+		{"unhashed asset", "/logo.svg", "*/*", http.StatusOK, "image/svg+xml", "public, max-age=604800, immutable", false},
+		{"proxy", "/api/orders", "application/json", http.StatusOK, "application/json", "private", false},
+		{"missing asset", "/assets/missing.js", "*/*", http.StatusNotFound, "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			req.Header.Set("Accept", test.accept)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			response := recorder.Result()
+
+			if response.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d", response.StatusCode, test.status)
+			}
+			for _, name := range singletonHeaders {
+				if values := response.Header.Values(name); len(values) > 1 {
+					t.Errorf("%s sent %d times: %q", name, len(values), values)
+				}
+			}
+			if test.contentType != "" && response.Header.Get("Content-Type") != test.contentType {
+				t.Errorf("Content-Type = %q, want %q", response.Header.Get("Content-Type"), test.contentType)
+			}
+			if test.cacheControl != "" && response.Header.Get("Cache-Control") != test.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", response.Header.Get("Cache-Control"), test.cacheControl)
+			}
+			if hasCSP := response.Header.Get("Content-Security-Policy") != ""; hasCSP != test.csp {
+				t.Errorf("Content-Security-Policy sent = %t, want %t", hasCSP, test.csp)
+			}
+		})
+	}
+}
+
+func TestHeaderPolicyKeepsLastValue(t *testing.T) {
+	handler := newHeaderPolicyHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Cache-Control", "public, max-age=60")
+		w.Header().Add("Cache-Control", "no-store")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Origin")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if values := recorder.Result().Header.Values("Cache-Control"); len(values) != 1 || values[0] != "no-store" {
+		t.Errorf("Cache-Control = %q, want [no-store]", values)
+	}
+	// headers that may repeat are left alone
+	if values := recorder.Result().Header.Values("Vary"); len(values) != 2 {
+		t.Errorf("Vary = %q, want both values", values)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const heatmapBucket = time.Minute
+
+// accessHeatmap counts the requests per asset in a ring buffer of one minute buckets covering the window,
+// and remembers which assets were requested at all since the start, to find dead code in the bundle.
+type accessHeatmap struct {
+	assets []string
+
+	mutex     sync.Mutex
+	buckets   []map[string]uint64
+	current   int
+	started   time.Time
+	requested map[string]bool
+}
+
+type assetHits struct {
+	Path string `json:"path"`
+	Hits uint64 `json:"hits"`
+}
+
+func newAccessHeatmap(files map[string]loadedFile, window time.Duration) *accessHeatmap {
+	heatmap := &accessHeatmap{
+		buckets:   make([]map[string]uint64, (window+heatmapBucket-1)/heatmapBucket),
+		started:   time.Now().Truncate(heatmapBucket),
+		requested: make(map[string]bool, len(files)),
+	}
+	for path := range files {
+		if path != indexFileName && path != configFileName {
+			heatmap.assets = append(heatmap.assets, path)
+		}
+	}
+	sort.Strings(heatmap.assets)
+	for i := range heatmap.buckets {
+		heatmap.buckets[i] = make(map[string]uint64)
+	}
+	return heatmap
+}
+
+// rotate clears the buckets the clock moved past, the mutex must be held.
+func (h *accessHeatmap) rotate(now time.Time) {
+	elapsed := int(now.Sub(h.started) / heatmapBucket)
+	if elapsed > len(h.buckets) {
+		elapsed = len(h.buckets)
+	}
+	for i := 0; i < elapsed; i++ {
+		h.current = (h.current + 1) % len(h.buckets)
+		h.buckets[h.current] = make(map[string]uint64)
+	}
+	if elapsed > 0 {
+		h.started = now.Truncate(heatmapBucket)
+	}
+}
+
+// record counts a request of an asset of the bundle.
+func (h *accessHeatmap) record(path string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.rotate(time.Now())
+	h.buckets[h.current][path]++
+	h.requested[path] = true
+}
+
+// report returns the assets by the number of requests within the window, and the assets never requested.
+func (h *accessHeatmap) report() (hottest []assetHits, neverRequested []string) {
+	h.mutex.Lock()
+	h.rotate(time.Now())
+	hits := make(map[string]uint64)
+	for _, bucket := range h.buckets {
+		for path, count := range bucket {
+			hits[path] += count
+		}
+	}
+	neverRequested = []string{}
+	for _, path := range h.assets {
+		if !h.requested[path] {
+			neverRequested = append(neverRequested, path)
+		}
+	}
+	h.mutex.Unlock()
+
+	hottest = make([]assetHits, 0, len(hits))
+	for path, count := range hits {
+		hottest = append(hottest, assetHits{path, count})
+	}
+	sort.Slice(hottest, func(i, j int) bool {
+		if hottest[i].Hits == hottest[j].Hits {
+			return hottest[i].Path < hottest[j].Path
+		}
+		return hottest[i].Hits > hottest[j].Hits
+	})
+	return hottest, neverRequested
+}
+
+// handler serves the heatmap as json at the path, all other requests are passed to the next handler.
+func (h *accessHeatmap) handler(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			next.ServeHTTP(w, req)
+			return
+		}
+		hottest, neverRequested := h.report()
+		body, err := json.Marshal(struct {
+			Window         string      `json:"window"`
+			Hottest        []assetHits `json:"hottest"`
+			NeverRequested []string    `json:"neverRequested"`
+		}{
+			Window:         fmt.Sprint(time.Duration(len(h.buckets)) * heatmapBucket),
+			Hottest:        hottest,
+			NeverRequested: neverRequested,
+		})
+		if err != nil {
+			writeProblem(w, req, http.StatusInternalServerError, "the heatmap could not be encoded")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	})
+}
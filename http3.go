@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+type quicConnKey struct{}
+
+// newHTTP3Server serves the handler over QUIC with the tls config of the TCP server. The advertisedPort is
+// announced in the Alt-Svc header, which differs from the port listened on behind a load balancer. With
+// allow0RTT, resuming clients may send requests in 0-RTT data, before the handshake completed.
+func newHTTP3Server(tlsConfig *tls.Config, advertisedPort int, idleTimeout time.Duration, allow0RTT bool, handler http.Handler) *http3.Server {
+	if allow0RTT {
+		handler = newEarlyDataHandler(handler)
+	}
+	return &http3.Server{
+		Port:      advertisedPort,
+		TLSConfig: tlsConfig,
+		QuicConfig: &quic.Config{
+			MaxIdleTimeout: idleTimeout,
+			Allow0RTT:      allow0RTT,
+		},
+		ConnContext: func(ctx context.Context, conn quic.Connection) context.Context {
+			return context.WithValue(ctx, quicConnKey{}, conn)
+		},
+		Handler: handler,
+	}
+}
+
+// earlyData tells if the request arrived in 0-RTT data of a connection whose handshake has not completed,
+// such a request may be replayed by an attacker.
+func earlyData(req *http.Request) bool {
+	conn, found := req.Context().Value(quicConnKey{}).(quic.EarlyConnection)
+	if !found {
+		return false
+	}
+	select {
+	case <-conn.HandshakeComplete():
+		return false
+	default:
+		return true
+	}
+}
+
+// newEarlyDataHandler only serves GET and HEAD requests from 0-RTT data, as they do not change anything
+// when replayed. Other requests are answered with 425 Too Early, so the client sends them again after the
+// handshake. Backends learn of early requests from the Early-Data header (RFC 8470).
+func newEarlyDataHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !earlyData(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			writeProblem(w, req, http.StatusTooEarly, "the request may be a replay, send it again once the handshake completed")
+			return
+		}
+		req.Header.Set("Early-Data", "1")
+		next.ServeHTTP(w, req)
+	})
+}
+
+// newAltSvcHandler advertises the HTTP/3 server to the clients connected over TCP, so browsers switch to
+// QUIC for their next requests.
+func newAltSvcHandler(quicSrv *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor < 3 {
+			// fails only until the udp sockets are open, the header is left out then
+			_ = quicSrv.SetQuicHeaders(w.Header())
+		}
+		next.ServeHTTP(w, req)
+	})
+}
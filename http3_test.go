@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// testEarlyConn is a QUIC connection whose handshake completes when complete is closed.
+type testEarlyConn struct {
+	quic.EarlyConnection
+	complete chan struct{}
+}
+
+func (c testEarlyConn) HandshakeComplete() <-chan struct{} {
+	return c.complete
+}
+
+func TestEarlyDataOnlyServesSafeMethods(t *testing.T) {
+	handler := newEarlyDataHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Early-Data", req.Header.Get("Early-Data"))
+	}))
+	completed := make(chan struct{})
+	close(completed)
+
+	tests := []struct {
+		name      string
+		method    string
+		complete  chan struct{}
+		status    int
+		earlyData string
+	}{
+		{"early GET", http.MethodGet, make(chan struct{}), http.StatusOK, "1"},
+		{"early HEAD", http.MethodHead, make(chan struct{}), http.StatusOK, "1"},
+		{"early POST", http.MethodPost, make(chan struct{}), http.StatusTooEarly, ""},
+		{"POST after the handshake", http.MethodPost, completed, http.StatusOK, ""},
+		{"POST over TCP", http.MethodPost, nil, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "https://localhost/api/orders", nil)
+			if test.complete != nil {
+				req = req.WithContext(context.WithValue(req.Context(), quicConnKey{}, testEarlyConn{complete: test.complete}))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+			if earlyData := rec.Header().Get("X-Early-Data"); earlyData != test.earlyData {
+				t.Errorf("Early-Data = %q, want %q", earlyData, test.earlyData)
+			}
+		})
+	}
+}
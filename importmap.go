@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+var importMapPattern = regexp.MustCompile(`(?s)<script type=["']?importmap["']?>(.*?)</script>`)
+
+type importMap struct {
+	Imports   map[string]string            `json:"imports,omitempty"`
+	Scopes    map[string]map[string]string `json:"scopes,omitempty"`
+	Integrity map[string]string            `json:"integrity,omitempty"`
+}
+
+// injectImportMap adds the import map to the html document. When the document already has an import map,
+// the configured entries are merged over it, remapping e.g. the remote entries of micro-frontends per
+// environment. The script element receives the csp nonce like every other script element of index.html.
+func injectImportMap(html []byte, mapJSON string) ([]byte, error) {
+	var configured importMap
+	err := json.Unmarshal([]byte(mapJSON), &configured)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := importMap{
+		Imports:   make(map[string]string),
+		Scopes:    make(map[string]map[string]string),
+		Integrity: make(map[string]string),
+	}
+	existing := importMapPattern.FindSubmatch(html)
+	if existing != nil {
+		err = json.Unmarshal(existing[1], &merged)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse the import map of index.html: %w", err)
+		}
+	}
+	for specifier, address := range configured.Imports {
+		merged.Imports[specifier] = address
+	}
+	for scope, imports := range configured.Scopes {
+		if merged.Scopes[scope] == nil {
+			merged.Scopes[scope] = make(map[string]string)
+		}
+		for specifier, address := range imports {
+			merged.Scopes[scope][specifier] = address
+		}
+	}
+	for address, integrity := range configured.Integrity {
+		merged.Integrity[address] = integrity
+	}
+
+	// json.Marshal escapes <, > and &, so the map can't close the script element
+	encoded, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	script := append(append([]byte(`<script type="importmap">`), encoded...), "</script>"...)
+
+	if existing != nil {
+		return importMapPattern.ReplaceAllLiteral(html, script), nil
+	}
+	// the import map must precede all module scripts
+	if position := bytes.Index(html, []byte("<script")); position >= 0 {
+		return append(append(append([]byte{}, html[:position]...), script...), html[position:]...), nil
+	}
+	return bytes.Replace(html, []byte("</head>"), append(script, "</head>"...), 1), nil
+}
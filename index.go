@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// indexFallbackTimeout bounds the fetch of the fallback index.html from a url.
+const indexFallbackTimeout = 10 * time.Second
+
+// placeholderIndex is served when the bundle has no index.html and INDEX_FALLBACK is placeholder.
+const placeholderIndex = `<!doctype html>
+<html lang="en">
+<head>
+    <base href="/">
+    <title>spa-server</title>
+</head>
+<body>
+<p>The application is not available yet.</p>
+</body>
+</html>`
+
+// fallbackIndex provides index.html for bundles without one. The fallback is either a placeholder page or
+// the index.html fetched once from a http(s) url, so smoke-test images and partial bundles still start.
+func fallbackIndex(ctx context.Context, fallback string) (loadedFile, error) {
+	index := loadedFile{
+		mime:     mime.TypeByExtension(".html"),
+		modified: time.Now(),
+	}
+	switch {
+	case fallback == "placeholder":
+		index.file = []byte(strings.Replace(
+			placeholderIndex,
+			"<base href=\"/\"",
+			fmt.Sprint("<base href=\"", getenvString("BASE_HREF", "/"), "\""),
+			-1))
+	case strings.HasPrefix(fallback, "http://") || strings.HasPrefix(fallback, "https://"):
+		ctx, cancel := context.WithTimeout(ctx, indexFallbackTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fallback, nil)
+		if err != nil {
+			return index, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return index, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return index, fmt.Errorf("%s responded with status %d", fallback, resp.StatusCode)
+		}
+		index.file, err = io.ReadAll(io.LimitReader(resp.Body, remoteMaxBytes))
+		if err != nil {
+			return index, err
+		}
+	default:
+		return index, fmt.Errorf("unknown index fallback %q", fallback)
+	}
+	slog.Info("Serving fallback index.html", "fallback", fallback)
+	return index, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// integrityManifest maps the paths of all assets to their subresource integrity hash. The html and the
+// config are left out, as their content is rewritten per response.
+func integrityManifest(files map[string]loadedFile) ([]byte, error) {
+	manifest := make(map[string]string, len(files))
+	for path, file := range files {
+		if path == indexFileName || path == configFileName {
+			continue
+		}
+		content, err := file.uncompressed()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		hash := sha512.Sum384(content)
+		manifest[path] = "sha384-" + base64.StdEncoding.EncodeToString(hash[:])
+	}
+	return json.Marshal(manifest)
+}
+
+// newIntegrityHandler serves the integrity manifest at the path, so module loaders can verify the chunks
+// they fetch at runtime.
+func newIntegrityHandler(path string, files map[string]loadedFile, next http.Handler) (http.Handler, error) {
+	manifest, err := integrityManifest(files)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// the manifest changes with every deployment under the same path
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+		_, _ = w.Write(manifest)
+	}), nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"go.uber.org/automaxprocs/maxprocs"
+)
+
+// cgroupMemoryFiles hold the memory limit of the container for cgroup v2 and v1.
+var cgroupMemoryFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// applyCgroupLimits derives GOMAXPROCS from the cpu quota and GOMEMLIMIT from the memory limit of the
+// container, unless they are set explicitly. The memory limit leaves headroom of 100 - ratio percent.
+func applyCgroupLimits(memoryLimitPercent uint64) {
+	_, err := maxprocs.Set(maxprocs.Logger(func(format string, args ...interface{}) {
+		slog.Info(fmt.Sprintf(format, args...))
+	}))
+	if err != nil {
+		slog.Error("Could not set GOMAXPROCS from cgroup cpu quota", "err", err)
+	}
+
+	if _, found := os.LookupEnv("GOMEMLIMIT"); found {
+		return
+	}
+	for _, path := range cgroupMemoryFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil || limit >= 1<<60 {
+			// "max" or the huge value cgroup v1 reports for unlimited memory
+			return
+		}
+		memLimit := limit / 100 * memoryLimitPercent
+		debug.SetMemoryLimit(int64(memLimit))
+		slog.Info("Set GOMEMLIMIT from cgroup memory limit", "limit", limit, "GOMEMLIMIT", memLimit)
+		return
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// familyNetworks returns the network suffixes and addresses to listen on for the ip family. The family
+// "ipv4" listens on address only, "ipv6" on addressV6 only and "dual" on both with separate sockets.
+// Without a family a single socket is opened on address, which the operating system may bind to both
+// families.
+func familyNetworks(family string, address string, addressV6 string) ([][2]string, error) {
+	switch family {
+	case "":
+		return [][2]string{{"", address}}, nil
+	case "ipv4":
+		return [][2]string{{"4", address}}, nil
+	case "ipv6":
+		return [][2]string{{"6", addressV6}}, nil
+	case "dual":
+		return [][2]string{{"4", address}, {"6", addressV6}}, nil
+	default:
+		return nil, fmt.Errorf("unknown ip family %q", family)
+	}
+}
+
+// listen opens the tcp listeners of the server for the ip family.
+func listen(family string, address string, addressV6 string, port string) ([]net.Listener, error) {
+	networks, err := familyNetworks(family, address, addressV6)
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]net.Listener, 0, len(networks))
+	for _, network := range networks {
+		listener, err := net.Listen("tcp"+network[0], net.JoinHostPort(network[1], port))
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenPackets opens the udp sockets of the HTTP/3 server for the ip family.
+func listenPackets(family string, address string, addressV6 string, port string) ([]net.PacketConn, error) {
+	networks, err := familyNetworks(family, address, addressV6)
+	if err != nil {
+		return nil, err
+	}
+	conns := make([]net.PacketConn, 0, len(networks))
+	for _, network := range networks {
+		conn, err := net.ListenPacket("udp"+network[0], net.JoinHostPort(network[1], port))
+		if err != nil {
+			for _, opened := range conns {
+				opened.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// serve serves the requests of all listeners, and of the udp sockets with the HTTP/3 server if there is
+// one, and returns the first error of any of them. On SIGTERM or SIGINT the server stops accepting
+// connections, calls draining and waits up to drain for in-flight requests to complete.
+func serve(srv *http.Server, listeners []net.Listener, quicSrv *http3.Server, conns []net.PacketConn, drain time.Duration, draining func()) error {
+	errs := make(chan error, len(listeners)+len(conns))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if srv.TLSConfig != nil {
+				// the certificate comes from TLSConfig.GetCertificate
+				errs <- srv.ServeTLS(listener, "", "")
+			} else {
+				errs <- srv.Serve(listener)
+			}
+		}(listener)
+	}
+	for _, conn := range conns {
+		go func(conn net.PacketConn) {
+			errs <- quicSrv.Serve(conn)
+		}(conn)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("Shutting down server", "signal", sig, "drain", drain)
+	}
+	draining()
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if quicSrv != nil {
+		// quic-go does not drain HTTP/3 connections yet, they are closed right away
+		quicSrv.Close()
+	}
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("in-flight requests did not complete within %s: %w", drain, err)
+	}
+	return nil
+}
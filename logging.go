@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// setupLogging makes slog the logger of the server. The format is "text" or "json", the level one of
+// "debug", "info", "warn" or "error". Besides stderr, every record is written to the tee, e.g. to stream the
+// log to the admin port.
+func setupLogging(format string, level string, tee io.Writer) error {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return err
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	out := io.MultiWriter(os.Stderr, tee)
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	// the server itself logs with slog, the log package is left to libraries like net/http, which use it
+	// for errors
+	log.SetFlags(0)
+	log.SetOutput(logPackageWriter{handler: handler})
+	return nil
+}
+
+// logPackageWriter passes the messages of the log package on to slog at level warn, so they are not
+// dropped with LOG_LEVEL=warn.
+type logPackageWriter struct {
+	handler slog.Handler
+}
+
+func (w logPackageWriter) Write(p []byte) (int, error) {
+	ctx := context.Background()
+	if !w.handler.Enabled(ctx, slog.LevelWarn) {
+		return len(p), nil
+	}
+	record := slog.NewRecord(time.Now(), slog.LevelWarn, strings.TrimSuffix(string(p), "\n"), 0)
+	return len(p), w.handler.Handle(ctx, record)
+}
+
+// fatal logs the error that keeps the server from running at level error and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newAccessLogHandler logs every request with its outcome at level info.
+func newAccessLogHandler(trustedProxyHops int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, req)
+		slog.LogAttrs(req.Context(), slog.LevelInfo, "Access",
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("userAgent", req.UserAgent()),
+			slog.String("remoteIp", clientIP(req, trustedProxyHops)),
+		)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// logStreamBuffer is the number of log records a slow client may lag behind before records are dropped.
+const logStreamBuffer = 256
+
+// logBroadcast passes the log records written to it on to the connected clients. The slog handlers write
+// every record with a single Write, so each write is one record.
+type logBroadcast struct {
+	mutex   sync.Mutex
+	clients map[chan []byte]bool
+}
+
+func newLogBroadcast() *logBroadcast {
+	return &logBroadcast{clients: make(map[chan []byte]bool)}
+}
+
+// Write never blocks the logging server, records are dropped for clients that cannot keep up.
+func (b *logBroadcast) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.clients) == 0 {
+		return len(p), nil
+	}
+	// the handler reuses its buffer after the write
+	record := bytes.TrimRight(bytes.Clone(p), "\n")
+	for client := range b.clients {
+		select {
+		case client <- record:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (b *logBroadcast) subscribe() chan []byte {
+	client := make(chan []byte, logStreamBuffer)
+	b.mutex.Lock()
+	b.clients[client] = true
+	b.mutex.Unlock()
+	return client
+}
+
+func (b *logBroadcast) unsubscribe(client chan []byte) {
+	b.mutex.Lock()
+	delete(b.clients, client)
+	b.mutex.Unlock()
+}
+
+// newLogStreamHandler streams the live log of the server as server-sent events, one event per record. With the query parameter contains only the records
+// including its value are sent, e.g. ?contains=status=500.
+func newLogStreamHandler(logs *logBroadcast) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeProblem(w, req, http.StatusMethodNotAllowed, "the log stream must be opened with GET")
+			return
+		}
+		contains := []byte(req.URL.Query().Get("contains"))
+
+		client := logs.subscribe()
+		defer logs.unsubscribe(client)
+
+		controller := http.NewResponseController(w)
+		_ = controller.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = fmt.Fprint(w, ": connected\n\n")
+		_ = controller.Flush()
+		for {
+			select {
+			case record := <-client:
+				if !bytes.Contains(record, contains) {
+					continue
+				}
+				_, err := fmt.Fprintf(w, "data: %s\n\n", record)
+				if err != nil {
+					return
+				}
+				_ = controller.Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -2,19 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"io/fs"
-	"log"
+	"log/slog"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
 )
 
 //go:embed all:public/*
@@ -24,9 +31,43 @@ const dirPrefix = "public"
 const indexFileName = "/index.html"
 const configFileName = "/config.json"
 
+// servedBundle is the state of the bundle the file handler serves, it is replaced as a whole when the bundle
+// is reloaded in dev mode.
+type servedBundle struct {
+	files map[string]loadedFile
+	// indexFiles is the index.html per mount
+	indexFiles map[string]loadedFile
+	shellETags map[string]string
+	version    string
+}
+
+// spaServer is the handler chain of the server with the settings the listeners are set up with.
+type spaServer struct {
+	handler     http.Handler
+	features    []string
+	files       map[string]loadedFile
+	version     string
+	metrics     *serverMetrics
+	metricsPort string
+	healthPath  string
+	readyPath   string
+	details     *healthDetails
+	config      *runtimeConfig
+	routes      *routeTable
+	// routing are the read-only settings of the routing document
+	routing routingReadOnly
+}
+
 type loadedFile struct {
 	file []byte
 	mime string
+	// encoded is the precompressed content per content encoding, lazy is set instead of file for files
+	// decompressed on first use
+	encoded map[string][]byte
+	lazy    *lazyContent
+	etag    string
+	// modified is the build time for files of the bundle and the load time for index.html and config.json
+	modified time.Time
 }
 
 func getenvString(key, fallback string) string {
@@ -44,27 +85,43 @@ func getenvUint(key string, fallback uint64) uint64 {
 	}
 	valueUint, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		log.Fatalf("Could not convert value from env to uint64. key: %s, value: %s err: %v", key, value, err)
+		fatal("Could not convert value from env to uint64", "key", key, "value", value, "err", err)
 	}
 	return valueUint
 }
 
-func loadFilesFromEmbeddedFs() (map[string]loadedFile, error) {
-	var files = make(map[string]loadedFile)
+// getenvFile returns the content of the file named by <key>_FILE if it is set, e.g. a mounted ConfigMap
+// for rules too long for an env variable, otherwise the value of the env variable.
+func getenvFile(key, fallback string) string {
+	path := os.Getenv(key + "_FILE")
+	if len(path) == 0 {
+		return getenvString(key, fallback)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fatal("Could not read file from env", "key", key+"_FILE", "path", path, "err", err)
+	}
+	return string(content)
+}
 
-	err := fs.WalkDir(embeddedFs, dirPrefix, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
+// loadFiles loads the files of the bundle, files with a content already in the store share it.
+func loadFiles(source bundleSource, configJSON []byte, store *contentStore) (map[string]loadedFile, error) {
+	var files = make(map[string]loadedFile)
+	lazyDecompression := getenvString("LAZY_DECOMPRESSION", "false") == "true"
+	encodings, err := parseEncodings(getenvString("COMPRESSION", "gzip"))
+	if err != nil {
+		return nil, err
+	}
 
-		file, err := embeddedFs.ReadFile(path)
+	paths, err := source.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		file, err := readFile(source, path)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		path = strings.TrimLeft(path, dirPrefix)
 		// apply base href correction
 		if path == indexFileName {
 			file = bytes.Replace(
@@ -86,112 +143,1283 @@ func loadFilesFromEmbeddedFs() (map[string]loadedFile, error) {
 			file: file,
 			mime: mimeType,
 		}
-		log.Printf("Loading file from embeded filessystem. file %s\n", path)
-		return nil
-	})
+		slog.Info("Loading file of the bundle", "file", path)
+	}
 
-	files[configFileName] = loadedFile{
-		file: []byte(getenvString("CONFIG_JSON", "{}")),
-		mime: mime.TypeByExtension(filepath.Ext(configFileName)),
+	attachPrecompressedSiblings(files)
+	built := buildTime()
+	loaded := time.Now()
+	sharedFiles := 0
+	for path, file := range files {
+		if path == indexFileName {
+			// the base href is replaced at load time
+			file.modified = loaded
+			files[path] = file
+			continue
+		}
+		file.modified = built
+		file.etag = contentETag(file.file)
+		prepared, shared, err := store.intern(file, func(file loadedFile) (loadedFile, error) {
+			if len(encodings) > 0 || lazyDecompression {
+				return precompress(file, encodings, lazyDecompression)
+			}
+			return file, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if shared {
+			sharedFiles++
+		}
+		files[path] = prepared
+	}
+	store.retain(files)
+	if sharedFiles > 0 {
+		slog.Info("Sharing the content of identical files", "files", sharedFiles)
 	}
 
-	if err != nil {
-		return nil, err
+	files[configFileName] = loadedFile{
+		file:     configJSON,
+		mime:     mime.TypeByExtension(filepath.Ext(configFileName)),
+		modified: loaded,
 	}
 
 	return files, nil
 }
 
 func main() {
+	started := time.Now()
+	logs := newLogBroadcast()
+	err := setupLogging(getenvString("LOG_FORMAT", "text"), getenvString("LOG_LEVEL", "info"), logs)
+	if err != nil {
+		fatal("Could not set up logging", "err", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "smoke" {
+		os.Exit(runSmoke(os.Args[2:]))
+	}
+
+	if getenvString("CGROUP_LIMITS", "true") == "true" {
+		memoryLimitPercent := getenvUint("MEMORY_LIMIT_PERCENT", 90)
+		if memoryLimitPercent == 0 || memoryLimitPercent > 100 {
+			fatal("Memory limit percent must be between 1 and 100", "value", memoryLimitPercent)
+		}
+		applyCgroupLimits(memoryLimitPercent)
+	}
+
 	port := getenvString("PORT", "8080")
 	addr := getenvString("ADDRESS", "0.0.0.0")
 
 	readTimeout := getenvUint("READ_TIMEOUT_SECONDS", 5)
 	writeTimeout := getenvUint("WRITE_TIMEOUT_SECONDS", 10)
 	idleTimeout := getenvUint("IDLE_TIMEOUT_SECONDS", 120)
-	csp := getenvString("CSP_HEADER", "")
+	sidecarReadyURL := getenvString("SIDECAR_READY_URL", "")
+	sidecarReadyTimeout := getenvUint("SIDECAR_READY_TIMEOUT_SECONDS", 60)
+	sidecarQuitURL := getenvString("SIDECAR_QUIT_URL", "")
 
-	files, err := loadFilesFromEmbeddedFs()
+	// lifetime ends when the server stopped, it bounds the background work like the sinks
+	lifetime, stop := context.WithCancel(context.Background())
+	defer stop()
+	server := setupServer(lifetime, started, logs)
 
+	srv := &http.Server{
+		Handler:      server.handler,
+		ReadTimeout:  time.Duration(readTimeout) * time.Second,
+		WriteTimeout: time.Duration(writeTimeout) * time.Second,
+		IdleTimeout:  time.Duration(idleTimeout) * time.Second,
+	}
+
+	tlsCertFile := getenvString("TLS_CERT_FILE", "")
+	tlsKeyFile := getenvString("TLS_KEY_FILE", "")
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		certs, err := newCertReloader(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			fatal("Could not load tls certificate", "cert", tlsCertFile, "key", tlsKeyFile, "err", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+		server.features = append(server.features, "tls")
+	}
+
+	acmeDomains := getenvString("ACME_DOMAINS", "")
+	acmeDNSProvider := getenvString("ACME_DNS_PROVIDER", "")
+	if acmeDomains != "" && srv.TLSConfig != nil {
+		fatal("Could not set up ACME, TLS_CERT_FILE and TLS_KEY_FILE are set as well")
+	}
+	if acmeDomains != "" && acmeDNSProvider != "" {
+		provider, err := newDNSProvider(acmeDNSProvider, getenvString("CLOUDFLARE_API_TOKEN", ""), getenvString("ACME_DNS_EXEC", ""))
+		if err != nil {
+			fatal("Could not set up the ACME dns provider", "err", err)
+		}
+		manager, err := newDNSACMEManager(
+			acmeDomains,
+			getenvString("ACME_EMAIL", ""),
+			getenvString("ACME_CACHE_DIR", "/var/cache/spa-server/acme"),
+			getenvString("ACME_DIRECTORY_URL", acme.LetsEncryptURL),
+			provider,
+			time.Duration(getenvUint("ACME_DNS_PROPAGATION_SECONDS", 120))*time.Second)
+		if err != nil {
+			fatal("Could not set up ACME with DNS-01", "err", err)
+		}
+		// no challenge listener, the server may be unreachable from the internet
+		go manager.run(lifetime)
+		srv.TLSConfig = manager.TLSConfig()
+		server.features = append(server.features, "acme-dns01")
+	} else if acmeDomains != "" {
+		manager := newACMEManager(
+			acmeDomains,
+			getenvString("ACME_EMAIL", ""),
+			getenvString("ACME_CACHE_DIR", "/var/cache/spa-server/acme"),
+			getenvString("ACME_DIRECTORY_URL", acme.LetsEncryptURL))
+		srv.TLSConfig = manager.TLSConfig()
+		challengeSrv := &http.Server{
+			Addr:        net.JoinHostPort(addr, getenvString("ACME_HTTP_PORT", "80")),
+			ReadTimeout: time.Duration(readTimeout) * time.Second,
+			IdleTimeout: time.Duration(idleTimeout) * time.Second,
+			// answers the HTTP-01 challenges and redirects all other requests to https
+			Handler: manager.HTTPHandler(nil),
+		}
+		go func() {
+			slog.Info("Serving ACME challenges", "addr", challengeSrv.Addr)
+			err := challengeSrv.ListenAndServe()
+			fatal("Could not serve ACME challenges", "err", err)
+		}()
+		server.features = append(server.features, "acme")
+	}
+
+	if srv.TLSConfig != nil {
+		if getenvString("TLS_SESSION_TICKETS", "true") != "true" {
+			srv.TLSConfig.SessionTicketsDisabled = true
+		} else if keysFile := getenvString("TLS_SESSION_TICKET_KEYS_FILE", ""); keysFile != "" {
+			keys, err := newTicketKeyReloader(keysFile)
+			if err != nil {
+				fatal("Could not load the session ticket keys", "file", keysFile, "err", err)
+			}
+			keys.configure(srv.TLSConfig)
+			server.features = append(server.features, "shared-ticket-keys")
+		}
+	}
+
+	var quicSrv *http3.Server
+	http3Port := getenvString("HTTP3_PORT", port)
+	if getenvString("HTTP3", "false") == "true" {
+		if srv.TLSConfig == nil {
+			fatal("Could not set up HTTP/3, it requires TLS_CERT_FILE and TLS_KEY_FILE or ACME_DOMAINS")
+		}
+		// without an advertised port, the port of the udp sockets is advertised
+		advertisedPort := getenvUint("HTTP3_ADVERTISED_PORT", 0)
+		allow0RTT := getenvString("HTTP3_0RTT", "false") == "true"
+		if allow0RTT && srv.TLSConfig.SessionTicketsDisabled {
+			fatal("Could not set up 0-RTT, it resumes sessions and TLS_SESSION_TICKETS is false")
+		}
+		quicSrv = newHTTP3Server(srv.TLSConfig, int(advertisedPort), time.Duration(idleTimeout)*time.Second, allow0RTT, srv.Handler)
+		srv.Handler = newAltSvcHandler(quicSrv, srv.Handler)
+		server.features = append(server.features, "http3")
+	}
+
+	adminPort := getenvString("ADMIN_PORT", "")
+	var adminMux *http.ServeMux
+	if adminPort != "" {
+		admin, err := newAdminAuth(
+			getenvFile("ADMIN_TOKEN", ""),
+			getenvFile("ADMIN_TOKENS", ""),
+			getenvString("ADMIN_OIDC_ISSUER_URL", ""),
+			getenvString("ADMIN_OIDC_AUDIENCE", ""),
+			getenvString("ADMIN_OIDC_ROLES_CLAIM", "roles"))
+		if err != nil {
+			fatal("Could not set up the admin port", "err", err)
+		}
+		admin.audit, err = openAdminAuditLog(getenvString("ADMIN_AUDIT_LOG", ""))
+		if err != nil {
+			fatal("Could not open the admin audit log", "err", err)
+		}
+		adminMux = http.NewServeMux()
+		// the log stream lifts the write timeout for itself
+		adminMux.Handle("/logs", admin.require(map[string]adminRole{http.MethodGet: roleOperator}, newLogStreamHandler(logs)))
+		adminMux.Handle("/routing", admin.require(map[string]adminRole{http.MethodGet: roleViewer, http.MethodPut: roleOperator},
+			newRoutingHandler(server.routes, server.routing)))
+		adminMux.Handle("/openapi.json", admin.require(map[string]adminRole{http.MethodGet: roleViewer},
+			newOpenAPIHandler(managementOpenAPI(server.healthPath, server.readyPath))))
+		configHandler := newConfigHandler("/config", server.config)
+		adminMux.Handle("/config", admin.require(map[string]adminRole{http.MethodGet: roleViewer, http.MethodPut: roleOperator}, configHandler))
+		adminMux.Handle("/config/rollback", admin.require(map[string]adminRole{http.MethodPost: roleOperator}, configHandler))
+		adminMux.Handle("/audit", admin.require(map[string]adminRole{http.MethodGet: roleAdmin}, newAdminAuditHandler(admin.audit)))
+		server.features = append(server.features, "admin")
+	}
+
+	if sidecarReadyURL != "" {
+		slog.Info("Waiting for sidecar to become ready", "url", sidecarReadyURL)
+		err = waitForSidecar(lifetime, sidecarReadyURL, time.Duration(sidecarReadyTimeout)*time.Second)
+		if err != nil {
+			fatal("Sidecar did not become ready", "url", sidecarReadyURL, "err", err)
+		}
+	}
+
+	ipFamily := getenvString("IP_FAMILY", "")
+	addrV6 := getenvString("ADDRESS_V6", "::")
+	listeners, err := listen(ipFamily, addr, addrV6, port)
 	if err != nil {
-		log.Fatalf("Could not load files from embedded filesystem. err: %v", err)
+		fatal("Could not start server", "err", err)
+	}
+	for _, listener := range listeners {
+		slog.Info("Starting server", "addr", listener.Addr())
+	}
+	var quicConns []net.PacketConn
+	if quicSrv != nil {
+		quicConns, err = listenPackets(ipFamily, addr, addrV6, http3Port)
+		if err != nil {
+			fatal("Could not start HTTP/3 server", "err", err)
+		}
+		for _, conn := range quicConns {
+			slog.Info("Starting HTTP/3 server", "addr", conn.LocalAddr())
+		}
+	}
+	addresses := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		addresses = append(addresses, listener.Addr().String())
+	}
+	totalBytes := 0
+	for path, file := range server.files {
+		content, err := file.uncompressed()
+		if err != nil {
+			fatal("Could not decompress file of the bundle", "file", path, "err", err)
+		}
+		totalBytes += len(content)
+	}
+	logStartupSummary(startupSummary{
+		Listeners:   addresses,
+		BundleHash:  server.version,
+		Files:       len(server.files),
+		TotalBytes:  totalBytes,
+		Features:    server.features,
+		CachePolicy: server.routing.CachePolicy,
+	})
+	management := &managementListeners{
+		readTimeout:  time.Duration(getenvUint("MANAGEMENT_READ_TIMEOUT_SECONDS", readTimeout)) * time.Second,
+		writeTimeout: time.Duration(getenvUint("MANAGEMENT_WRITE_TIMEOUT_SECONDS", 30)) * time.Second,
+		idleTimeout:  time.Duration(getenvUint("MANAGEMENT_IDLE_TIMEOUT_SECONDS", idleTimeout)) * time.Second,
+		linger:       time.Duration(getenvUint("MANAGEMENT_LINGER_SECONDS", 5)) * time.Second,
+	}
+	// the probes are answered on the management listeners as well, so they can move off the public port
+	if server.metricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle(getenvString("METRICS_PATH", "/metrics"), server.metrics.endpoint())
+		management.add("metrics", net.JoinHostPort(addr, server.metricsPort), management.readiness(server.readyPath, newHealthHandler(server.healthPath, server.readyPath, server.details, mux)))
+	}
+	if adminMux != nil {
+		management.add("admin endpoints", net.JoinHostPort(addr, adminPort), management.readiness(server.readyPath, newHealthHandler(server.healthPath, server.readyPath, server.details, adminMux)))
 	}
 
-	indexFile, indexFileFound := files[indexFileName]
-	if !indexFileFound {
-		log.Fatalln("Could not find index.html")
+	err = serve(srv, listeners, quicSrv, quicConns, time.Duration(getenvUint("SHUTDOWN_DRAIN_SECONDS", 20))*time.Second, management.drain)
+	management.shutdown()
+	stop()
+	if sidecarQuitURL != "" {
+		quitSidecar(sidecarQuitURL)
+	}
+	if err != nil {
+		fatal("Could not start server", "err", err)
 	}
 
-	srv := &http.Server{
-		Addr: fmt.Sprintf("%s:%s", addr, port),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			loadedFile, exists := files[req.URL.Path]
-			if !exists {
-				loadedFile = indexFile
-			}
-			w.Header().Add("Content-Type", loadedFile.mime)
-			content := loadedFile.file
-			if !exists || req.URL.Path == indexFileName {
-				nonce := make([]byte, 32)
-				_, err := rand.Read(nonce)
-				if err != nil {
-					log.Printf("Could not generate nonce for CSP header. err: %v", err)
-					nonce = []byte("RaND9mN0nC3")
+	slog.Info("Stopping Server")
+}
+
+// setupServer loads the bundle and builds the handler chain as configured by the env variables. The
+// background work of the handlers, e.g. forwarding events or watching the bundle, ends with the context.
+func setupServer(ctx context.Context, started time.Time, logs *logBroadcast) *spaServer {
+	csp := getenvString("CSP_HEADER", defaultCSP)
+	var trustedProxyHops int
+	if getenvString("TRUST_PROXY_HEADERS", "false") == "true" {
+		trustedProxyHops = int(getenvUint("TRUSTED_PROXY_HOPS", 1))
+		if trustedProxyHops == 0 {
+			fatal("TRUSTED_PROXY_HOPS must be at least 1 with TRUST_PROXY_HEADERS")
+		}
+	}
+	geoipDbPath := getenvString("GEOIP_DB_PATH", "")
+	geoipRules := getenvString("GEOIP_RULES", "[]")
+	sentryDsn := getenvString("SENTRY_DSN", "")
+	eventsSink := getenvString("EVENTS_SINK", "")
+	sourcemapPolicy := getenvString("SOURCEMAP_POLICY", "allow")
+	mirrorURL := getenvString("MIRROR_URL", "")
+	shedMaxInFlight := getenvUint("SHED_MAX_IN_FLIGHT", 0)
+	shedMaxLatency := getenvUint("SHED_MAX_LATENCY_MS", 0)
+
+	overlayDir := getenvString("OVERLAY_DIR", "")
+	configJSON, err := loadConfigJSON(overlayDir)
+	if err != nil {
+		fatal("Could not load config", "err", err)
+	}
+
+	themes, err := parseThemes(getenvString("THEMES_JSON", "{}"))
+	if err != nil {
+		fatal("Could not parse themes", "err", err)
+	}
+
+	maintenanceWindows, err := parseMaintenanceWindows(getenvString("MAINTENANCE_WINDOWS", "[]"))
+	if err != nil {
+		fatal("Could not parse maintenance windows", "err", err)
+	}
+
+	frameAncestors := getenvString("FRAME_ANCESTORS", "")
+	if csp != "false" && frameAncestors != "" {
+		csp = mergeCSP(csp, map[string]string{"frame-ancestors": frameAncestors})
+	}
+	frameOptions := xFrameOptions(frameAncestors)
+
+	preconnectOrigins := strings.Split(getenvString("PRECONNECT_ORIGINS", ""), ",")
+	if getenvString("PRECONNECT_FROM_CONFIG", "false") == "true" {
+		origins, err := configOrigins(configJSON)
+		if err != nil {
+			fatal("Could not collect origins from config for preconnect", "err", err)
+		}
+		preconnectOrigins = append(preconnectOrigins, origins...)
+	}
+	preconnect := preconnectLinks(preconnectOrigins)
+
+	htmlRenderMode := getenvString("HTML_RENDER_MODE", "cached")
+	htmlCacheControl := "public, max-age=60"
+	switch htmlRenderMode {
+	case "cached":
+		if csp != "false" {
+			slog.Info("The html responses carry a CSP nonce but may be cached. Use HTML_RENDER_MODE=per-response if a CDN caches index.html")
+		}
+	case "per-response":
+		// every response carries its own nonce, so it must never be reused
+		htmlCacheControl = "private, no-store"
+	default:
+		fatal("Unknown html render mode", "mode", htmlRenderMode)
+	}
+
+	if csp != "false" && getenvString("CSP_CONNECT_FROM_CONFIG", "false") == "true" {
+		origins, err := configOrigins(configJSON)
+		if err != nil {
+			fatal("Could not collect origins from config for CSP", "err", err)
+		}
+		csp = withConnectSources(csp, origins)
+		slog.Info("Allowing origins from config in connect-src", "origins", strings.Join(origins, " "))
+	}
+
+	cspRoutes, err := parseCSPRoutes(getenvString("CSP_ROUTES", "[]"), csp)
+	if err != nil {
+		fatal("Could not parse csp routes", "err", err)
+	}
+
+	experiments, err := parseExperiments(getenvString("EXPERIMENTS_JSON", "[]"))
+	if err != nil {
+		fatal("Could not parse experiments", "err", err)
+	}
+
+	configRules, err := parseConfigRules(getenvString("CONFIG_RULES", "[]"))
+	if err != nil {
+		fatal("Could not parse config rules", "err", err)
+	}
+
+	assetCacheControl := "public, max-age=604800, immutable"
+	devMode := getenvString("DEV_MODE", "false") == "true"
+	if devMode {
+		// the assets change in place while developing, without new fingerprints
+		assetCacheControl = "no-cache"
+	}
+
+	var configSigning *configSigner
+	if signingKey := getenvString("CONFIG_SIGNING_KEY", ""); signingKey != "" {
+		configSigning, err = newConfigSigner(signingKey, getenvString("CONFIG_SIGNING_KEY_ID", ""))
+		if err != nil {
+			fatal("Could not load config signing key", "err", err)
+		}
+	}
+
+	// refresh every 1 minute to ensure fresh-ness
+	configCacheControl := getenvString("CONFIG_CACHE_CONTROL", "public, max-age=60")
+	if (len(experiments) > 0 || len(configRules) > 0) && os.Getenv("CONFIG_CACHE_CONTROL") == "" {
+		// the config differs per visitor, so it must not be stored by shared caches
+		configCacheControl = "private, max-age=60"
+	}
+
+	previewMode := getenvString("PREVIEW_MODE", "false") == "true"
+	previewBanner := getenvString("PREVIEW_BANNER", "Preview deployment")
+	if previewMode {
+		// a preview changes with every push, no cache may keep an outdated or protected copy
+		htmlCacheControl = "no-store"
+		configCacheControl = "no-store"
+		assetCacheControl = "no-store"
+	}
+
+	if sentryDsn != "" {
+		err = initSentry(sentryDsn, getenvString("SENTRY_ENVIRONMENT", ""), getenvString("SENTRY_RELEASE", ""))
+		if err != nil {
+			fatal("Could not initialize sentry", "err", err)
+		}
+	}
+
+	staticDir := getenvString("STATIC_DIR", "")
+	source, err := newBundleSource(staticDir, overlayDir)
+	if err != nil {
+		reportFatal(err)
+		fatal("Could not open static or overlay directory", "static", staticDir, "overlay", overlayDir, "err", err)
+	}
+	contents := newContentStore()
+	files, err := loadFiles(source, configJSON, contents)
+
+	if err != nil {
+		reportFatal(err)
+		fatal("Could not load files of the bundle", "err", err)
+	}
+
+	mounts, err := parseBasePaths(getenvString("BASE_PATHS", "/"))
+	if err != nil {
+		fatal("Could not parse base paths", "err", err)
+	}
+	indexFallback := getenvString("INDEX_FALLBACK", "")
+	versionPath := getenvString("VERSION_PATH", "")
+	importMap := getenvString("IMPORT_MAP_JSON", "")
+	region := getenvString("REGION", "")
+	zone := getenvString("ZONE", "")
+
+	// prepareBundle derives the served state from the loaded files, at startup and on every reload
+	prepareBundle := func(files map[string]loadedFile) (*servedBundle, error) {
+		var err error
+		indexFile, indexFileFound := files[indexFileName]
+		if !indexFileFound {
+			if indexFallback == "" {
+				return nil, errors.New("could not find index.html")
+			}
+			indexFile, err = fallbackIndex(ctx, indexFallback)
+			if err != nil {
+				return nil, fmt.Errorf("could not find index.html nor load its fallback: %w", err)
+			}
+			files[indexFileName] = indexFile
+		}
+
+		// the version is taken before anything is injected, so it only changes with the bundle
+		version, err := bundleHash(files)
+		if err != nil {
+			return nil, fmt.Errorf("could not hash the bundle: %w", err)
+		}
+		if versionPath != "" {
+			indexFile.file = injectVersionMeta(indexFile.file, version)
+			files[indexFileName] = indexFile
+			configFile := files[configFileName]
+			configFile.file, err = withVersion(configFile.file, version)
+			if err != nil {
+				return nil, fmt.Errorf("could not add version to config: %w", err)
+			}
+			files[configFileName] = configFile
+		}
+
+		if importMap != "" {
+			indexFile.file, err = injectImportMap(indexFile.file, importMap)
+			if err != nil {
+				return nil, fmt.Errorf("could not inject import map into index.html: %w", err)
+			}
+			files[indexFileName] = indexFile
+		}
+
+		if devMode {
+			indexFile.file = injectLiveReload(indexFile.file)
+			files[indexFileName] = indexFile
+		}
+
+		if previewMode && previewBanner != "" {
+			indexFile.file = injectPreviewBanner(indexFile.file, previewBanner)
+			files[indexFileName] = indexFile
+		}
+
+		if region != "" || zone != "" {
+			configFile := files[configFileName]
+			configFile.file, err = withRegion(configFile.file, region, zone)
+			if err != nil {
+				return nil, fmt.Errorf("could not add region to config: %w", err)
+			}
+			files[configFileName] = configFile
+		}
+
+		indexFiles := mountIndexFiles(indexFile, getenvString("BASE_HREF", "/"), mounts)
+
+		// the html shell can be revalidated unless every response must be rendered anew
+		shellETags := make(map[string]string, len(indexFiles))
+		if htmlRenderMode != "per-response" {
+			headers := []string{csp, preconnect, frameOptions, htmlCacheControl}
+			for _, route := range cspRoutes {
+				headers = append(headers, route.Prefix, route.policy)
+			}
+			for mount, index := range indexFiles {
+				shellETags[mount] = shellETag(index.file, headers...)
+			}
+		}
+		return &servedBundle{files: files, indexFiles: indexFiles, shellETags: shellETags, version: version}, nil
+	}
+
+	prepared, err := prepareBundle(files)
+	if err != nil {
+		reportFatal(err)
+		fatal("Could not prepare the bundle", "err", err)
+	}
+	var served atomic.Pointer[servedBundle]
+	served.Store(prepared)
+	indexFile := files[indexFileName]
+	version := prepared.version
+
+	var critical map[string]bool
+	priorityHints := getenvString("PRIORITY_HINTS", "false") == "true"
+	if priorityHints {
+		critical = criticalAssets(indexFile.file)
+	}
+
+	var dictionaries *dictionaryCompression
+	if patterns := getenvString("COMPRESSION_DICTIONARIES", ""); patterns != "" {
+		dictionaries, err = newDictionaryCompression(patterns, getenvString("COMPRESSION_DICTIONARY_DIR", ""), files)
+		if err != nil {
+			fatal("Could not load the compression dictionaries", "err", err)
+		}
+	}
+
+	stats := newServingStats()
+	if statsLogInterval := getenvUint("STATS_LOG_INTERVAL_SECONDS", 0); statsLogInterval > 0 {
+		go stats.logPeriodically(time.Duration(statsLogInterval)*time.Second, int(getenvUint("STATS_TOP_FILES", 5)))
+	}
+
+	var heatmap *accessHeatmap
+	heatmapPath := getenvString("HEATMAP_PATH", "")
+	if heatmapPath != "" {
+		heatmapWindow := getenvUint("HEATMAP_WINDOW_MINUTES", 60)
+		if heatmapWindow == 0 {
+			fatal("Heatmap window must be at least one minute")
+		}
+		heatmap = newAccessHeatmap(files, time.Duration(heatmapWindow)*time.Minute)
+	}
+
+	previews, err := parsePreviews(getenvString("PREVIEWS_JSON", "[]"))
+	if err != nil {
+		fatal("Could not parse previews", "err", err)
+	}
+
+	downloadRoutes, err := parseDownloadRoutes(getenvString("DOWNLOAD_ROUTES", "[]"))
+	if err != nil {
+		fatal("Could not parse download routes", "err", err)
+	}
+
+	configVaryHeaders := configVary(configRules, experiments, previews)
+	htmlVaryHeaders := htmlVary(themes)
+
+	missingAssets := getenvString("MISSING_ASSETS", "fallback")
+	if missingAssets != "fallback" && missingAssets != "404" {
+		fatal("Unknown missing assets mode", "mode", missingAssets)
+	}
+	fallbackAccept := getenvString("SPA_FALLBACK_ACCEPT", "html")
+	if fallbackAccept != "html" && fallbackAccept != "any" {
+		fatal("Unknown fallback accept mode", "mode", fallbackAccept)
+	}
+	fallbackExclude, err := parseFallbackExclude(getenvString("SPA_FALLBACK_EXCLUDE", defaultFallbackExclude))
+	if err != nil {
+		fatal("Could not parse fallback exclude pattern", "err", err)
+	}
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the bundle is replaced by a new runtime config or in dev mode, the request sticks to one state of it
+		current := served.Load()
+		files, indexFiles, shellETags := current.files, current.indexFiles, current.shellETags
+		loadedFile, exists := files[req.URL.Path]
+		if !exists && excludedFromFallback(req.URL.Path, missingAssets, fallbackExclude) {
+			markMissingFile(req)
+			http.NotFound(w, req)
+			return
+		}
+		// the root of a mount is the SPA itself, any other route only falls back for clients asking for html
+		fallback := !exists && req.URL.Path != "/"
+		if fallback && fallbackAccept == "html" {
+			w.Header().Add("Vary", "Accept")
+			if !acceptsHTML(req) {
+				writeProblem(w, req, http.StatusNotFound, "there is no file at the path, and only requests accepting text/html fall back to the SPA")
+				return
+			}
+		}
+		if !exists || req.URL.Path == indexFileName {
+			loadedFile = indexFiles[mountOf(req)]
+		}
+		w.Header().Set("Content-Type", loadedFile.mime)
+		if priorityHints {
+			html := !exists || req.URL.Path == indexFileName
+			if priority := priorityHint(critical, req.URL.Path, html); priority != "" {
+				w.Header().Set("Priority", priority)
+			}
+		}
+		content := loadedFile.file
+		status := http.StatusOK
+		if !exists || req.URL.Path == indexFileName {
+			for _, name := range htmlVaryHeaders {
+				w.Header().Add("Vary", name)
+			}
+			theme, themed := themeForHost(themes, req.Host)
+			if etag, found := shellETags[mountOf(req)]; found {
+				if themed {
+					etag = themedETag(etag, theme)
+				}
+				etag = fmt.Sprintf("\"%s\"", etag)
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Last-Modified", loadedFile.modified.UTC().Format(http.TimeFormat))
+				w.Header().Set("Cache-Control", htmlCacheControl)
+				if notModified(req, etag) || notModifiedSince(req, loadedFile.modified) {
+					// the cached shell keeps the nonce and the content security policy it was sent with
+					stats.record(req, classNotModified, indexFileName, 0)
+					writeNotModified(w)
+					return
 				}
-				nonceStr := base64.StdEncoding.EncodeToString(nonce)
-
-				if csp == "" {
-					csp = "default-src 'self'; " +
-						"script-src 'strict-dynamic' 'nonce-%[1]s'; " +
-						"style-src 'self' 'nonce-%[1]s'; " +
-						"img-src 'self' data:; " +
-						"font-src 'self' data:; "
+			}
+			if themed {
+				content = applyTheme(content, theme)
+			}
+
+			nonce := make([]byte, 32)
+			_, err := rand.Read(nonce)
+			if err != nil {
+				slog.Error("Could not generate nonce for CSP header", "err", err)
+				nonce = []byte("RaND9mN0nC3")
+			}
+			nonceStr := base64.StdEncoding.EncodeToString(nonce)
+
+			if csp != "false" {
+				// insert nonce into html
+				content = bytes.Replace(
+					content,
+					[]byte("<script"),
+					[]byte(fmt.Sprint("<script nonce=\"", nonceStr, "\"")),
+					-1)
+				content = bytes.Replace(
+					content,
+					[]byte("<style"),
+					[]byte(fmt.Sprint("<style nonce=\"", nonceStr, "\"")),
+					-1)
+				content = bytes.Replace(
+					content,
+					[]byte("{{csp-nonce}}"),
+					[]byte(nonceStr),
+					-1)
+
+				w.Header().Set("Content-Security-Policy", fmt.Sprintf(cspForPath(csp, cspRoutes, req.URL.Path), nonceStr))
+			}
+			if preconnect != "" {
+				w.Header().Set("Link", preconnect)
+			}
+			if frameOptions != "" {
+				w.Header().Set("X-Frame-Options", frameOptions)
+			}
+			w.Header().Set("Cache-Control", htmlCacheControl)
+			if htmlRenderMode == "per-response" {
+				w.Header().Set("Vary", "*")
+			}
+
+		} else if req.URL.Path == configFileName {
+			preview, inPreview := activePreview(req, previews)
+			if inPreview {
+				content, err = withPreview(content, preview)
+				if err != nil {
+					slog.Error("Could not apply preview to config", "preview", preview.Name, "err", err)
+					content = loadedFile.file
 				}
-				if csp != "false" {
-					// read content from loaded file and insert nonce into html
+			}
+			if len(configRules) > 0 {
+				content, err = applyConfigRules(content, configRules, req, trustedProxyHops)
+				if err != nil {
+					slog.Error("Could not apply config rules", "err", err)
 					content = loadedFile.file
-					content = bytes.Replace(
-						content,
-						[]byte("<script"),
-						[]byte(fmt.Sprint("<script nonce=\"", nonceStr, "\"")),
-						-1)
-					content = bytes.Replace(
-						content,
-						[]byte("<style"),
-						[]byte(fmt.Sprint("<style nonce=\"", nonceStr, "\"")),
-						-1)
-					content = bytes.Replace(
-						content,
-						[]byte("{{csp-nonce}}"),
-						[]byte(nonceStr),
-						-1)
-
-					w.Header().Add("Content-Security-Policy", fmt.Sprintf(csp, nonceStr))
 				}
-				w.Header().Add("Cache-Control", "public, max-age: 60")
+			}
+			if len(experiments) > 0 {
+				assignments, err := assignExperiments(w, req, experiments)
+				var withAssignments []byte
+				if err == nil {
+					withAssignments, err = withExperiments(content, assignments)
+				}
+				if err != nil {
+					slog.Error("Could not add experiment assignments to config", "err", err)
+				} else {
+					content = withAssignments
+				}
+			}
+			w.Header().Set("Cache-Control", configCacheControl)
+			for _, name := range configVaryHeaders {
+				w.Header().Add("Vary", name)
+			}
+			if inPreview {
+				// the config of a preview must never reach other users through a shared cache
+				w.Header().Set("Cache-Control", "private, no-store")
+			}
+			if configSigning != nil {
+				signature, err := configSigning.detached(content)
+				if err != nil {
+					slog.Error("Could not sign config", "err", err)
+				} else {
+					w.Header().Set("X-Config-Signature", signature)
+					w.Header().Set("X-Config-Version", configVersion(content))
+				}
+			}
+			// the config may differ per request, so its etag is derived from the content sent
+			etag := contentETag(content)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", loadedFile.modified.UTC().Format(http.TimeFormat))
+			if notModified(req, etag) || notModifiedSince(req, loadedFile.modified) {
+				stats.record(req, classNotModified, configFileName, 0)
+				writeNotModified(w)
+				return
+			}
+		} else {
+			w.Header().Set("Cache-Control", assetCacheControl)
+			if disposition := contentDisposition(downloadRoutes, req.URL.Path); disposition != "" {
+				w.Header().Set("Content-Disposition", disposition)
+			}
+			etag := loadedFile.etag
+			dictionaryPattern := ""
+			if dictionaries != nil {
+				dictionaryPattern = dictionaries.match(req.URL.Path)
+			}
+			if dictionaryPattern != "" {
+				// the browser keeps the file to decompress the next versions of it
+				w.Header().Set("Use-As-Dictionary", fmt.Sprintf("match=%q", strings.TrimSuffix(mountOf(req), "/")+dictionaryPattern))
+				w.Header().Add("Vary", "Accept-Encoding, Available-Dictionary")
+			}
+			var dczContent []byte
+			dictionaryID, dcz := "", false
+			if dictionaryPattern != "" {
+				dczContent, dictionaryID, dcz = dictionaries.negotiate(req, loadedFile)
+			}
+			if dcz {
+				w.Header().Set("Content-Encoding", "dcz")
+				content = dczContent
+				// each dictionary leads to other content
+				etag = encodedETag(etag, "dcz-"+dictionaryID[:16])
+			} else if len(loadedFile.encoded) > 0 {
+				if dictionaryPattern == "" {
+					w.Header().Add("Vary", "Accept-Encoding")
+				}
+				if encoding := negotiateEncoding(req, loadedFile.encoded); encoding != "" {
+					// the client decompresses the file, with lazy decompression the server never has to
+					w.Header().Set("Content-Encoding", encoding)
+					content = loadedFile.encoded[encoding]
+					etag = encodedETag(etag, encoding)
+				} else {
+					var err error
+					content, err = loadedFile.content()
+					if err != nil {
+						slog.Error("Could not serve file", "path", req.URL.Path, "err", err)
+						writeProblem(w, req, http.StatusInternalServerError, "the file could not be decompressed")
+						return
+					}
+				}
+			}
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", loadedFile.modified.UTC().Format(http.TimeFormat))
+			if notModified(req, etag) || notModifiedSince(req, loadedFile.modified) {
+				stats.record(req, classNotModified, req.URL.Path, 0)
+				writeNotModified(w)
+				return
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			// ranges are only defined for GET, a HEAD request describes the full response
+			if rangeHeader := req.Header.Get("Range"); rangeHeader != "" && req.Method == http.MethodGet && rangeApplies(req, etag, loadedFile.modified) {
+				byteRange, satisfiable := parseRange(rangeHeader, len(content))
+				if !satisfiable {
+					writeRangeNotSatisfiable(w, len(content))
+					return
+				}
+				if byteRange != nil {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", byteRange.start, byteRange.end, len(content)))
+					content = content[byteRange.start : byteRange.end+1]
+					status = http.StatusPartialContent
+				}
+			}
+		}
 
-			} else if req.URL.Path == configFileName {
-				w.Header().Add("Cache-Control", "public, max-age: 60") // refresh every 1 minute to ensure fresh-ness
-			} else {
-				w.Header().Add("Cache-Control", "public, max-age: 604800, immutable")
+		sent := len(content)
+		if req.Method == http.MethodHead {
+			sent = 0
+		}
+		switch {
+		case !exists:
+			stats.record(req, classFallback, indexFileName, sent)
+		case req.URL.Path == indexFileName:
+			stats.record(req, classIndex, indexFileName, sent)
+		case req.URL.Path == configFileName:
+			stats.record(req, classConfig, configFileName, sent)
+		default:
+			stats.record(req, classAsset, req.URL.Path, sent)
+			if heatmap != nil {
+				heatmap.record(req.URL.Path)
 			}
+		}
+
+		// the length of a HEAD response is the one of the body a GET would receive
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+		if req.Method == http.MethodHead {
+			return
+		}
+		err := writeContent(w, req, content)
+		if err != nil && req.Context().Err() != nil {
+			// the client went away, e.g. by closing the tab, this is not an error of the server
+			slog.Info("Client disconnected before the file was sent", "file", req.URL.Path)
+		} else if err != nil {
+			slog.Error("Could not send loadedFile to client", "file", req.URL.Path, "err", err)
+		}
+	})
+
+	if getenvString("SELF_TEST", "true") == "true" {
+		failures := selfTest(handler, csp, cspRoutes)
+		for _, failure := range failures {
+			slog.Error("Self-test failed", "err", failure)
+		}
+		if len(failures) > 0 {
+			reportFatal(fmt.Errorf("%d self-tests failed", len(failures)))
+			fatal("Could not start server, self-tests failed", "failures", len(failures))
+		}
+	}
 
-			w.Header().Add("Content-Length", fmt.Sprint(len(content)))
-			_, err = w.Write(content)
+	var features []string
+	if dictionaries != nil {
+		features = append(features, "dictionary-compression")
+	}
+	if len(themes) > 0 {
+		features = append(features, "themes")
+	}
+	if len(experiments) > 0 {
+		features = append(features, "experiments")
+	}
+	if len(configRules) > 0 {
+		features = append(features, "config-rules")
+	}
+	if configSigning != nil {
+		features = append(features, "config-signing")
+	}
+	if len(cspRoutes) > 0 {
+		features = append(features, "csp-routes")
+	}
+	if priorityHints {
+		features = append(features, "priority-hints")
+	}
+	if len(downloadRoutes) > 0 {
+		features = append(features, "downloads")
+	}
+
+	remotes, err := parseRemotes(getenvString("REMOTES_JSON", "[]"))
+	if err != nil {
+		fatal("Could not parse remotes", "err", err)
+	}
+	var remoteCache *remoteProxy
+	if len(remotes) > 0 {
+		remoteCache = newRemoteProxy(remotes)
+		handler = remoteCache.handler(handler)
+		features = append(features, "remotes")
+	}
+	oidcIssuer := getenvString("OIDC_ISSUER_URL", "")
+	if oidcIssuer != "" && remoteCache == nil {
+		// caches the documents of the identity provider, it serves no remotes
+		remoteCache = newRemoteProxy(nil)
+	}
+
+	rewriteRules, err := parseRewriteRules(getenvFile("REWRITES", "[]"))
+	if err != nil {
+		fatal("Could not parse rewrites", "err", err)
+	}
+	upgradeIdleTimeout := time.Duration(getenvUint("PROXY_UPGRADE_IDLE_TIMEOUT_SECONDS", 0)) * time.Second
+	proxyRules, err := parseProxyRules(getenvString("PROXY_RULES", ""), upgradeIdleTimeout)
+	if err != nil {
+		fatal("Could not parse proxy rules", "err", err)
+	}
+	redirectRules, err := parseRedirectRules(getenvFile("REDIRECTS", "[]"))
+	if err != nil {
+		fatal("Could not parse redirects", "err", err)
+	}
+	routeTable := newRouteTable(&routes{redirects: redirectRules, rewrites: rewriteRules, proxies: proxyRules}, upgradeIdleTimeout)
+	if len(rewriteRules) > 0 {
+		features = append(features, "rewrites")
+	}
+	if len(proxyRules) > 0 {
+		features = append(features, "proxy")
+	}
+	if len(redirectRules) > 0 {
+		features = append(features, "redirects")
+	}
+
+	sourcemaps, err := newSourcemapPolicy(
+		sourcemapPolicy,
+		getenvString("SOURCEMAP_ALLOWED_IPS", ""),
+		getenvString("SOURCEMAP_TOKEN", ""),
+		getenvString("SOURCEMAP_TOKEN_HEADER", "X-Sourcemap-Token"),
+		trustedProxyHops)
+	if err != nil {
+		fatal("Could not set up source map policy", "err", err)
+	}
+	// the source map policy applies to the rewritten path, a rewrite may lead to a source map, archives
+	// apply it on their own
+	if sourcemaps.policy != "allow" {
+		handler = sourcemaps.handler(handler)
+		features = append(features, "sourcemap-policy")
+	}
+	// rewrites apply to the path within the mount, right before the files are looked up
+	handler = routeTable.inner(handler)
+
+	if len(mounts) > 1 || mounts[0] != "/" {
+		handler = newMountHandler(mounts, handler)
+		features = append(features, "mounts")
+	}
+
+	// proxied paths are outside of the mounts, like with a reverse proxy in front of the server. Redirects
+	// come before proxying and mounts, so a moved app may have been proxied or mounted before.
+	handler = routeTable.outer(handler)
+
+	// the missing paths are created before dev mode, which forgets them on reloads
+	var missing *missingCache
+	if missingCacheSeconds := getenvUint("MISSING_CACHE_SECONDS", 0); missingCacheSeconds > 0 {
+		missing = newMissingCache(time.Duration(missingCacheSeconds)*time.Second, routeTable.proxyPrefixes,
+			int(getenvUint("STATS_TOP_FILES", 5)))
+		// imported routes may lead a missing path to a file or a backend
+		routeTable.changed = missing.reset
+	}
+
+	// the bundle is loaded again with the runtime config when it is replaced, and on changes in dev mode
+	fixedOrigins := csp != "false" && getenvString("CSP_CONNECT_FROM_CONFIG", "false") == "true" ||
+		getenvString("PRECONNECT_FROM_CONFIG", "false") == "true"
+	runtimeConfig := newRuntimeConfig(configJSON, fixedOrigins, func(configJSON []byte) error {
+		files, err := loadFiles(source, configJSON, contents)
+		if err != nil {
+			return err
+		}
+		prepared, err := prepareBundle(files)
+		if err != nil {
+			return err
+		}
+		served.Store(prepared)
+		if missing != nil {
+			missing.reset()
+		}
+		return nil
+	})
+
+	if devMode {
+		if staticDir == "" && overlayDir == "" {
+			fatal("Could not start dev mode, it watches STATIC_DIR or OVERLAY_DIR and neither is set")
+		}
+		reloads := newLiveReload()
+		go func() {
+			err := source.watch(ctx, func() {
+				if err := runtimeConfig.reload(); err != nil {
+					slog.Warn("Could not reload the bundle, serving the previous one", "err", err)
+					return
+				}
+				slog.Info("Reloaded the bundle", "files", len(served.Load().files))
+				reloads.notify()
+			})
 			if err != nil {
-				log.Printf("Could not send loadedFile to client. file: %s", req.URL.Path)
+				slog.Error("Could not watch the bundle for changes", "err", err)
 			}
-		}),
-		ReadTimeout:  time.Duration(readTimeout) * time.Second,
-		WriteTimeout: time.Duration(writeTimeout) * time.Second,
-		IdleTimeout:  time.Duration(idleTimeout) * time.Second,
+		}()
+		handler = reloads.handler(handler)
+		features = append(features, "dev-mode")
+	}
+
+	if versionPath != "" {
+		handler = newVersionHandler(versionPath, version, handler)
+		features = append(features, "version")
+	}
+
+	if heatmap != nil {
+		handler = heatmap.handler(heatmapPath, handler)
+		features = append(features, "heatmap")
+	}
+
+	if len(previews) > 0 {
+		handler = newPreviewHandler(getenvString("PREVIEW_PATH", "/__preview"), previews, trustedProxyHops, handler)
+		features = append(features, "previews")
+	}
+
+	if integrityPath := getenvString("INTEGRITY_PATH", ""); integrityPath != "" {
+		handler, err = newIntegrityHandler(integrityPath, files, handler)
+		if err != nil {
+			fatal("Could not create integrity manifest", "err", err)
+		}
+		features = append(features, "integrity-manifest")
+	}
+
+	archiveRoutes, err := parseArchiveRoutes(getenvString("ARCHIVE_ROUTES", "[]"))
+	if err != nil {
+		fatal("Could not parse archive routes", "err", err)
+	}
+	if len(archiveRoutes) > 0 {
+		handler = newArchiveHandler(archiveRoutes, func() map[string]loadedFile { return served.Load().files }, sourcemaps, handler)
+		features = append(features, "archives")
+	}
+
+	if mirrorURL != "" {
+		handler, err = newMirrorHandler(ctx, mirrorURL, getenvUint("MIRROR_PERCENT", 100), getenvString("MIRROR_MODE", "headers"), handler)
+		if err != nil {
+			fatal("Could not set up request mirroring", "err", err)
+		}
+		features = append(features, "mirroring")
+	}
+
+	if eventsSink != "" {
+		sink, err := newEventSink(eventsSink, getenvString("EVENTS_SINK_URL", ""))
+		if err != nil {
+			fatal("Could not set up analytics event sink", "err", err)
+		}
+		handler = newEventsHandler(ctx, getenvString("EVENTS_PATH", "/__events"), sink, int64(getenvUint("EVENTS_MAX_BYTES", 65536)), handler)
+		features = append(features, "events")
+	}
+
+	if geoipDbPath != "" {
+		handler, err = newGeoipHandler(geoipDbPath, geoipRules, trustedProxyHops, handler)
+		if err != nil {
+			fatal("Could not set up geoip access control", "err", err)
+		}
+		features = append(features, "geoip")
+	}
+
+	if sentryDsn != "" {
+		handler = newSentryHandler(handler)
+		features = append(features, "sentry")
+	}
+
+	// maintenance wraps sentry, the planned 503 responses are not reported as server errors
+	if len(maintenanceWindows) > 0 {
+		handler = newMaintenanceHandler(maintenanceWindows, func() map[string]loadedFile { return served.Load().files }, handler)
+		features = append(features, "maintenance-windows")
+	}
+
+	if region != "" || zone != "" {
+		handler = newRegionHandler(region, zone, handler)
+		features = append(features, "region")
+	}
+
+	slowRequestThreshold := getenvUint("SLOW_REQUEST_MS", 0)
+	largeResponseThreshold := getenvUint("LARGE_RESPONSE_BYTES", 0)
+	if slowRequestThreshold > 0 || largeResponseThreshold > 0 {
+		handler = newWarningHandler(time.Duration(slowRequestThreshold)*time.Millisecond, int(largeResponseThreshold), handler)
+		features = append(features, "warnings")
+	}
+
+	// shedding comes last, so rejecting requests stays cheap and is not reported as server error
+	if shedMaxInFlight > 0 || shedMaxLatency > 0 {
+		shedder := newLoadShedder(shedMaxInFlight, time.Duration(shedMaxLatency)*time.Millisecond, getenvUint("SHED_RETRY_AFTER_SECONDS", 5))
+		handler = shedder.handler(handler)
+		features = append(features, "load-shedding")
+	}
+
+	// rate limits wrap the shedder, so throttled requests don't count as in flight
+	rateLimitRoutes, err := parseRateLimitRoutes(getenvString("RATE_LIMITS", "[]"))
+	if err != nil {
+		fatal("Could not parse rate limits", "err", err)
+	}
+	if len(rateLimitRoutes) > 0 {
+		limiter := newRateLimiter(rateLimitRoutes, trustedProxyHops)
+		if redisURL := getenvFile("RATE_LIMIT_REDIS_URL", ""); redisURL != "" {
+			err = limiter.useRedis(redisURL, getenvString("RATE_LIMIT_REDIS_PREFIX", "spa-server:ratelimit:"))
+			if err != nil {
+				fatal("Could not set up the Redis of the rate limits", "err", err)
+			}
+			features = append(features, "redis-rate-limits")
+		}
+		handler = limiter.handler(handler)
+		features = append(features, "rate-limits")
 	}
 
-	log.Printf("Starting server on Addr: %s:%s", addr, port)
-	err = srv.ListenAndServe()
+	chaosRules, err := parseChaosRules(getenvString("CHAOS_RULES", "[]"))
 	if err != nil {
-		log.Fatalf("Could not start server. err: %v", err)
+		fatal("Could not parse chaos rules", "err", err)
+	}
+	if len(chaosRules) > 0 {
+		slog.Warn("Chaos rules degrade the responses, do not use them in production", "rules", len(chaosRules))
+		handler = newChaosHandler(chaosRules, handler)
+		features = append(features, "chaos")
+	}
+
+	writeTimeoutRoutes, err := parseWriteTimeoutRoutes(getenvString("WRITE_TIMEOUT_ROUTES", "[]"))
+	if err != nil {
+		fatal("Could not parse write timeout routes", "err", err)
+	}
+	if debugPolicyPath := getenvString("DEBUG_POLICY_PATH", ""); debugPolicyPath != "" {
+		handler = newPolicyDebugHandler(debugPolicyPath, &policySetup{
+			files:              files,
+			mounts:             mounts,
+			remotes:            remotes,
+			routes:             routeTable,
+			missingAssets:      missingAssets,
+			fallbackExclude:    fallbackExclude,
+			fallbackAccept:     fallbackAccept,
+			csp:                csp,
+			cspRoutes:          cspRoutes,
+			preconnect:         preconnect,
+			frameOptions:       frameOptions,
+			htmlRenderMode:     htmlRenderMode,
+			htmlCacheControl:   htmlCacheControl,
+			configCacheControl: configCacheControl,
+			assetCacheControl:  assetCacheControl,
+			downloadRoutes:     downloadRoutes,
+			writeTimeoutRoutes: writeTimeoutRoutes,
+			htmlVary:           htmlVaryHeaders,
+			configVary:         configVaryHeaders,
+		}, handler)
+		features = append(features, "debug-policy")
+	}
+
+	if len(writeTimeoutRoutes) > 0 {
+		handler = newWriteTimeoutHandler(writeTimeoutRoutes, handler)
+		features = append(features, "write-timeout-routes")
+	}
+
+	if missing != nil {
+		if statsLogInterval := getenvUint("STATS_LOG_INTERVAL_SECONDS", 0); statsLogInterval > 0 {
+			go missing.logPeriodically(time.Duration(statsLogInterval) * time.Second)
+		}
+		handler = missing.handler(handler)
+		features = append(features, "missing-cache")
+	}
+
+	metricsPath := getenvString("METRICS_PATH", "")
+	metricsPort := getenvString("METRICS_PORT", "")
+	var metrics *serverMetrics
+	if metricsPath != "" || metricsPort != "" {
+		metrics = newServerMetrics()
+		if remoteCache != nil {
+			metrics.registry.MustRegister(remoteCache.staleResponses, remoteCache.refreshFailures)
+		}
+		if missing != nil {
+			metrics.registry.MustRegister(missing)
+		}
+		metrics.setConfigVersion(configVersion(configJSON))
+		runtimeConfig.changed = metrics.setConfigVersion
+	}
+	// metrics on the main listener are protected like the SPA, METRICS_PORT is meant for scrapers
+	if metricsPath != "" && metricsPort == "" {
+		handler = newMetricsEndpointHandler(metricsPath, metrics, handler)
 	}
 
-	log.Println("Stopping Server")
+	if previewMode {
+		previewPassword := getenvString("PREVIEW_PASSWORD", "")
+		if previewPassword == "" {
+			slog.Warn("Preview mode without PREVIEW_PASSWORD, the preview deployment is public")
+		}
+		var gate *basicAuthGate
+		if previewPassword != "" {
+			gate, err = newPasswordGate(getenvString("PREVIEW_USERNAME", "preview"), previewPassword, "Preview")
+			if err != nil {
+				fatal("Could not set up the preview password", "err", err)
+			}
+		}
+		var shares *previewShares
+		if shareSecret := getenvString("PREVIEW_SHARE_SECRET", ""); shareSecret != "" {
+			if previewPassword == "" {
+				fatal("Could not set up share links, they bypass PREVIEW_PASSWORD and it is not set")
+			}
+			shares, err = newPreviewShares(shareSecret, getenvString("PREVIEW_SHARE_PATH", "/__share"), time.Duration(getenvUint("PREVIEW_SHARE_MAX_HOURS", 168))*time.Hour, trustedProxyHops)
+			if err != nil {
+				fatal("Could not set up share links", "err", err)
+			}
+			features = append(features, "share-links")
+		}
+		handler = newPreviewModeHandler(gate, shares, handler)
+		features = append(features, "preview-mode")
+	}
+
+	if htpasswd := getenvFile("BASIC_AUTH_USERS", ""); htpasswd != "" {
+		users, err := parseHtpasswd(htpasswd)
+		if err != nil {
+			fatal("Could not parse basic auth users", "err", err)
+		}
+		handler = newBasicAuthGate(users, getenvString("BASIC_AUTH_REALM", "Restricted"), getenvString("BASIC_AUTH_EXCLUDE", "")).handler(handler)
+		features = append(features, "basic-auth")
+	}
+
+	if oidcIssuer != "" {
+		gate, err := newOIDCGate(
+			oidcIssuer,
+			getenvString("OIDC_CLIENT_ID", ""),
+			getenvFile("OIDC_CLIENT_SECRET", ""),
+			getenvFile("OIDC_COOKIE_SECRET", ""),
+			getenvString("OIDC_SCOPES", "openid, profile, email"),
+			getenvString("OIDC_CALLBACK_PATH", "/__oidc/callback"),
+			getenvString("OIDC_LOGOUT_PATH", "/__oidc/logout"),
+			time.Duration(getenvUint("OIDC_SESSION_HOURS", 8))*time.Hour,
+			getenvString("OIDC_EXCLUDE", ""),
+			trustedProxyHops)
+		if err != nil {
+			fatal("Could not set up OpenID Connect login", "err", err)
+		}
+		gate.cacheDocuments(remoteCache, getenvUint("OIDC_CACHE_SECONDS", 300), getenvUint("OIDC_STALE_SECONDS", 86400))
+		if getenvString("OIDC_CSRF_PROTECTION", "false") == "true" {
+			gate.protectCSRF(routeTable.proxyPrefixes)
+			features = append(features, "csrf-protection")
+		}
+		handler = gate.handler(handler)
+		features = append(features, "oidc")
+	}
+
+	// preflight requests carry no credentials, so they are answered before any authentication
+	if corsOrigins := getenvString("CORS_ALLOWED_ORIGINS", ""); corsOrigins != "" {
+		cors, err := newCORSPolicy(
+			corsOrigins,
+			getenvString("CORS_ALLOWED_METHODS", "GET, HEAD"),
+			getenvString("CORS_ALLOWED_HEADERS", ""),
+			getenvString("CORS_ALLOW_CREDENTIALS", "false") == "true",
+			getenvUint("CORS_MAX_AGE_SECONDS", 600))
+		if err != nil {
+			fatal("Could not parse cors origins", "err", err)
+		}
+		handler = cors.handler(handler)
+		features = append(features, "cors")
+	}
+
+	if metrics != nil {
+		handler = metrics.handler(handler)
+		features = append(features, "metrics")
+	}
+
+	if getenvString("ACCESS_LOG", "true") == "true" {
+		handler = newAccessLogHandler(trustedProxyHops, handler)
+	}
+
+	healthPath := getenvString("HEALTH_PATH", "/healthz")
+	readyPath := getenvString("READY_PATH", "/readyz")
+	var details *healthDetails
+	if getenvString("HEALTH_DETAILS", "false") == "true" {
+		details = &healthDetails{
+			started:      started,
+			version:      version,
+			files:        len(files),
+			configLoaded: files[configFileName].modified,
+		}
+	}
+	handler = newHealthHandler(healthPath, readyPath, details, handler)
+	handler = newHeaderPolicyHandler(handler)
+
+	return &spaServer{
+		handler:     handler,
+		features:    features,
+		files:       files,
+		version:     version,
+		metrics:     metrics,
+		metricsPort: metricsPort,
+		healthPath:  healthPath,
+		readyPath:   readyPath,
+		details:     details,
+		config:      runtimeConfig,
+		routes:      routeTable,
+		routing: routingReadOnly{
+			Mounts: mounts,
+			CachePolicy: map[string]string{
+				"html":   htmlCacheControl,
+				"config": configCacheControl,
+				"assets": assetCacheControl,
+			},
+			CSPRoutes:          cspRoutes,
+			DownloadRoutes:     downloadRoutes,
+			WriteTimeoutRoutes: writeTimeoutRoutes,
+			RateLimits:         rateLimitRoutes,
+		},
+	}
 }
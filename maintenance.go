@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const maintenanceFileName = "/maintenance.html"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceWindow is either a single window between the timestamps start and end, or a window recurring
+// on the given days (every day if empty) between the times of day from and to in UTC.
+type maintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Days  []string  `json:"days"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+
+	days     map[time.Weekday]bool
+	fromTime time.Duration
+	toTime   time.Duration
+}
+
+func parseMaintenanceWindows(windowsJSON string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	err := json.Unmarshal([]byte(windowsJSON), &windows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range windows {
+		window := &windows[i]
+		if !window.Start.IsZero() || !window.End.IsZero() {
+			if window.Start.IsZero() || window.End.IsZero() {
+				return nil, fmt.Errorf("maintenance window %d needs both a start and an end", i)
+			}
+			if len(window.Days) > 0 || window.From != "" || window.To != "" {
+				return nil, fmt.Errorf("maintenance window %d has a start and an end, it can not recur on days or times of day", i)
+			}
+			if !window.End.After(window.Start) {
+				return nil, fmt.Errorf("maintenance window %d ends before it starts", i)
+			}
+			continue
+		}
+		window.fromTime, err = parseTimeOfDay(window.From)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %d: %w", i, err)
+		}
+		window.toTime, err = parseTimeOfDay(window.To)
+		if err != nil {
+			return nil, fmt.Errorf("maintenance window %d: %w", i, err)
+		}
+		window.days = make(map[time.Weekday]bool)
+		for _, day := range window.Days {
+			key := strings.ToLower(day)
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, found := weekdays[key]
+			if !found {
+				return nil, fmt.Errorf("maintenance window %d has an unknown day %q", i, day)
+			}
+			window.days[weekday] = true
+		}
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w maintenanceWindow) recursOn(day time.Weekday) bool {
+	return len(w.days) == 0 || w.days[day]
+}
+
+// activeUntil returns the end of the window if now is within the window.
+func (w maintenanceWindow) activeUntil(now time.Time) (time.Time, bool) {
+	if !w.Start.IsZero() {
+		return w.End, !now.Before(w.Start) && now.Before(w.End)
+	}
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	sinceMidnight := now.Sub(midnight)
+	if w.fromTime <= w.toTime {
+		return midnight.Add(w.toTime), w.recursOn(now.Weekday()) && sinceMidnight >= w.fromTime && sinceMidnight < w.toTime
+	}
+	// the window spans midnight
+	if sinceMidnight >= w.fromTime && w.recursOn(now.Weekday()) {
+		return midnight.Add(24*time.Hour + w.toTime), true
+	}
+	yesterday := midnight.Add(-24 * time.Hour).Weekday()
+	return midnight.Add(w.toTime), sinceMidnight < w.toTime && w.recursOn(yesterday)
+}
+
+// newMaintenanceHandler answers all requests with a 503 during the maintenance windows. The response is
+// the maintenance.html of the bundle served at the time if it exists, with a Retry-After pointing to the end
+// of the window.
+func newMaintenanceHandler(windows []maintenanceWindow, files func() map[string]loadedFile, next http.Handler) http.Handler {
+	var inMaintenance atomic.Bool
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		var end time.Time
+		active := false
+		for _, window := range windows {
+			if windowEnd, windowActive := window.activeUntil(now); windowActive && windowEnd.After(end) {
+				end = windowEnd
+				active = true
+			}
+		}
+		if inMaintenance.Swap(active) != active {
+			if active {
+				slog.Info("Entering maintenance window", "end", end.Format(time.RFC3339))
+			} else {
+				slog.Info("Leaving maintenance window")
+			}
+		}
+		if !active {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(end.Sub(now).Seconds()))))
+		w.Header().Set("Cache-Control", "no-store")
+		page, pageFound := files()[maintenanceFileName]
+		if !pageFound {
+			http.Error(w, "The server is down for maintenance.", http.StatusServiceUnavailable)
+			return
+		}
+		content, err := page.content()
+		if err != nil {
+			slog.Error("Could not serve the maintenance page", "err", err)
+			http.Error(w, "The server is down for maintenance.", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", page.mime)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(content)
+	})
+}
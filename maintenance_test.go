@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaintenancePageFollowsReloadedBundle(t *testing.T) {
+	windows := []maintenanceWindow{{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}}
+	var files atomic.Pointer[map[string]loadedFile]
+	files.Store(&map[string]loadedFile{})
+	handler := newMaintenanceHandler(windows, func() map[string]loadedFile { return *files.Load() }, http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "down for maintenance") {
+		t.Fatalf("without a page: %d %q", rec.Code, rec.Body.String())
+	}
+
+	// a reload in dev mode brings the page
+	files.Store(&map[string]loadedFile{maintenanceFileName: {file: []byte("<h1>Back soon</h1>"), mime: "text/html; charset=utf-8"}})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "<h1>Back soon</h1>" {
+		t.Errorf("after the reload: %d %q", rec.Code, rec.Body.String())
+	}
+}
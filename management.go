@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// managementListeners run the metrics and admin endpoints apart from the public server, with timeouts of
+// their own. They outlive the public server by the linger time on shutdown, so the final scrapes and
+// probes still get an answer while the public server drains.
+type managementListeners struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	linger       time.Duration
+
+	servers  []*http.Server
+	draining atomic.Bool
+	// closing ends the requests of all listeners on shutdown, e.g. log streams which would never complete
+	closing context.Context
+	close   context.CancelFunc
+}
+
+// add creates a listener at the address, named for the logs, e.g. "metrics".
+func (m *managementListeners) add(name string, address string, handler http.Handler) {
+	if m.closing == nil {
+		m.closing, m.close = context.WithCancel(context.Background())
+	}
+	srv := &http.Server{
+		Addr:         address,
+		ReadTimeout:  m.readTimeout,
+		WriteTimeout: m.writeTimeout,
+		IdleTimeout:  m.idleTimeout,
+		Handler:      handler,
+		BaseContext: func(net.Listener) context.Context {
+			return m.closing
+		},
+	}
+	m.servers = append(m.servers, srv)
+	go func() {
+		slog.Info("Serving "+name, "addr", srv.Addr)
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			fatal("Could not serve "+name, "err", err)
+		}
+	}()
+}
+
+// readiness answers the readiness probe with a 503 once the shutdown started, so the pod is taken out of
+// the load balancer while its public server drains.
+func (m *managementListeners) readiness(readyPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == readyPath && m.draining.Load() {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"status":"draining"}`))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// drain marks the start of the shutdown.
+func (m *managementListeners) drain() {
+	m.draining.Store(true)
+}
+
+// shutdown waits for the linger time and then closes the listeners, waiting up to the write timeout for
+// their in-flight requests. Streaming requests are ended right away.
+func (m *managementListeners) shutdown() {
+	if len(m.servers) == 0 {
+		return
+	}
+	time.Sleep(m.linger)
+	m.close()
+	ctx, cancel := context.WithTimeout(context.Background(), max(m.writeTimeout, time.Second))
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range m.servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				slog.Error("Could not shut down management listener gracefully", "addr", srv.Addr, "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
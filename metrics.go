@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// classOther labels the responses not served by the file handler, e.g. remotes or analytics events.
+const classOther = "other"
+
+type requestClassKey struct{}
+
+// setRequestClass tags the request with the response class of the file handler for the metrics.
+func setRequestClass(req *http.Request, class string) {
+	if holder, found := req.Context().Value(requestClassKey{}).(*string); found {
+		*holder = class
+	}
+}
+
+// serverMetrics are the prometheus metrics of the server, the responses are labeled with the class of
+// the file handler.
+type serverMetrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+	// configInfo is 1 for the version of the runtime config in effect
+	configInfo *prometheus.GaugeVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spa_http_requests_total",
+			Help: "Number of http responses by class and status code.",
+		}, []string{"class", "code"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spa_http_response_bytes_total",
+			Help: "Number of bytes of the http response bodies by class, as sent, e.g. compressed.",
+		}, []string{"class"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "spa_http_request_duration_seconds",
+			Help:    "Latency of http responses by class.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"class"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "spa_http_requests_in_flight",
+			Help: "Number of http requests being served.",
+		}),
+		configInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "spa_config_info",
+			Help: "The version of the runtime config in effect, as label.",
+		}, []string{"version"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.bytes,
+		m.duration,
+		m.inFlight,
+		m.configInfo,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// setConfigVersion labels the config info with the version of the runtime config in effect.
+func (m *serverMetrics) setConfigVersion(version string) {
+	m.configInfo.Reset()
+	m.configInfo.WithLabelValues(version).Set(1)
+}
+
+// handler observes every request passed to the next handler.
+func (m *serverMetrics) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		class := classOther
+		req = req.WithContext(context.WithValue(req.Context(), requestClassKey{}, &class))
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, req)
+
+		m.requests.WithLabelValues(class, strconv.Itoa(recorder.status)).Inc()
+		m.bytes.WithLabelValues(class).Add(float64(recorder.bytes))
+		m.duration.WithLabelValues(class).Observe(time.Since(start).Seconds())
+	})
+}
+
+// endpoint serves the metrics in the prometheus exposition format.
+func (m *serverMetrics) endpoint() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// newMetricsEndpointHandler serves the metrics at the path of the main listener, all other requests are
+// passed to the next handler.
+func newMetricsEndpointHandler(path string, m *serverMetrics, next http.Handler) http.Handler {
+	endpoint := m.endpoint()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			next.ServeHTTP(w, req)
+			return
+		}
+		endpoint.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const mirrorMaxBodyBytes = 1 << 20
+const mirrorMaxInFlight = 64
+const mirrorTimeout = 10 * time.Second
+
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// newMirrorHandler sends a copy of the given percentage of requests to the shadow target in the background.
+// The responses of the shadow target are discarded, users are always served by the next handler. In the
+// mode "headers" only the method, url and headers are mirrored, in the mode "full" also the request body.
+// The shadow requests outlive the requests they copy, they are bound to the context instead.
+func newMirrorHandler(ctx context.Context, target string, percent uint64, mode string, next http.Handler) (http.Handler, error) {
+	if mode != "headers" && mode != "full" {
+		return nil, fmt.Errorf("unknown mirror mode %q", mode)
+	}
+	if percent > 100 {
+		return nil, fmt.Errorf("mirror percentage %d is above 100", percent)
+	}
+	target = strings.TrimRight(target, "/")
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// limits the number of concurrent shadow requests, requests above the limit are not mirrored
+	inFlight := make(chan struct{}, mirrorMaxInFlight)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if uint64(rand.Intn(100)) >= percent {
+			next.ServeHTTP(w, req)
+			return
+		}
+		var body []byte
+		if mode == "full" && req.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(req.Body, mirrorMaxBodyBytes+1))
+			req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+			if err != nil || len(body) > mirrorMaxBodyBytes {
+				next.ServeHTTP(w, req)
+				return
+			}
+		}
+		shadow, err := http.NewRequestWithContext(ctx, req.Method, target+req.URL.RequestURI(), bytes.NewReader(body))
+		if err != nil {
+			slog.Error("Could not create shadow request", "err", err)
+			next.ServeHTTP(w, req)
+			return
+		}
+		shadow.Header = req.Header.Clone()
+		for _, header := range hopByHopHeaders {
+			shadow.Header.Del(header)
+		}
+		shadow.Header.Set("X-Shadow-Request", "true")
+
+		select {
+		case inFlight <- struct{}{}:
+			go func() {
+				defer func() { <-inFlight }()
+				shadowCtx, cancel := context.WithTimeout(ctx, mirrorTimeout)
+				defer cancel()
+				resp, err := client.Do(shadow.WithContext(shadowCtx))
+				if err != nil {
+					slog.Error("Could not mirror request", "path", req.URL.Path, "err", err)
+					return
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}()
+		default:
+		}
+		next.ServeHTTP(w, req)
+	}), nil
+}
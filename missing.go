@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const missingCacheMaxEntries = 10000
+
+// isAssetPath tells if the path refers to a file rather than a route of the SPA, e.g. /main.js.
+func isAssetPath(path string) bool {
+	ext := filepath.Ext(path)
+	return ext != "" && ext != ".html"
+}
+
+// defaultFallbackExclude matches the files a bundler emits, a missing chunk answered with index.html fails
+// in the browser with a confusing "Unexpected token <" instead of a 404.
+const defaultFallbackExclude = `\.(m?js|css|map|json|wasm|png|jpe?g|gif|svg|webp|avif|ico|woff2?|ttf|otf|eot)$`
+
+// parseFallbackExclude compiles the pattern of the paths never answered with index.html, false excludes none.
+func parseFallbackExclude(pattern string) (*regexp.Regexp, error) {
+	if pattern == "false" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// acceptsHTML tells if the client accepts the html of the SPA, like a browser navigating to a route, in
+// contrast to fetch() calls and probes, which accept */* or json. Without an Accept header it accepts anything.
+func acceptsHTML(req *http.Request) bool {
+	accept := req.Header.Values("Accept")
+	if len(accept) == 0 {
+		return true
+	}
+	for _, value := range accept {
+		for _, mediaRange := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				// explicitly not acceptable
+				continue
+			}
+			if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludedFromFallback tells if a missing path is answered with a 404 instead of index.html.
+func excludedFromFallback(path string, missingAssets string, exclude *regexp.Regexp) bool {
+	if missingAssets == "404" && isAssetPath(path) {
+		return true
+	}
+	return exclude != nil && exclude.MatchString(path)
+}
+
+type missingEntry struct {
+	expires time.Time
+	// hits are the requests since the last log, total those since the path is remembered
+	hits  uint64
+	total uint64
+}
+
+// missingKey identifies a missing path, the same path may exist on one host and not on another, e.g. with
+// host based redirects.
+type missingKey struct {
+	host string
+	path string
+}
+
+func hasAnyPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type missingFileKey struct{}
+
+// markMissingFile tells the missing cache that the file handler found no file for the path, other 404s
+// depend on the client, e.g. source maps denied by the policy, and are not remembered.
+func markMissingFile(req *http.Request) {
+	if holder, found := req.Context().Value(missingFileKey{}).(*bool); found {
+		*holder = true
+	}
+}
+
+// varies tells if the response varies by the request header, reading every value of the Vary header, e.g.
+// Origin added by the CORS handler before Accept.
+func varies(header http.Header, name string) bool {
+	for _, value := range header.Values("Vary") {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if token == "*" || strings.EqualFold(token, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingCache remembers the paths answered with a 404 for a while, so scanners and broken references are
+// answered before they reach the rest of the handlers. It also counts the requests per missing path. Paths
+// with an excluded prefix are never remembered, e.g. those of a proxied api whose resources come and go.
+// The cache is a prometheus collector of the topN most requested missing paths.
+type missingCache struct {
+	ttl      time.Duration
+	excluded func() []string
+	topN     int
+	requests *prometheus.Desc
+
+	mutex   sync.Mutex
+	entries map[missingKey]*missingEntry
+}
+
+type missingPath struct {
+	host string
+	path string
+	hits uint64
+}
+
+func newMissingCache(ttl time.Duration, excluded func() []string, topN int) *missingCache {
+	return &missingCache{
+		ttl:      ttl,
+		excluded: excluded,
+		topN:     topN,
+		requests: prometheus.NewDesc("spa_missing_path_requests_total",
+			"Number of requests of the most requested missing paths since they are remembered.",
+			[]string{"host", "path"}, nil),
+		entries: make(map[missingKey]*missingEntry),
+	}
+}
+
+func (c *missingCache) lookup(key missingKey) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.entries[key]
+	if !found || time.Now().After(entry.expires) {
+		return false
+	}
+	entry.hits++
+	entry.total++
+	return true
+}
+
+// reset forgets all missing paths, e.g. when a reloaded bundle adds some of them.
+func (c *missingCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[missingKey]*missingEntry)
+}
+
+func (c *missingCache) store(key missingKey) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if len(c.entries) >= missingCacheMaxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= missingCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = &missingEntry{expires: now.Add(c.ttl), hits: 1, total: 1}
+}
+
+// handler answers GET and HEAD requests for known missing paths with a 404 and remembers the paths the
+// file handler reported missing.
+func (c *missingCache) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead || hasAnyPrefix(req.URL.Path, c.excluded()) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		key := missingKey{req.Host, req.URL.Path}
+		if c.lookup(key) {
+			http.NotFound(w, req)
+			return
+		}
+		missing := false
+		req = req.WithContext(context.WithValue(req.Context(), missingFileKey{}, &missing))
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, req)
+		// a 404 depending on the Accept header does not tell that the path is missing for all clients
+		if missing && recorder.status == http.StatusNotFound && !varies(w.Header(), "Accept") {
+			c.store(key)
+		}
+	})
+}
+
+// takeTopMissing returns the n missing paths with the most requests since the last call.
+func (c *missingCache) takeTopMissing(n int) []missingPath {
+	c.mutex.Lock()
+	top := make([]missingPath, 0, len(c.entries))
+	for key, entry := range c.entries {
+		if entry.hits > 0 {
+			top = append(top, missingPath{key.host, key.path, entry.hits})
+			entry.hits = 0
+		}
+	}
+	c.mutex.Unlock()
+	return mostRequested(top, n)
+}
+
+func mostRequested(paths []missingPath, n int) []missingPath {
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i].hits > paths[j].hits
+	})
+	if len(paths) > n {
+		paths = paths[:n]
+	}
+	return paths
+}
+
+func (c *missingCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+}
+
+// Collect exports the topN missing paths with the most requests, exporting them all would let scanners
+// grow the number of series without bounds.
+func (c *missingCache) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	all := make([]missingPath, 0, len(c.entries))
+	for key, entry := range c.entries {
+		all = append(all, missingPath{key.host, key.path, entry.total})
+	}
+	c.mutex.Unlock()
+	for _, missing := range mostRequested(all, c.topN) {
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(missing.hits), missing.host, missing.path)
+	}
+}
+
+// logPeriodically logs the topN most requested missing paths of each interval.
+func (c *missingCache) logPeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		if top := c.takeTopMissing(c.topN); len(top) > 0 {
+			entries := make([]string, 0, len(top))
+			for _, missing := range top {
+				entries = append(entries, fmt.Sprintf("%s%s: %d", missing.host, missing.path, missing.hits))
+			}
+			slog.Info("Most requested missing paths", "interval", interval, "paths", strings.Join(entries, ", "))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMissingCacheKeepsAcceptDependentRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"without cors", map[string]string{"MISSING_CACHE_SECONDS": "60"}},
+		{"with cors", map[string]string{"MISSING_CACHE_SECONDS": "60", "CORS_ALLOWED_ORIGINS": "https://app.example.com"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestServer(t, test.env)
+			requests := []struct {
+				accept string
+				status int
+			}{
+				// a fetch of the route first, then the browser navigating to it
+				{"application/json", http.StatusNotFound},
+				{"text/html", http.StatusOK},
+				{"application/json", http.StatusNotFound},
+				{"text/html", http.StatusOK},
+			}
+			for _, r := range requests {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/orders/42", nil)
+				req.Header.Set("Accept", r.accept)
+				req.Header.Set("Origin", "https://app.example.com")
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != r.status {
+					t.Fatalf("Accept %s: status = %d, want %d", r.accept, rec.Code, r.status)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingCacheRemembersMissingFiles(t *testing.T) {
+	handler := newTestServer(t, map[string]string{
+		"MISSING_CACHE_SECONDS": "60",
+		"METRICS_PATH":          "/metrics",
+	})
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/assets/gone.js", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil))
+	want := `spa_missing_path_requests_total{host="localhost",path="/assets/gone.js"} 3`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics do not contain %s", want)
+	}
+}
+
+func TestMissingCacheKeepsDeniedSourcemaps(t *testing.T) {
+	handler := newTestServer(t, map[string]string{
+		"MISSING_CACHE_SECONDS": "60",
+		"SOURCEMAP_POLICY":      "restricted",
+		"SOURCEMAP_TOKEN":       "secret",
+	})
+	requests := []struct {
+		token  string
+		status int
+	}{
+		// a browser denied the source map first, then the error-tracking service presenting the token
+		{"", http.StatusNotFound},
+		{"secret", http.StatusOK},
+		{"", http.StatusNotFound},
+		{"secret", http.StatusOK},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/assets/main.3f2a1b9c.js.map", nil)
+		if r.token != "" {
+			req.Header.Set("X-Sourcemap-Token", r.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != r.status {
+			t.Fatalf("token %q: status = %d, want %d", r.token, rec.Code, r.status)
+		}
+	}
+}
+
+func TestVaries(t *testing.T) {
+	tests := []struct {
+		vary []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"Accept"}, true},
+		{[]string{"Origin", "Accept"}, true},
+		{[]string{"Origin, accept"}, true},
+		{[]string{"Origin", "Accept-Encoding"}, false},
+		{[]string{"*"}, true},
+	}
+	for _, test := range tests {
+		header := http.Header{"Vary": test.vary}
+		if got := varies(header, "Accept"); got != test.want {
+			t.Errorf("varies(%q, Accept) = %v, want %v", test.vary, got, test.want)
+		}
+	}
+}
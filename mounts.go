@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type mountContextKey struct{}
+
+// parseBasePaths parses the comma separated base paths the bundle is mounted at, ordered from the longest
+// to the shortest so the most specific mount wins.
+func parseBasePaths(list string) ([]string, error) {
+	var mounts []string
+	for _, mount := range strings.Split(list, ",") {
+		mount = strings.TrimSpace(mount)
+		if !strings.HasPrefix(mount, "/") || !strings.HasSuffix(mount, "/") {
+			return nil, fmt.Errorf("base path %q must start and end with /", mount)
+		}
+		mounts = append(mounts, mount)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i]) > len(mounts[j])
+	})
+	return mounts, nil
+}
+
+// mountIndexFiles creates a variant of index.html for every mount, with the base href pointing to the mount.
+func mountIndexFiles(index loadedFile, baseHref string, mounts []string) map[string]loadedFile {
+	indexFiles := make(map[string]loadedFile, len(mounts))
+	for _, mount := range mounts {
+		file := index
+		file.file = bytes.Replace(
+			index.file,
+			[]byte(fmt.Sprint("<base href=\"", baseHref, "\"")),
+			[]byte(fmt.Sprint("<base href=\"", strings.TrimSuffix(baseHref, "/"), mount, "\"")),
+			-1)
+		indexFiles[mount] = file
+	}
+	return indexFiles
+}
+
+// newMountHandler strips the base path from the request and remembers it for the file handler, so every
+// mount has its own fallback to its own index.html. Requests outside of all mounts receive a 404.
+func newMountHandler(mounts []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, mount := range mounts {
+			if req.URL.Path+"/" == mount {
+				http.Redirect(w, req, mount, http.StatusMovedPermanently)
+				return
+			}
+			if !strings.HasPrefix(req.URL.Path, mount) {
+				continue
+			}
+			mounted := req.WithContext(context.WithValue(req.Context(), mountContextKey{}, mount))
+			mountedURL := *req.URL
+			mountedURL.Path = "/" + strings.TrimPrefix(req.URL.Path, mount)
+			mountedURL.RawPath = ""
+			mounted.URL = &mountedURL
+			next.ServeHTTP(w, mounted)
+			return
+		}
+		http.NotFound(w, req)
+	})
+}
+
+// mountOf returns the base path the request was received at.
+func mountOf(req *http.Request) string {
+	mount, found := req.Context().Value(mountContextKey{}).(string)
+	if !found {
+		return "/"
+	}
+	return mount
+}
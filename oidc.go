@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcSessionCookieName = "spa-oidc-session"
+
+// oidcLoginCookieName is the prefix of the login cookies, there is one per state, so logins started in
+// parallel tabs do not replace each other.
+const oidcLoginCookieName = "spa-oidc-login-"
+
+// oidcCSRFCookieName holds the CSRF token of the session, readable by the SPA so it can send the token in
+// the oidcCSRFHeaderName header of its mutating requests.
+const oidcCSRFCookieName = "spa-csrf-token"
+const oidcCSRFHeaderName = "X-CSRF-Token"
+
+// oidcLoginTTL is how long a user may take to sign in at the identity provider.
+const oidcLoginTTL = 10 * time.Minute
+const oidcRequestTimeout = 10 * time.Second
+
+// oidcLogin is the state of a login in progress, kept in a cookie until the identity provider redirects back.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"expires"`
+}
+
+// oidcSession is the signed in user, kept in an encrypted cookie so the server needs no session storage.
+type oidcSession struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"expires"`
+	// IDToken is passed as id_token_hint on logout, so the provider ends the session without asking
+	IDToken string `json:"idToken,omitempty"`
+}
+
+// oidcGate lets only users signed in at an OpenID Connect identity provider in. Navigations without a
+// session are redirected to the provider, which redirects back to the callback path with an authorization
+// code. The code is exchanged for an ID token with PKCE, and the verified user is kept in an encrypted
+// session cookie. Other requests without a session are answered with a 401, so a fetch of the SPA never
+// follows a redirect to the login page of the provider.
+type oidcGate struct {
+	issuer       string
+	config       oauth2.Config
+	callbackPath string
+	logoutPath   string
+	sessionTTL   time.Duration
+	excluded     []string
+	cookies      cipher.AEAD
+	client       *http.Client
+	// csrfKey signs the CSRF tokens, so a token set by a sibling subdomain never matches a session
+	csrfKey []byte
+	// csrfProtected returns the path prefixes whose mutating requests need the CSRF token, nil disables it
+	csrfProtected func() []string
+	// trustedProxyHops trusts X-Forwarded-Proto for the scheme of the redirect url and the cookies
+	trustedProxyHops int
+
+	// the provider is discovered on first use, so the server starts while the identity provider is down,
+	// and again after the discovery ttl
+	discoveryTTL time.Duration
+	mutex        sync.Mutex
+	provider     *oidc.Provider
+	verifier     *oidc.IDTokenVerifier
+	discovered   time.Time
+}
+
+// newOIDCGate sets up the gate for the client of the issuer. The cookie secret encrypts the session
+// cookies, a new secret signs all users out. Paths under one of the comma separated excluded prefixes are
+// served without a session.
+func newOIDCGate(issuer string, clientID string, clientSecret string, cookieSecret string, scopes string, callbackPath string, logoutPath string, sessionTTL time.Duration, excluded string, trustedProxyHops int) (*oidcGate, error) {
+	if !strings.HasPrefix(issuer, "https://") && !strings.HasPrefix(issuer, "http://") {
+		return nil, fmt.Errorf("issuer %q must be a http(s) url", issuer)
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("client id is missing")
+	}
+	if len(cookieSecret) < 32 {
+		return nil, fmt.Errorf("cookie secret must have at least 32 characters")
+	}
+	for _, path := range []string{callbackPath, logoutPath} {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q must start with /", path)
+		}
+	}
+	key := sha256.Sum256([]byte(cookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	cookies, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	csrfKey := sha256.Sum256([]byte("csrf:" + cookieSecret))
+	gate := &oidcGate{
+		issuer: issuer,
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       []string{oidc.ScopeOpenID},
+		},
+		callbackPath: callbackPath,
+		logoutPath:   logoutPath,
+		sessionTTL:   sessionTTL,
+		cookies:      cookies,
+		csrfKey:      csrfKey[:],
+		client:       &http.Client{Timeout: oidcRequestTimeout},
+
+		trustedProxyHops: trustedProxyHops,
+	}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" && scope != oidc.ScopeOpenID {
+			gate.config.Scopes = append(gate.config.Scopes, scope)
+		}
+	}
+	for _, prefix := range strings.Split(excluded, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			gate.excluded = append(gate.excluded, prefix)
+		}
+	}
+	return gate, nil
+}
+
+// cacheDocuments fetches the discovery document and the JWKS of the identity provider through the cache,
+// which keeps them for cacheSeconds and serves them for staleSeconds longer while the provider is down.
+// The provider is discovered again once its discovery document expired, so changed endpoints and signing
+// keys are picked up.
+func (g *oidcGate) cacheDocuments(cache *remoteProxy, cacheSeconds uint64, staleSeconds uint64) {
+	g.client.Transport = cache.transport(remote{
+		Prefix:         "oidc",
+		CacheSeconds:   cacheSeconds,
+		StaleSeconds:   staleSeconds,
+		TimeoutSeconds: uint64(oidcRequestTimeout / time.Second),
+	})
+	g.discoveryTTL = time.Duration(cacheSeconds) * time.Second
+}
+
+// protectCSRF requires the CSRF token of the session on the mutating requests to paths under the prefixes,
+// e.g. of the proxy rules, so a page of another site can not use the session cookie to call the backends.
+// The token is a double-submit cookie: the SPA reads it and repeats it in the X-CSRF-Token header.
+func (g *oidcGate) protectCSRF(prefixes func() []string) {
+	g.csrfProtected = prefixes
+}
+
+// csrfToken signs a random value for the subject of the session.
+func (g *oidcGate) csrfToken(subject string) (string, error) {
+	value, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return value + "." + g.csrfSignature(value, subject), nil
+}
+
+func (g *oidcGate) csrfSignature(value string, subject string) string {
+	mac := hmac.New(sha256.New, g.csrfKey)
+	mac.Write([]byte(value + "\x00" + subject))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken tells if the token was issued for the subject of the session.
+func (g *oidcGate) validCSRFToken(token string, subject string) bool {
+	value, signature, found := strings.Cut(token, ".")
+	return found && hmac.Equal([]byte(signature), []byte(g.csrfSignature(value, subject)))
+}
+
+// checkCSRF issues the CSRF token of the session if the browser has none for it, and refuses mutating
+// requests to the protected paths that do not repeat the token of the cookie in the header.
+func (g *oidcGate) checkCSRF(w http.ResponseWriter, req *http.Request, session oidcSession) bool {
+	cookie, err := req.Cookie(oidcCSRFCookieName)
+	valid := err == nil && g.validCSRFToken(cookie.Value, session.Subject)
+	if !valid {
+		token, err := g.csrfToken(session.Subject)
+		if err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:    oidcCSRFCookieName,
+				Value:   token,
+				Path:    "/",
+				Expires: time.Unix(session.Expires, 0),
+				Secure:  isHTTPS(req, g.trustedProxyHops),
+				// the SPA reads the token, it is worthless to another site that can not read the cookie
+				HttpOnly: false,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	// matched like the proxy rules match, so every request the proxy forwards is checked
+	protected := false
+	for _, prefix := range g.csrfProtected() {
+		protected = protected || strings.HasPrefix(req.URL.Path, prefix)
+	}
+	if !protected {
+		return true
+	}
+	if valid && subtle.ConstantTimeCompare([]byte(req.Header.Get(oidcCSRFHeaderName)), []byte(cookie.Value)) == 1 {
+		return true
+	}
+	slog.Warn("Refused request without the CSRF token of the session", "method", req.Method, "path", req.URL.Path)
+	writeProblem(w, req, http.StatusForbidden, "the request must repeat the "+oidcCSRFCookieName+" cookie in the "+oidcCSRFHeaderName+" header")
+	return false
+}
+
+// discover returns the provider of the issuer, fetching its discovery document until it succeeds once and
+// again after the discovery ttl. While the discovery fails, the provider discovered before is kept.
+func (g *oidcGate) discover(ctx context.Context) (*oidc.Provider, *oidc.IDTokenVerifier, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.provider != nil && (g.discoveryTTL == 0 || time.Since(g.discovered) < g.discoveryTTL) {
+		return g.provider, g.verifier, nil
+	}
+	// the key set of the provider fetches the JWKS with the context it was created with, so the context
+	// keeps the client but must outlive the request
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.WithoutCancel(ctx), g.client), g.issuer)
+	if err != nil {
+		if g.provider != nil {
+			slog.Warn("Could not discover the OpenID Connect provider again, keeping the previous one", "issuer", g.issuer, "err", err)
+			g.discovered = time.Now()
+			return g.provider, g.verifier, nil
+		}
+		return nil, nil, err
+	}
+	if g.provider == nil {
+		slog.Info("Discovered the OpenID Connect provider", "issuer", g.issuer)
+	}
+	g.provider = provider
+	g.verifier = provider.Verifier(&oidc.Config{ClientID: g.config.ClientID})
+	g.discovered = time.Now()
+	return g.provider, g.verifier, nil
+}
+
+// seal encrypts the value into a cookie value, the purpose keeps the cookies of one kind from being
+// presented as the other.
+func (g *oidcGate) seal(purpose string, value interface{}) (string, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, g.cookies.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(g.cookies.Seal(nonce, nonce, plain, []byte(purpose))), nil
+}
+
+// open decrypts the cookie of the request into the value, it fails for missing or tampered cookies.
+func (g *oidcGate) open(req *http.Request, name string, purpose string, value interface{}) error {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < g.cookies.NonceSize() {
+		return fmt.Errorf("cookie %s is too short", name)
+	}
+	plain, err := g.cookies.Open(nil, sealed[:g.cookies.NonceSize()], sealed[g.cookies.NonceSize():], []byte(purpose))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, value)
+}
+
+func (g *oidcGate) setCookie(w http.ResponseWriter, req *http.Request, name string, path string, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		Secure:   isHTTPS(req, g.trustedProxyHops),
+		HttpOnly: true,
+		// lax, so the cookies are sent with the redirect back from the identity provider
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (g *oidcGate) clearCookie(w http.ResponseWriter, name string, path string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: path, MaxAge: -1, HttpOnly: true})
+}
+
+// absoluteURL is the url of the path on the host of the request.
+func (g *oidcGate) absoluteURL(req *http.Request, path string) string {
+	scheme := "http"
+	if isHTTPS(req, g.trustedProxyHops) {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: req.Host, Path: path}).String()
+}
+
+// redirectURL is the absolute url of the callback path on the host of the request, it must be registered
+// with the client at the identity provider.
+func (g *oidcGate) redirectURL(req *http.Request) string {
+	return g.absoluteURL(req, g.callbackPath)
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// login redirects to the identity provider and remembers the request, so the user returns to it.
+func (g *oidcGate) login(w http.ResponseWriter, req *http.Request) {
+	provider, _, err := g.discover(req.Context())
+	if err != nil {
+		slog.Error("Could not discover the OpenID Connect provider", "issuer", g.issuer, "err", err)
+		writeProblem(w, req, http.StatusBadGateway, "the identity provider is not available")
+		return
+	}
+	state, errState := randomToken()
+	nonce, errNonce := randomToken()
+	if errState != nil || errNonce != nil {
+		writeProblem(w, req, http.StatusInternalServerError, "could not start the login")
+		return
+	}
+	expires := time.Now().Add(oidcLoginTTL)
+	login := oidcLogin{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+		Redirect: localRedirect(req.URL.RequestURI()),
+		Expires:  expires.Unix(),
+	}
+	sealed, err := g.seal(oidcLoginCookieName, login)
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, "could not start the login")
+		return
+	}
+	config := g.config
+	config.Endpoint = provider.Endpoint()
+	config.RedirectURL = g.redirectURL(req)
+	// the login cookie is only sent back to the callback
+	g.setCookie(w, req, oidcLoginCookieName+state, g.callbackPath, sealed, expires)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, req, config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier)), http.StatusFound)
+}
+
+// callback completes the login started by the login cookie of the state, creates the session and redirects
+// to the page the login started from.
+func (g *oidcGate) callback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	state := query.Get("state")
+	var login oidcLogin
+	err := g.open(req, oidcLoginCookieName+state, oidcLoginCookieName, &login)
+	if err != nil || time.Now().Unix() >= login.Expires || state == "" || state != login.State {
+		writeProblem(w, req, http.StatusBadRequest, "the login is invalid or has expired, open the page again")
+		return
+	}
+	g.clearCookie(w, oidcLoginCookieName+state, g.callbackPath)
+	if reason := query.Get("error"); reason != "" {
+		slog.Warn("Identity provider refused the login", "error", reason, "description", query.Get("error_description"))
+		writeProblem(w, req, http.StatusForbidden, fmt.Sprintf("the identity provider refused the login: %s", reason))
+		return
+	}
+	provider, verifier, err := g.discover(req.Context())
+	if err != nil {
+		slog.Error("Could not discover the OpenID Connect provider", "issuer", g.issuer, "err", err)
+		writeProblem(w, req, http.StatusBadGateway, "the identity provider is not available")
+		return
+	}
+	config := g.config
+	config.Endpoint = provider.Endpoint()
+	config.RedirectURL = g.redirectURL(req)
+	ctx := context.WithValue(req.Context(), oauth2.HTTPClient, g.client)
+	token, err := config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		slog.Error("Could not exchange the authorization code", "err", err)
+		writeProblem(w, req, http.StatusBadGateway, "could not complete the login at the identity provider")
+		return
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		slog.Error("Could not verify the ID token", "err", err)
+		writeProblem(w, req, http.StatusForbidden, "the identity provider returned an invalid ID token")
+		return
+	}
+	var claims struct {
+		Email string `json:"email"`
+	}
+	_ = idToken.Claims(&claims)
+
+	expires := time.Now().Add(g.sessionTTL)
+	sealed, err := g.seal(oidcSessionCookieName, oidcSession{Subject: idToken.Subject, Email: claims.Email, Expires: expires.Unix(), IDToken: rawIDToken})
+	if err != nil {
+		writeProblem(w, req, http.StatusInternalServerError, "could not create the session")
+		return
+	}
+	g.setCookie(w, req, oidcSessionCookieName, "/", sealed, expires)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, req, login.Redirect, http.StatusFound)
+}
+
+// logout ends the session and, if the provider supports it, the session at the identity provider too. The
+// provider redirects back to / on the host of the request, which must be registered as post logout redirect
+// uri. It must be posted, so a link or an image on another page can not sign the user out.
+func (g *oidcGate) logout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeProblem(w, req, http.StatusMethodNotAllowed, "logout must be posted")
+		return
+	}
+	// an expired session still identifies the user to the provider
+	var session oidcSession
+	_ = g.open(req, oidcSessionCookieName, oidcSessionCookieName, &session)
+	g.clearCookie(w, oidcSessionCookieName, "/")
+	w.Header().Set("Cache-Control", "no-store")
+	redirect := "/"
+	if provider, _, err := g.discover(req.Context()); err == nil {
+		var claims struct {
+			EndSessionEndpoint string `json:"end_session_endpoint"`
+		}
+		if provider.Claims(&claims) == nil && claims.EndSessionEndpoint != "" {
+			query := url.Values{
+				"client_id":                {g.config.ClientID},
+				"post_logout_redirect_uri": {g.absoluteURL(req, "/")},
+			}
+			if session.IDToken != "" {
+				query.Set("id_token_hint", session.IDToken)
+			}
+			separator := "?"
+			if strings.Contains(claims.EndSessionEndpoint, "?") {
+				separator = "&"
+			}
+			redirect = claims.EndSessionEndpoint + separator + query.Encode()
+		}
+	}
+	// see other, so the browser follows the redirect with a GET
+	http.Redirect(w, req, redirect, http.StatusSeeOther)
+}
+
+// session returns the user of the session cookie, if it is valid and has not expired.
+func (g *oidcGate) session(req *http.Request) (oidcSession, bool) {
+	var session oidcSession
+	err := g.open(req, oidcSessionCookieName, oidcSessionCookieName, &session)
+	return session, err == nil && time.Now().Unix() < session.Expires
+}
+
+// handler serves the callback and logout paths and lets only requests with a session through.
+func (g *oidcGate) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == g.callbackPath:
+			g.callback(w, req)
+			return
+		case req.URL.Path == g.logoutPath:
+			g.logout(w, req)
+			return
+		case underAnyPrefix(req.URL.Path, g.excluded):
+			next.ServeHTTP(w, req)
+			return
+		}
+		if session, valid := g.session(req); valid {
+			if g.csrfProtected != nil && !g.checkCSRF(w, req, session) {
+				return
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodGet && acceptsHTML(req) {
+			g.login(w, req)
+			return
+		}
+		writeProblem(w, req, http.StatusUnauthorized, "this server requires a login")
+	})
+}
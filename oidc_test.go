@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestOIDCGate sets up a gate for an issuer that is down, so the tests never get past the discovery.
+func newTestOIDCGate(t *testing.T, excluded string, trustedProxyHops int) *oidcGate {
+	t.Helper()
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(issuer.Close)
+	gate, err := newOIDCGate(issuer.URL, "spa", "", strings.Repeat("s", 32), "openid",
+		"/__oidc/callback", "/__oidc/logout", time.Hour, excluded, trustedProxyHops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gate
+}
+
+func TestOIDCGateExcludedPaths(t *testing.T) {
+	handler := newTestOIDCGate(t, "/public, /assets/", 0).handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/public", http.StatusOK},
+		{"/public/logo.svg", http.StatusOK},
+		{"/assets/main.js", http.StatusOK},
+		{"/publicity", http.StatusUnauthorized},
+		{"/public/../admin", http.StatusUnauthorized},
+		{"/assets", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	gate := newTestOIDCGate(t, "", 0)
+	handler := gate.handler(http.NotFoundHandler())
+	login := func(state string, expires time.Time) string {
+		sealed, err := gate.seal(oidcLoginCookieName, oidcLogin{State: state, Redirect: "/", Expires: expires.Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+	session, err := gate.seal(oidcSessionCookieName, oidcLogin{State: "state-a", Redirect: "/", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+		status int
+	}{
+		{"no login cookie", "state-a", nil, http.StatusBadRequest},
+		{"no state", "", &http.Cookie{Name: oidcLoginCookieName, Value: login("", time.Now().Add(time.Hour))}, http.StatusBadRequest},
+		{"cookie of another state", "state-b", &http.Cookie{Name: oidcLoginCookieName + "state-b", Value: login("state-a", time.Now().Add(time.Hour))}, http.StatusBadRequest},
+		{"expired login", "state-a", &http.Cookie{Name: oidcLoginCookieName + "state-a", Value: login("state-a", time.Now().Add(-time.Minute))}, http.StatusBadRequest},
+		{"tampered cookie", "state-a", &http.Cookie{Name: oidcLoginCookieName + "state-a", Value: login("state-a", time.Now().Add(time.Hour))[1:]}, http.StatusBadRequest},
+		{"session cookie as login cookie", "state-a", &http.Cookie{Name: oidcLoginCookieName + "state-a", Value: session}, http.StatusBadRequest},
+		// the state matches, the login fails at the discovery of the issuer that is down
+		{"matching state", "state-a", &http.Cookie{Name: oidcLoginCookieName + "state-a", Value: login("state-a", time.Now().Add(time.Hour))}, http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/__oidc/callback?code=code&state="+test.state, nil)
+			if test.cookie != nil {
+				req.AddCookie(test.cookie)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestOIDCLogoutMustBePosted(t *testing.T) {
+	handler := newTestOIDCGate(t, "", 0).handler(http.NotFoundHandler())
+	tests := []struct {
+		method  string
+		status  int
+		cleared bool
+	}{
+		{http.MethodGet, http.StatusMethodNotAllowed, false},
+		{http.MethodPost, http.StatusSeeOther, true},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost/__oidc/logout", nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+			cleared := false
+			for _, cookie := range rec.Result().Cookies() {
+				cleared = cleared || cookie.Name == oidcSessionCookieName && cookie.MaxAge < 0
+			}
+			if cleared != test.cleared {
+				t.Errorf("session cookie cleared = %v, want %v", cleared, test.cleared)
+			}
+		})
+	}
+}
+
+func TestOIDCRedirectURLScheme(t *testing.T) {
+	tests := []struct {
+		name             string
+		trustedProxyHops int
+		forwardedProto   string
+		want             string
+	}{
+		{"plain http", 0, "", "http://app.example.com/__oidc/callback"},
+		{"untrusted forwarded https", 0, "https", "http://app.example.com/__oidc/callback"},
+		{"trusted forwarded https", 1, "https", "https://app.example.com/__oidc/callback"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gate := newTestOIDCGate(t, "", test.trustedProxyHops)
+			req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			if test.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+			}
+			if got := gate.redirectURL(req); got != test.want {
+				t.Errorf("redirectURL = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOIDCLogoutEndsProviderSession(t *testing.T) {
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys","end_session_endpoint":"%[1]s/logout","id_token_signing_alg_values_supported":["RS256"]}`, issuer.URL)
+	}))
+	t.Cleanup(issuer.Close)
+	gate, err := newOIDCGate(issuer.URL, "spa", "", strings.Repeat("s", 32), "openid",
+		"/__oidc/callback", "/__oidc/logout", time.Hour, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := gate.seal(oidcSessionCookieName, oidcSession{Subject: "user", Expires: time.Now().Add(time.Hour).Unix(), IDToken: "raw.id.token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://app.example.com/__oidc/logout", nil)
+	req.AddCookie(&http.Cookie{Name: oidcSessionCookieName, Value: session})
+	rec := httptest.NewRecorder()
+	gate.handler(http.NotFoundHandler()).ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location.Scheme + "://" + location.Host + location.Path; got != issuer.URL+"/logout" {
+		t.Errorf("redirect = %q, want the end session endpoint", got)
+	}
+	query := location.Query()
+	if query.Get("id_token_hint") != "raw.id.token" {
+		t.Errorf("id_token_hint = %q", query.Get("id_token_hint"))
+	}
+	if query.Get("post_logout_redirect_uri") != "http://app.example.com/" {
+		t.Errorf("post_logout_redirect_uri = %q", query.Get("post_logout_redirect_uri"))
+	}
+	if query.Get("client_id") != "spa" {
+		t.Errorf("client_id = %q", query.Get("client_id"))
+	}
+}
+
+func TestOIDCDiscoveryServedStaleDuringOutage(t *testing.T) {
+	var down atomic.Bool
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/auth","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys","id_token_signing_alg_values_supported":["RS256"]}`, issuer.URL)
+	}))
+	t.Cleanup(issuer.Close)
+	gate, err := newOIDCGate(issuer.URL, "spa", "", strings.Repeat("s", 32), "openid",
+		"/__oidc/callback", "/__oidc/logout", time.Hour, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newRemoteProxy(nil)
+	gate.cacheDocuments(cache, 60, 3600)
+	if _, _, err := gate.discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the discovery document expired while the identity provider is down
+	down.Store(true)
+	gate.discovered = time.Now().Add(-time.Hour)
+	cache.mutex.Lock()
+	for target, cached := range cache.cache {
+		cached.expires = time.Now().Add(-time.Minute)
+		cache.cache[target] = cached
+	}
+	cache.mutex.Unlock()
+
+	provider, _, err := gate.discover(context.Background())
+	if err != nil || provider.Endpoint().TokenURL != issuer.URL+"/token" {
+		t.Fatalf("discovery during the outage failed: %v", err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cache.staleResponses)
+	families, err := registry.Gather()
+	if err != nil || len(families) != 1 || families[0].GetMetric()[0].GetCounter().GetValue() != 1 {
+		t.Errorf("the stale response is not counted: %v %v", families, err)
+	}
+}
+
+func TestOIDCCSRFProtectsProxiedMutations(t *testing.T) {
+	gate := newTestOIDCGate(t, "", 0)
+	gate.protectCSRF(func() []string { return []string{"/api/"} })
+	handler := gate.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	newSession := func(subject string) *http.Cookie {
+		sealed, err := gate.seal(oidcSessionCookieName, oidcSession{Subject: subject, Expires: time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: oidcSessionCookieName, Value: sealed}
+	}
+	session := newSession("user")
+
+	// the token is issued with the first response of the session
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+	req.AddCookie(session)
+	handler.ServeHTTP(rec, req)
+	var token string
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == oidcCSRFCookieName {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("no CSRF token was issued")
+	}
+	otherToken, err := gate.csrfToken("attacker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		cookie string
+		header string
+		status int
+	}{
+		{"proxied post with token", http.MethodPost, "/api/orders", token, token, http.StatusNoContent},
+		{"proxied post without header", http.MethodPost, "/api/orders", token, "", http.StatusForbidden},
+		{"proxied post with other header", http.MethodPost, "/api/orders", token, otherToken, http.StatusForbidden},
+		{"proxied post with token of another session", http.MethodDelete, "/api/orders/1", otherToken, otherToken, http.StatusForbidden},
+		{"proxied get", http.MethodGet, "/api/orders", "", "", http.StatusNoContent},
+		{"post outside the proxy", http.MethodPost, "/__events", "", "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost"+test.path, nil)
+			req.AddCookie(session)
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: oidcCSRFCookieName, Value: test.cookie})
+			}
+			if test.header != "" {
+				req.Header.Set(oidcCSRFHeaderName, test.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
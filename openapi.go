@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// jsonObject is a json object of the OpenAPI document.
+type jsonObject = map[string]interface{}
+
+// problemResponse is an error answered with a problem document, see writeProblem.
+func problemResponse(description string) jsonObject {
+	return jsonObject{
+		"description": description,
+		"content": jsonObject{
+			"application/problem+json": jsonObject{"schema": jsonObject{"$ref": "#/components/schemas/Problem"}},
+		},
+	}
+}
+
+// adminOperation describes an operation of the admin port open to clients with at least the role.
+func adminOperation(id string, summary string, role adminRole, responses jsonObject) jsonObject {
+	responses["401"] = problemResponse("No known admin token was presented")
+	responses["403"] = problemResponse("The role of the token is too low")
+	return jsonObject{
+		"operationId": id,
+		"summary":     summary,
+		"description": fmt.Sprintf("Requires the %s role.", role),
+		"x-role":      role.String(),
+		"security":    []jsonObject{{"bearer": []string{}}},
+		"responses":   responses,
+	}
+}
+
+// managementOpenAPI is the OpenAPI 3 document of the admin port, with the probes at their paths.
+func managementOpenAPI(healthPath string, readyPath string) jsonObject {
+	jsonContent := func(schema jsonObject) jsonObject {
+		return jsonObject{"application/json": jsonObject{"schema": schema}}
+	}
+	routing := jsonObject{"$ref": "#/components/schemas/RoutingDocument"}
+	configStatus := jsonObject{"$ref": "#/components/schemas/ConfigStatus"}
+	paths := jsonObject{
+		"/openapi.json": jsonObject{
+			"get": adminOperation("getOpenAPI", "This document", roleViewer, jsonObject{
+				"200": jsonObject{"description": "The OpenAPI document", "content": jsonContent(jsonObject{"type": "object"})},
+			}),
+		},
+		"/routing": jsonObject{
+			"get": adminOperation("getRouting", "Export the resolved rule set", roleViewer, jsonObject{
+				"200": jsonObject{"description": "The routing document", "content": jsonContent(routing)},
+			}),
+			"put": func() jsonObject {
+				operation := adminOperation("putRouting", "Replace the redirects, rewrites and proxy rules", roleOperator, jsonObject{
+					"200": jsonObject{"description": "The routing document in effect", "content": jsonContent(routing)},
+					"409": problemResponse("The readOnly settings differ from those of the running server"),
+					"413": problemResponse("The document is too large"),
+					"422": problemResponse("The rules are invalid"),
+				})
+				operation["requestBody"] = jsonObject{"required": true, "content": jsonContent(routing)}
+				return operation
+			}(),
+		},
+		"/config": jsonObject{
+			"get": adminOperation("getConfig", "Show the runtime config in effect", roleViewer, jsonObject{
+				"200": jsonObject{"description": "The config and its version", "content": jsonContent(configStatus)},
+			}),
+			"put": func() jsonObject {
+				operation := adminOperation("putConfig", "Replace the runtime config, keeping the previous one for a rollback", roleOperator, jsonObject{
+					"200": jsonObject{"description": "The config in effect", "content": jsonContent(configStatus)},
+					"409": problemResponse("The origins of the config differ from those the CSP was derived from"),
+					"413": problemResponse("The config is too large"),
+					"422": problemResponse("The config is invalid"),
+				})
+				operation["requestBody"] = jsonObject{"required": true, "content": jsonContent(jsonObject{"type": "object"})}
+				return operation
+			}(),
+		},
+		"/config/rollback": jsonObject{
+			"post": adminOperation("rollbackConfig", "Serve the previous runtime config again", roleOperator, jsonObject{
+				"200": jsonObject{"description": "The config in effect", "content": jsonContent(configStatus)},
+				"409": problemResponse("There is no previous config"),
+			}),
+		},
+		"/audit": jsonObject{
+			"get": func() jsonObject {
+				report := jsonObject{"$ref": "#/components/schemas/AuditReport"}
+				operation := adminOperation("getAudit", "Read and verify the audit log of the admin actions", roleAdmin, jsonObject{
+					"200": jsonObject{"description": "The entries, the chain is intact", "content": jsonContent(report)},
+					"409": jsonObject{"description": "The entries, the chain is broken", "content": jsonContent(report)},
+				})
+				operation["parameters"] = []jsonObject{{
+					"name": "after", "in": "query", "required": false,
+					"description": "Only the entries after this sequence number are listed",
+					"schema":      jsonObject{"type": "integer"},
+				}}
+				return operation
+			}(),
+		},
+		"/logs": jsonObject{
+			"get": func() jsonObject {
+				operation := adminOperation("streamLogs", "Stream the live log as server-sent events", roleOperator, jsonObject{
+					"200": jsonObject{"description": "One event per log record", "content": jsonObject{"text/event-stream": jsonObject{"schema": jsonObject{"type": "string"}}}},
+				})
+				operation["parameters"] = []jsonObject{{
+					"name": "contains", "in": "query", "required": false,
+					"description": "Only records including the value are sent",
+					"schema":      jsonObject{"type": "string"},
+				}}
+				return operation
+			}(),
+		},
+	}
+	probes := []struct {
+		path    string
+		id      string
+		summary string
+	}{
+		{healthPath, "liveness", "Liveness probe"},
+		{readyPath, "readiness", "Readiness probe, fails once the server shuts down"},
+	}
+	for _, probe := range probes {
+		if strings.HasPrefix(probe.path, "/") {
+			paths[probe.path] = jsonObject{"get": jsonObject{
+				"operationId": probe.id,
+				"summary":     probe.summary,
+				"security":    []jsonObject{},
+				"responses": jsonObject{
+					"200": jsonObject{"description": "The status of the server", "content": jsonContent(jsonObject{"type": "object"})},
+					"503": jsonObject{"description": "The server is shutting down"},
+				},
+			}}
+		}
+	}
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":   "spa-server admin API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"securitySchemes": jsonObject{
+				"bearer": jsonObject{"type": "http", "scheme": "bearer", "description": "An admin token, or a JWT of the admin OpenID Connect issuer"},
+			},
+			"schemas": jsonObject{
+				// the fields of problem
+				"Problem": jsonObject{
+					"type":     "object",
+					"required": []string{"type", "title", "status", "instance", "requestId"},
+					"properties": jsonObject{
+						"type":      jsonObject{"type": "string"},
+						"title":     jsonObject{"type": "string"},
+						"status":    jsonObject{"type": "integer"},
+						"detail":    jsonObject{"type": "string"},
+						"instance":  jsonObject{"type": "string"},
+						"requestId": jsonObject{"type": "string", "description": "The X-Request-Id of the request, to find it in the logs"},
+					},
+				},
+				"ConfigStatus": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"configVersion":         jsonObject{"type": "string"},
+						"previousConfigVersion": jsonObject{"type": "string", "description": "The version a rollback returns to"},
+						"config":                jsonObject{"type": "object"},
+					},
+				},
+				// the fields of adminAuditEntry
+				"AuditEntry": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"seq":        jsonObject{"type": "integer"},
+						"time":       jsonObject{"type": "string", "format": "date-time"},
+						"principal":  jsonObject{"type": "string"},
+						"role":       jsonObject{"type": "string", "enum": []string{"viewer", "operator", "admin"}},
+						"method":     jsonObject{"type": "string"},
+						"path":       jsonObject{"type": "string"},
+						"status":     jsonObject{"type": "integer"},
+						"bodySha256": jsonObject{"type": "string"},
+						"requestId":  jsonObject{"type": "string"},
+						"prev":       jsonObject{"type": "string", "description": "The hash of the entry before"},
+						"hash":       jsonObject{"type": "string", "description": "The SHA-256 of the json of the entry without the hash"},
+					},
+				},
+				"AuditReport": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"verified": jsonObject{"type": "boolean"},
+						"error":    jsonObject{"type": "string", "description": "Why the chain is broken"},
+						"entries":  jsonObject{"type": "array", "items": jsonObject{"$ref": "#/components/schemas/AuditEntry"}},
+					},
+				},
+				// the fields of routingDocument
+				"RoutingDocument": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"redirects": jsonObject{"type": "array", "items": jsonObject{
+							"type":     "object",
+							"required": []string{"from", "to", "status"},
+							"properties": jsonObject{
+								"host":   jsonObject{"type": "string"},
+								"from":   jsonObject{"type": "string"},
+								"to":     jsonObject{"type": "string"},
+								"status": jsonObject{"type": "integer"},
+							},
+						}},
+						"rewrites": jsonObject{"type": "array", "items": jsonObject{
+							"type":     "object",
+							"required": []string{"pattern", "replacement"},
+							"properties": jsonObject{
+								"pattern":     jsonObject{"type": "string"},
+								"replacement": jsonObject{"type": "string"},
+							},
+						}},
+						"proxyRules": jsonObject{"type": "array", "items": jsonObject{"type": "string", "example": "/api/=>http://backend:8080"}},
+						"readOnly": jsonObject{
+							"type":        "object",
+							"description": "The settings that only change with a restart, an import is refused if they differ",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// newOpenAPIHandler serves the OpenAPI document of the admin port.
+func newOpenAPIHandler(document jsonObject) http.Handler {
+	body, _ := json.MarshalIndent(document, "", "  ")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeProblem(w, req, http.StatusMethodNotAllowed, "the OpenAPI document is read with GET")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	})
+}
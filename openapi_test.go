@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newOpenAPIHandler(managementOpenAPI("/healthz", "false")).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var document struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		t.Errorf("openapi = %q", document.OpenAPI)
+	}
+	for path, method := range map[string]string{"/routing": "put", "/logs": "get", "/openapi.json": "get", "/audit": "get", "/config": "put", "/config/rollback": "post", "/healthz": "get"} {
+		if _, found := document.Paths[path][method]; !found {
+			t.Errorf("%s %s is not documented", method, path)
+		}
+	}
+	if _, found := document.Paths["false"]; found {
+		t.Errorf("the disabled readiness probe is documented")
+	}
+
+	// the schemas follow the documents the server writes
+	schemas := map[string]reflect.Type{"Problem": reflect.TypeOf(problem{}), "RoutingDocument": reflect.TypeOf(routingDocument{}), "AuditEntry": reflect.TypeOf(adminAuditEntry{})}
+	for name, structType := range schemas {
+		for i := 0; i < structType.NumField(); i++ {
+			field := strings.Split(structType.Field(i).Tag.Get("json"), ",")[0]
+			if _, found := document.Components.Schemas[name].Properties[field]; !found {
+				t.Errorf("the %s schema lacks %q", name, field)
+			}
+		}
+	}
+}
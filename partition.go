@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// configVary returns the request headers the config depends on, so shared caches keep one config per
+// tenant or visitor instead of serving the config of one to another.
+func configVary(rules []configRule, experiments []experiment, previews []preview) []string {
+	headers := make(map[string]bool)
+	for _, rule := range rules {
+		for name := range rule.Match.Headers {
+			headers[http.CanonicalHeaderKey(name)] = true
+		}
+		if len(rule.Match.Cookies) > 0 {
+			headers["Cookie"] = true
+		}
+	}
+	if len(experiments) > 0 || len(previews) > 0 {
+		headers["Cookie"] = true
+	}
+	vary := make([]string, 0, len(headers))
+	for name := range headers {
+		vary = append(vary, name)
+	}
+	sort.Strings(vary)
+	return vary
+}
+
+// htmlVary returns the request headers the html depends on. Themes per host render a different
+// index.html for each host, which shared caches must keep apart even if they normalize the host.
+func htmlVary(themes map[string]themeInjection) []string {
+	for host := range themes {
+		if host != defaultThemeHost {
+			return []string{"Host"}
+		}
+	}
+	return nil
+}
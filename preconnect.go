@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// preconnectLinks returns the value of a Link header asking browsers to set up the connections to the
+// origins, e.g. of the API, while the SPA is still loading. Websocket origins are preconnected over http(s).
+func preconnectLinks(origins []string) string {
+	links := make([]string, 0, 2*len(origins))
+	seen := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		origin = strings.Replace(origin, "wss://", "https://", 1)
+		origin = strings.Replace(origin, "ws://", "http://", 1)
+		if origin == "" || seen[origin] {
+			continue
+		}
+		seen[origin] = true
+		// fetch requests without credentials use anonymous connections, which need crossorigin
+		links = append(links, fmt.Sprintf("<%s>; rel=preconnect; crossorigin", origin), fmt.Sprintf("<%s>; rel=dns-prefetch", origin))
+	}
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+const previewCookieName = "spa-preview"
+const previewCookieMaxAge = 24 * 60 * 60
+
+// preview is a config set merged over the runtime config for users who opened the tokenized preview link,
+// so product teams can share unreleased features on production infrastructure.
+type preview struct {
+	Name   string                 `json:"name"`
+	Token  string                 `json:"token"`
+	Config map[string]interface{} `json:"config"`
+}
+
+func parsePreviews(previewsJSON string) ([]preview, error) {
+	var previews []preview
+	err := json.Unmarshal([]byte(previewsJSON), &previews)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range previews {
+		if p.Name == "" {
+			return nil, fmt.Errorf("preview must have a name")
+		}
+		if len(p.Token) < 16 {
+			return nil, fmt.Errorf("token of preview %s must have at least 16 characters", p.Name)
+		}
+	}
+	return previews, nil
+}
+
+func previewForToken(previews []preview, token string) (preview, bool) {
+	for _, p := range previews {
+		if subtle.ConstantTimeCompare([]byte(p.Token), []byte(token)) == 1 {
+			return p, true
+		}
+	}
+	return preview{}, false
+}
+
+// activePreview returns the preview the preview cookie of the request switches to.
+func activePreview(req *http.Request, previews []preview) (preview, bool) {
+	cookie, err := req.Cookie(previewCookieName)
+	if err != nil {
+		return preview{}, false
+	}
+	return previewForToken(previews, cookie.Value)
+}
+
+// withPreview merges the config of the preview over the runtime config and names the preview under the
+// key "preview".
+func withPreview(config []byte, p preview) ([]byte, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(config, &doc)
+	if err != nil {
+		return nil, err
+	}
+	mergeJSON(doc, p.Config)
+	doc["preview"] = p.Name
+	return json.Marshal(doc)
+}
+
+// localRedirect returns the redirect if it is a path on this server, otherwise /, so a link must not send
+// users to other sites.
+func localRedirect(redirect string) string {
+	if !isLocalPath(redirect) {
+		return "/"
+	}
+	return redirect
+}
+
+// isLocalPath tells if browsers resolve the location to a path on this server. Browsers drop tabs and
+// newlines from urls and treat \ like /, so /%09/evil.com would lead to //evil.com, locations with
+// whitespace or control characters are refused as well.
+func isLocalPath(location string) bool {
+	if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") || strings.HasPrefix(location, "/\\") {
+		return false
+	}
+	if strings.IndexFunc(location, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return false
+	}
+	parsed, err := url.Parse(location)
+	return err == nil && parsed.Scheme == "" && parsed.Host == ""
+}
+
+// newPreviewHandler serves the preview links at the path. ?token=<token> sets the preview cookie, ?clear
+// removes it, both redirect to the path in the redirect parameter or to /.
+func newPreviewHandler(path string, previews []preview, trustedProxyHops int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeProblem(w, req, http.StatusMethodNotAllowed, "preview links must be opened with GET")
+			return
+		}
+		query := req.URL.Query()
+		cookie := &http.Cookie{
+			Name:     previewCookieName,
+			Path:     "/",
+			Secure:   isHTTPS(req, trustedProxyHops),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		if query.Has("clear") {
+			cookie.MaxAge = -1
+		} else if _, found := previewForToken(previews, query.Get("token")); found {
+			cookie.Value = query.Get("token")
+			cookie.MaxAge = previewCookieMaxAge
+		} else {
+			writeProblem(w, req, http.StatusForbidden, "unknown preview token")
+			return
+		}
+		http.SetCookie(w, cookie)
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, req, localRedirect(query.Get("redirect")), http.StatusFound)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		redirect string
+		want     string
+	}{
+		{"/orders?id=1#top", "/orders?id=1#top"},
+		{"", "/"},
+		{"https://evil.com", "/"},
+		{"//evil.com", "/"},
+		{"/\\evil.com", "/"},
+		{"/\t/evil.com", "/"},
+		{"/\n/evil.com", "/"},
+		{"/\r/evil.com", "/"},
+		{"/ /evil.com", "/"},
+		{"/\x00/evil.com", "/"},
+		{"orders", "/"},
+	}
+	for _, test := range tests {
+		if got := localRedirect(test.redirect); got != test.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", test.redirect, got, test.want)
+		}
+	}
+}
+
+func TestPreviewCookieSecure(t *testing.T) {
+	previews := []preview{{Name: "checkout-v2", Token: "0123456789abcdef"}}
+	tests := []struct {
+		name             string
+		trustedProxyHops int
+		forwardedProto   string
+		secure           bool
+	}{
+		{"plain http", 0, "", false},
+		{"forwarded https from a trusted proxy", 1, "https", true},
+		{"forwarded https without trusted proxies", 0, "https", false},
+		{"forwarded http from a trusted proxy", 1, "http", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newPreviewHandler("/__preview", previews, test.trustedProxyHops, http.NotFoundHandler())
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/__preview?token=0123456789abcdef", nil)
+			if test.forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("%d cookies set, want 1", len(cookies))
+			}
+			if cookies[0].Secure != test.secure {
+				t.Errorf("Secure = %v, want %v", cookies[0].Secure, test.secure)
+			}
+		})
+	}
+}
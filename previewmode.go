@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const previewRobots = "User-agent: *\nDisallow: /\n"
+const previewShareCookieName = "spa-preview-share"
+const previewShareDefaultTTL = 24 * time.Hour
+
+// injectPreviewBanner adds a fixed banner with the text to the top of the body of the html document, so
+// nobody mistakes a preview deployment for production. The style element receives the CSP nonce like the
+// other styles of the document.
+func injectPreviewBanner(document []byte, text string) []byte {
+	banner := fmt.Sprintf(`<style>.spa-preview-banner{position:fixed;top:0;left:0;right:0;z-index:2147483647;`+
+		`padding:2px 8px;background:#b45309;color:#fff;font:12px/1.5 sans-serif;text-align:center;pointer-events:none}</style>`+
+		`<div class="spa-preview-banner">%s</div>`, html.EscapeString(text))
+	index := bytes.Index(document, []byte("<body"))
+	if index < 0 {
+		return append(append([]byte{}, document...), banner...)
+	}
+	end := bytes.IndexByte(document[index:], '>')
+	if end < 0 {
+		return append(append([]byte{}, document...), banner...)
+	}
+	end += index + 1
+	result := make([]byte, 0, len(document)+len(banner))
+	result = append(result, document[:end]...)
+	result = append(result, banner...)
+	return append(result, document[end:]...)
+}
+
+// previewShares signs expiring share links of a protected preview deployment. The token of a link is its
+// expiry and a signature of it, so the links need no storage and all of them end with a new secret.
+type previewShares struct {
+	secret []byte
+	path   string
+	maxTTL time.Duration
+	// trustedProxyHops trusts X-Forwarded-Proto for the scheme of the links and the cookie
+	trustedProxyHops int
+}
+
+func newPreviewShares(secret string, path string, maxTTL time.Duration, trustedProxyHops int) (*previewShares, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("share link secret must have at least 32 characters")
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("share link path %q must start with /", path)
+	}
+	return &previewShares{secret: []byte(secret), path: path, maxTTL: maxTTL, trustedProxyHops: trustedProxyHops}, nil
+}
+
+func (s *previewShares) sign(expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "preview-share:%d", expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *previewShares) token(expires time.Time) string {
+	return fmt.Sprintf("%d.%s", expires.Unix(), s.sign(expires.Unix()))
+}
+
+// verify returns the expiry of the token if it was signed with the secret and has not expired yet.
+func (s *previewShares) verify(token string, now time.Time) (time.Time, bool) {
+	expiresText, signature, found := strings.Cut(token, ".")
+	if !found {
+		return time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(expiresText, 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(s.sign(expires))) {
+		return time.Time{}, false
+	}
+	return time.Unix(expires, 0), now.Unix() < expires
+}
+
+// allowed tells if the share cookie of the request holds a valid token.
+func (s *previewShares) allowed(req *http.Request) bool {
+	cookie, err := req.Cookie(previewShareCookieName)
+	if err != nil {
+		return false
+	}
+	_, valid := s.verify(cookie.Value, time.Now())
+	return valid
+}
+
+// open sets the share cookie of a valid share link until the link expires and redirects to the page the
+// link points to.
+func (s *previewShares) open(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	token := query.Get("token")
+	expires, valid := s.verify(token, time.Now())
+	if !valid {
+		writeProblem(w, req, http.StatusForbidden, "the share link is invalid or has expired")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     previewShareCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   isHTTPS(req, s.trustedProxyHops),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, req, localRedirect(query.Get("redirect")), http.StatusFound)
+}
+
+// create answers with a new share link for the page in the redirect parameter, valid for the hours
+// parameter, 24 hours by default and at most the maximum of the links.
+func (s *previewShares) create(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	ttl := previewShareDefaultTTL
+	if hours := query.Get("hours"); hours != "" {
+		value, err := strconv.ParseUint(hours, 10, 32)
+		if err != nil || value == 0 {
+			writeProblem(w, req, http.StatusBadRequest, "hours must be a positive number")
+			return
+		}
+		ttl = time.Duration(value) * time.Hour
+	}
+	ttl = min(ttl, s.maxTTL)
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+
+	scheme := "http"
+	if isHTTPS(req, s.trustedProxyHops) {
+		scheme = "https"
+	}
+	link := url.URL{
+		Scheme:   scheme,
+		Host:     req.Host,
+		Path:     s.path,
+		RawQuery: url.Values{"token": {s.token(expires)}, "redirect": {localRedirect(query.Get("redirect"))}}.Encode(),
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	// the link is meant to be copied, so its & stays readable
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{link.String(), expires.UTC()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", fmt.Sprint(body.Len()))
+	_, _ = w.Write(body.Bytes())
+}
+
+// newPreviewModeHandler keeps a preview deployment out of search engines and, with a password gate, away
+// from the public. Every response carries X-Robots-Tag: noindex and robots.txt disallows all crawling, before
+// the credentials are checked so crawlers learn to stay away. Without a gate the deployment stays public.
+// With share links, GET requests to their path with credentials create a link, and opening a link lets
+// its visitors in without credentials until it expires.
+func newPreviewModeHandler(gate *basicAuthGate, shares *previewShares, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		if req.URL.Path == "/robots.txt" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Length", fmt.Sprint(len(previewRobots)))
+			if req.Method != http.MethodHead {
+				_, _ = w.Write([]byte(previewRobots))
+			}
+			return
+		}
+		if shares != nil && req.URL.Path == shares.path && req.URL.Query().Has("token") {
+			if req.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeProblem(w, req, http.StatusMethodNotAllowed, "share links must be opened with GET")
+				return
+			}
+			shares.open(w, req)
+			return
+		}
+		if gate != nil && (shares == nil || req.URL.Path == shares.path || !shares.allowed(req)) && !gate.authorize(w, req) {
+			return
+		}
+		if shares != nil && req.URL.Path == shares.path {
+			if req.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeProblem(w, req, http.StatusMethodNotAllowed, "share links must be created with GET")
+				return
+			}
+			shares.create(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
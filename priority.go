@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var scriptSourcePattern = regexp.MustCompile(`<script[^>]*\ssrc=["']([^"']+)["']`)
+var linkPattern = regexp.MustCompile(`<link[^>]*>`)
+var linkRelPattern = regexp.MustCompile(`\srel=["']?(stylesheet|preload|modulepreload)["'\s>]`)
+var linkHrefPattern = regexp.MustCompile(`\shref=["']([^"']+)["']`)
+
+// criticalAssets returns the paths of the scripts and stylesheets index.html loads or preloads, which are
+// needed to render the shell of the SPA. Assets of other origins are ignored.
+func criticalAssets(index []byte) map[string]bool {
+	var references []string
+	for _, match := range scriptSourcePattern.FindAllSubmatch(index, -1) {
+		references = append(references, string(match[1]))
+	}
+	for _, link := range linkPattern.FindAll(index, -1) {
+		if !linkRelPattern.Match(link) {
+			continue
+		}
+		if match := linkHrefPattern.FindSubmatch(link); match != nil {
+			references = append(references, string(match[1]))
+		}
+	}
+
+	critical := make(map[string]bool, len(references))
+	for _, reference := range references {
+		u, err := url.Parse(reference)
+		if err != nil || u.Scheme != "" || u.Host != "" {
+			continue
+		}
+		critical["/"+strings.TrimPrefix(strings.TrimPrefix(u.Path, "./"), "/")] = true
+	}
+	return critical
+}
+
+// priorityHint returns the value of the Priority header (RFC 9218) of a response, so intermediaries and
+// constrained connections deliver the shell first. Empty means the default priority.
+func priorityHint(critical map[string]bool, path string, html bool) string {
+	switch {
+	case html:
+		return "u=0"
+	case critical[path]:
+		return "u=1"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// problem is an RFC 7807 problem details body, so the SPA and monitoring parse failures of the api-style
+// endpoints consistently.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance"`
+	RequestID string `json:"requestId"`
+}
+
+// requestID returns the id the client or a proxy assigned to the request, or a new random one.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// writeProblem answers the request with an application/problem+json body for the status and returns the
+// request id, to correlate logs with the response.
+func writeProblem(w http.ResponseWriter, req *http.Request, status int, detail string) string {
+	id := requestID(req)
+	body, _ := json.Marshal(problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  req.URL.Path,
+		RequestID: id,
+	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.Header().Set("X-Request-Id", id)
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	return id
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyRule forwards all requests with paths starting with the prefix to the target, e.g. the api of the
+// SPA, so no additional reverse proxy is needed in front of the server. Responses of streaming rules are
+// flushed right away and exempt from the write timeout, e.g. for long polling or ndjson streams.
+type proxyRule struct {
+	prefix string
+	target *url.URL
+	stream bool
+	proxy  *httputil.ReverseProxy
+	// upgrades forwards protocol upgrades, e.g. websockets, each over its own connection to the target
+	upgrades *httputil.ReverseProxy
+}
+
+// parseProxyRules parses the comma separated rules of the form prefix=>target, e.g. /api/=>http://backend:3000,
+// optionally followed by ;stream for streaming rules, e.g. /api/feed/=>http://backend:3000;stream. Upgraded connections are closed after upgradeIdleTimeout without traffic, zero keeps them open until one
+// of the sides closes them.
+func parseProxyRules(list string, upgradeIdleTimeout time.Duration) ([]proxyRule, error) {
+	var rules []proxyRule
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, target, found := strings.Cut(entry, "=>")
+		if !found {
+			return nil, fmt.Errorf("proxy rule %q must be of the form prefix=>target", entry)
+		}
+		prefix = strings.TrimSpace(prefix)
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("proxy rule prefix %q must start with /", prefix)
+		}
+		target, options, _ := strings.Cut(target, ";")
+		stream := false
+		for _, option := range strings.Split(options, ";") {
+			switch strings.TrimSpace(option) {
+			case "":
+			case "stream":
+				stream = true
+			default:
+				return nil, fmt.Errorf("unknown option %q of proxy rule %q", option, entry)
+			}
+		}
+		targetURL, err := url.Parse(strings.TrimSpace(target))
+		if err != nil {
+			return nil, err
+		}
+		if (targetURL.Scheme != "http" && targetURL.Scheme != "https") || targetURL.Host == "" {
+			return nil, fmt.Errorf("proxy rule target %q must be a http(s) url", target)
+		}
+		rules = append(rules, proxyRule{
+			prefix:   prefix,
+			target:   targetURL,
+			stream:   stream,
+			proxy:    newReverseProxy(targetURL, http.DefaultTransport, stream),
+			upgrades: newReverseProxy(targetURL, newUpgradeTransport(upgradeIdleTimeout), false),
+		})
+	}
+	return rules, nil
+}
+
+type responseControllerKey struct{}
+
+// newReverseProxy forwards the requests with their full path appended to the path of the target. The
+// responses of streaming proxies are flushed after every write. Server-sent events are always flushed right
+// away by httputil.ReverseProxy, and they are exempt from the write timeout like streaming responses.
+func newReverseProxy(target *url.URL, transport http.RoundTripper, stream bool) *httputil.ReverseProxy {
+	var flushInterval time.Duration
+	if stream {
+		flushInterval = -1
+	}
+	return &httputil.ReverseProxy{
+		Transport:     transport,
+		FlushInterval: flushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if mediaType != "text/event-stream" {
+				return nil
+			}
+			if controller, found := resp.Request.Context().Value(responseControllerKey{}).(*http.ResponseController); found {
+				_ = controller.SetWriteDeadline(time.Time{})
+			}
+			return nil
+		},
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			// the host of the target replaces the original one, which is passed in X-Forwarded-Host
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if req.Context().Err() != nil {
+				// the client went away while waiting for the backend
+				return
+			}
+			id := writeProblem(w, req, http.StatusBadGateway, "the backend could not be reached")
+			slog.Error("Could not proxy request", "path", req.URL.Path, "target", target.Redacted(), "requestId", id, "err", err)
+		},
+	}
+}
+
+// idleTimeoutConn closes the connection when no data was read or written for the timeout.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// newUpgradeTransport dials a new connection to the target for every upgrade. The proxy copies the data
+// of both directions through the connection to the target, so its idle timeout covers both of them.
+func newUpgradeTransport(idleTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	if idleTimeout > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+		}
+	}
+	return transport
+}
+
+// isUpgrade tells if the client asks to switch the protocol of the connection, e.g. to a websocket.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// proxyPrefixes returns the prefixes of the rules.
+func proxyPrefixes(rules []proxyRule) []string {
+	prefixes := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		prefixes = append(prefixes, rule.prefix)
+	}
+	return prefixes
+}
+
+// newProxyHandler forwards requests matching the first rule with a prefix of the path to its target,
+// including protocol upgrades like websockets, all other requests are passed to the next handler.
+func newProxyHandler(rules []proxyRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rule := range rules {
+			if !strings.HasPrefix(req.URL.Path, rule.prefix) {
+				continue
+			}
+			if isUpgrade(req) {
+				// the read and write timeouts of the server would cut the upgraded connection
+				controller := http.NewResponseController(w)
+				_ = controller.SetReadDeadline(time.Time{})
+				_ = controller.SetWriteDeadline(time.Time{})
+				rule.upgrades.ServeHTTP(w, req)
+				return
+			}
+			controller := http.NewResponseController(w)
+			if rule.stream {
+				_ = controller.SetWriteDeadline(time.Time{})
+			}
+			// lets the proxy clear the write deadline once the response turns out to be an event stream
+			rule.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), responseControllerKey{}, controller)))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byteRange is an inclusive range of bytes of a file.
+type byteRange struct {
+	start int
+	end   int
+}
+
+// parseRange parses a Range header with a single byte range for content of the size. Headers with
+// several ranges or other units are not supported and served in full. The second result tells if the
+// range is satisfiable.
+func parseRange(header string, size int) (*byteRange, bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return nil, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return nil, true
+	}
+	if first == "" {
+		// a suffix range, the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return nil, true
+		}
+		if n == 0 || size == 0 {
+			return nil, false
+		}
+		if n > size {
+			n = size
+		}
+		return &byteRange{size - n, size - 1}, true
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return nil, true
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return nil, true
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return nil, false
+	}
+	return &byteRange{start, end}, true
+}
+
+// rangeApplies tells if the If-Range header of the request, if any, still matches the etag or the
+// modification time of the content, so a partial response fits the content the client has already.
+func rangeApplies(req *http.Request, etag string, modified time.Time) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == etag
+	}
+	since, err := http.ParseTime(ifRange)
+	return err == nil && modified.Truncate(time.Second).Equal(since)
+}
+
+// writeRangeNotSatisfiable answers with a 416 and the size of the selected representation. The plain text
+// body is neither compressed nor the file, so the headers describing the file are removed.
+func writeRangeNotSatisfiable(w http.ResponseWriter, size int) {
+	for _, name := range []string{"Content-Encoding", "Content-Disposition", "ETag", "Last-Modified", "Priority"} {
+		w.Header().Del(name)
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimitRedisTimeout bounds the round trip to Redis, a slower Redis falls back to the local buckets.
+const rateLimitRedisTimeout = 100 * time.Millisecond
+
+// redisTokenBucket takes a token from the bucket at KEYS[1], shared by all replicas, after refilling it for
+// the time since its last update. ARGV are the capacity, the milliseconds per token and the time in
+// milliseconds. It returns whether the token was taken and else the milliseconds until the next token.
+var redisTokenBucket = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local perToken = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or capacity
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) / perToken)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * perToken)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity * perToken))
+if wait > 0 then
+	return {0, wait}
+end
+return {1, 0}
+`)
+
+// rateLimitRoute limits the requests of every client to the paths starting with the prefix, e.g. the events
+// collector or /config.json, to Requests per Seconds. The routes have separate budgets, so abuse of a
+// dynamic endpoint never throttles the assets.
+type rateLimitRoute struct {
+	Prefix   string `json:"prefix"`
+	Requests uint64 `json:"requests"`
+	Seconds  uint64 `json:"seconds"`
+}
+
+func parseRateLimitRoutes(routesJSON string) ([]rateLimitRoute, error) {
+	var routes []rateLimitRoute
+	err := json.Unmarshal([]byte(routesJSON), &routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("rate limit route prefix %q must start with /", route.Prefix)
+		}
+		if route.Requests == 0 || route.Seconds == 0 {
+			return nil, fmt.Errorf("rate limit route %q needs requests and seconds", route.Prefix)
+		}
+	}
+	return routes, nil
+}
+
+// tokenBucket holds the requests a client may still issue, refilled continuously up to the limit.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a token bucket per route and client. Buckets that refilled completely are dropped,
+// so the memory is bounded by the clients active within the longest period. With Redis the buckets are
+// shared by all replicas, the local buckets only stand in while Redis is unavailable.
+type rateLimiter struct {
+	routes           []rateLimitRoute
+	trustedProxyHops int
+	redis            *redis.Client
+	redisPrefix      string
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	// redisFailed is the time the last Redis failure was logged, so an outage is not logged per request
+	redisFailed time.Time
+}
+
+func newRateLimiter(routes []rateLimitRoute, trustedProxyHops int) *rateLimiter {
+	return &rateLimiter{
+		routes:           routes,
+		trustedProxyHops: trustedProxyHops,
+		buckets:          make(map[string]*tokenBucket),
+		swept:            time.Now(),
+	}
+}
+
+// useRedis shares the buckets through the Redis of the url, e.g. redis://:password@redis:6379/0, under
+// keys starting with the prefix.
+func (l *rateLimiter) useRedis(redisURL string, prefix string) error {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return err
+	}
+	l.redis = redis.NewClient(options)
+	l.redisPrefix = prefix
+	return nil
+}
+
+// take takes a token for the client from the shared bucket in Redis, or from the local one if there is
+// no Redis or it failed.
+func (l *rateLimiter) take(ctx context.Context, route rateLimitRoute, client string, now time.Time) (bool, time.Duration) {
+	if l.redis == nil {
+		return l.allow(route, client, now)
+	}
+	ctx, cancel := context.WithTimeout(ctx, rateLimitRedisTimeout)
+	defer cancel()
+	perToken := float64(route.Seconds) * 1000 / float64(route.Requests)
+	result, err := redisTokenBucket.Run(ctx, l.redis, []string{l.redisPrefix + route.Prefix + " " + client},
+		route.Requests, perToken, now.UnixMilli()).Int64Slice()
+	if err == nil && len(result) == 2 {
+		return result[0] == 1, time.Duration(result[1]) * time.Millisecond
+	}
+	l.mutex.Lock()
+	if now.Sub(l.redisFailed) > time.Minute {
+		l.redisFailed = now
+		slog.Warn("Could not rate limit with Redis, limiting per replica", "err", err)
+	}
+	l.mutex.Unlock()
+	return l.allow(route, client, now)
+}
+
+// allow takes a token from the bucket of the client for the route, or returns the time until the next
+// token is available.
+func (l *rateLimiter) allow(route rateLimitRoute, client string, now time.Time) (bool, time.Duration) {
+	capacity := float64(route.Requests)
+	perToken := time.Duration(route.Seconds) * time.Second / time.Duration(route.Requests)
+	key := route.Prefix + " " + client
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+float64(now.Sub(bucket.updated))/float64(perToken))
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(perToken))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that were not used for longer than the longest period, at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	var longest time.Duration
+	for _, route := range l.routes {
+		longest = max(longest, time.Duration(route.Seconds)*time.Second)
+	}
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) > longest {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// handler answers requests exceeding the limit of the first matching route with a 429, requests of paths
+// without a route are not limited.
+func (l *rateLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, route := range l.routes {
+			if !strings.HasPrefix(req.URL.Path, route.Prefix) {
+				continue
+			}
+			allowed, retryAfter := l.take(req.Context(), route, clientIP(req, l.trustedProxyHops), time.Now())
+			if !allowed {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+				writeProblem(w, req, http.StatusTooManyRequests, "Too many requests, please try again later.")
+				return
+			}
+			break
+		}
+		next.ServeHTTP(w, req)
+	})
+}
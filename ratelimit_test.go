@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRateLimitSharedThroughRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	route := rateLimitRoute{Prefix: "/config.json", Requests: 2, Seconds: 60}
+	replica := func() *rateLimiter {
+		limiter := newRateLimiter([]rateLimitRoute{route}, 0)
+		if err := limiter.useRedis("redis://"+server.Addr(), "spa-server:ratelimit:"); err != nil {
+			t.Fatal(err)
+		}
+		return limiter
+	}
+	a, b := replica(), replica()
+	now := time.Now()
+
+	if allowed, _ := a.take(context.Background(), route, "192.0.2.1", now); !allowed {
+		t.Fatalf("the first request was limited")
+	}
+	if allowed, _ := b.take(context.Background(), route, "192.0.2.1", now); !allowed {
+		t.Fatalf("the second request was limited")
+	}
+	// the budget is used up on both replicas
+	allowed, retryAfter := a.take(context.Background(), route, "192.0.2.1", now)
+	if allowed || retryAfter != 30*time.Second {
+		t.Errorf("third request allowed = %v, retry after %v, want limited for 30s", allowed, retryAfter)
+	}
+	if allowed, _ := b.take(context.Background(), route, "192.0.2.2", now); !allowed {
+		t.Errorf("another client was limited")
+	}
+	if allowed, _ := b.take(context.Background(), route, "192.0.2.1", now.Add(30*time.Second)); !allowed {
+		t.Errorf("the refilled token was not taken")
+	}
+
+	// without Redis every replica limits on its own
+	server.Close()
+	for i := 0; i < 2; i++ {
+		if allowed, _ := a.take(context.Background(), route, "192.0.2.1", now); !allowed {
+			t.Fatalf("request %d was limited while Redis is down", i+1)
+		}
+	}
+	if allowed, _ := a.take(context.Background(), route, "192.0.2.1", now); allowed {
+		t.Errorf("the local limit does not apply while Redis is down")
+	}
+}
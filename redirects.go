@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// redirectRule redirects requests for the host, any host if empty, whose path matches From to To. A From
+// ending with * matches all paths with the prefix before it, and the rest of the path replaces the * at
+// the end of To, e.g. /old-app/* to /new-app/*. To is a path or an absolute url, e.g. for canonical hosts.
+type redirectRule struct {
+	Host   string `json:"host,omitempty"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status"`
+}
+
+func parseRedirectRules(rulesJSON string) ([]redirectRule, error) {
+	var rules []redirectRule
+	err := json.Unmarshal([]byte(rulesJSON), &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if rule.From == "" && rule.Host != "" {
+			rules[i].From = "/*"
+		}
+		if !strings.HasPrefix(rules[i].From, "/") {
+			return nil, fmt.Errorf("redirect rule from %q must start with /", rule.From)
+		}
+		if strings.Contains(strings.TrimSuffix(rules[i].From, "*"), "*") {
+			return nil, fmt.Errorf("redirect rule from %q may only end with *", rule.From)
+		}
+		target, err := url.Parse(rule.To)
+		if err != nil {
+			return nil, fmt.Errorf("redirect rule to %q is invalid: %w", rule.To, err)
+		}
+		if !strings.HasPrefix(rule.To, "/") && (target.Scheme != "http" && target.Scheme != "https" || target.Host == "") {
+			return nil, fmt.Errorf("redirect rule to %q must be a path or a http(s) url", rule.To)
+		}
+		if strings.HasSuffix(rule.To, "*") && !strings.HasSuffix(rules[i].From, "*") {
+			return nil, fmt.Errorf("redirect rule to %q ends with * but from %q does not", rule.To, rules[i].From)
+		}
+		switch rule.Status {
+		case 0:
+			rules[i].Status = http.StatusMovedPermanently
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("redirect rule status %d must be one of 301, 302, 303, 307 or 308", rule.Status)
+		}
+	}
+	return rules, nil
+}
+
+// target returns the location a request for the host and path is redirected to, if the rule matches it.
+func (r redirectRule) target(host string, path string) (string, bool) {
+	if r.Host != "" {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if !strings.EqualFold(host, r.Host) {
+			return "", false
+		}
+	}
+	prefix, wildcard := strings.CutSuffix(r.From, "*")
+	if !wildcard {
+		return r.To, path == r.From
+	}
+	rest, found := strings.CutPrefix(path, prefix)
+	if !found {
+		return "", false
+	}
+	if to, replaced := strings.CutSuffix(r.To, "*"); replaced {
+		return to + rest, true
+	}
+	return r.To, true
+}
+
+// staysOnTarget tells if browsers resolve the location to the site of To. The rest of the path replacing
+// the * may turn a path into //evil.com or add a user info or host to an url, such locations are refused.
+func (r redirectRule) staysOnTarget(location string) bool {
+	if strings.HasPrefix(r.To, "/") {
+		return isLocalPath(location)
+	}
+	if strings.IndexFunc(location, func(c rune) bool { return unicode.IsSpace(c) || unicode.IsControl(c) }) >= 0 {
+		return false
+	}
+	target, err := url.Parse(strings.TrimSuffix(r.To, "*"))
+	if err != nil {
+		return false
+	}
+	parsed, err := url.Parse(location)
+	return err == nil && parsed.User == nil && strings.EqualFold(parsed.Scheme, target.Scheme) && strings.EqualFold(parsed.Host, target.Host)
+}
+
+// newRedirectHandler redirects the requests matching the first matching rule before any file is looked up,
+// keeping their query. Requests whose location would lead to another site are refused with 400. All other
+// requests are passed to the next handler.
+func newRedirectHandler(rules []redirectRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rule := range rules {
+			if location, found := rule.target(req.Host, req.URL.Path); found {
+				if !rule.staysOnTarget(location) {
+					writeProblem(w, req, http.StatusBadRequest, "the redirect location leads to another site")
+					return
+				}
+				if req.URL.RawQuery != "" && strings.Contains(location, "?") {
+					location += "&" + req.URL.RawQuery
+				} else if req.URL.RawQuery != "" {
+					location += "?" + req.URL.RawQuery
+				}
+				http.Redirect(w, req, location, rule.Status)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
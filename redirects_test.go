@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectRulesStayOnTarget(t *testing.T) {
+	handler := newTestServer(t, map[string]string{
+		"REDIRECTS": `[{"from":"/old/*","to":"/*"},{"from":"/docs/*","to":"https://docs.example.com/*"},{"from":"/blog*","to":"https://blog.example.com*"}]`,
+	})
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/old/orders?id=1", http.StatusMovedPermanently, "/orders?id=1"},
+		{"/old//evil.com", http.StatusBadRequest, ""},
+		{"/old/\\evil.com", http.StatusBadRequest, ""},
+		{"/old/%09/evil.com", http.StatusBadRequest, ""},
+		{"/docs/guide", http.StatusMovedPermanently, "https://docs.example.com/guide"},
+		{"/docs//evil.com", http.StatusMovedPermanently, "https://docs.example.com//evil.com"},
+		{"/blog/post", http.StatusMovedPermanently, "https://blog.example.com/post"},
+		{"/blog@evil.com/", http.StatusBadRequest, ""},
+		{"/blog.evil.com/", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("status = %d, want %d", rec.Code, test.status)
+			}
+			if location := rec.Header().Get("Location"); location != test.location {
+				t.Errorf("Location = %q, want %q", location, test.location)
+			}
+		})
+	}
+}
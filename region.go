@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// withRegion adds the region and zone the server runs in to the runtime config under the key "serving",
+// so the SPA can prefer region-local API endpoints.
+func withRegion(config []byte, region string, zone string) ([]byte, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(config, &doc)
+	if err != nil {
+		return nil, err
+	}
+	serving := make(map[string]interface{})
+	if region != "" {
+		serving["region"] = region
+	}
+	if zone != "" {
+		serving["zone"] = zone
+	}
+	mergeJSON(doc, map[string]interface{}{"serving": serving})
+	return json.Marshal(doc)
+}
+
+// newRegionHandler announces the region and zone of the server in the headers of every response.
+func newRegionHandler(region string, zone string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if region != "" {
+			w.Header().Set("X-Served-Region", region)
+		}
+		if zone != "" {
+			w.Header().Set("X-Served-Zone", zone)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+const remoteMaxBytes = 20 << 20
+const remoteMaxCacheEntries = 1000
+const remoteDefaultTimeout = 30 * time.Second
+
+// remote serves the files of a micro-frontend from another origin under the local prefix, so
+// module-federated apps avoid CORS and third-party cookie issues. It also caches documents of other
+// services, e.g. the OIDC discovery document and JWKS of an identity provider. For StaleSeconds after a
+// cached file expired, it is served right away and refreshed in the background, and while the refresh
+// fails the cached file keeps being served.
+type remote struct {
+	Prefix         string            `json:"prefix"`
+	Target         string            `json:"target"`
+	CacheSeconds   uint64            `json:"cacheSeconds"`
+	StaleSeconds   uint64            `json:"staleSeconds"`
+	TimeoutSeconds uint64            `json:"timeoutSeconds"`
+	Integrity      map[string]string `json:"integrity"`
+}
+
+// timeout is the deadline of a fetch from the remote.
+func (r remote) timeout() time.Duration {
+	if r.TimeoutSeconds == 0 {
+		return remoteDefaultTimeout
+	}
+	return time.Duration(r.TimeoutSeconds) * time.Second
+}
+
+type remoteResponse struct {
+	body        []byte
+	contentType string
+	expires     time.Time
+}
+
+type remoteProxy struct {
+	remotes []remote
+	client  *http.Client
+	// staleResponses and refreshFailures show how long an outage of a remote is bridged by the cache
+	staleResponses  *prometheus.CounterVec
+	refreshFailures *prometheus.CounterVec
+
+	mutex sync.Mutex
+	cache map[string]remoteResponse
+	// loads coalesces simultaneous fetches of the same uncached file into a single request to the remote
+	loads singleflight.Group
+}
+
+func parseRemotes(remotesJSON string) ([]remote, error) {
+	var remotes []remote
+	err := json.Unmarshal([]byte(remotesJSON), &remotes)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range remotes {
+		if !strings.HasPrefix(r.Prefix, "/") || !strings.HasSuffix(r.Prefix, "/") {
+			return nil, fmt.Errorf("remote prefix %q must start and end with /", r.Prefix)
+		}
+		if !strings.HasPrefix(r.Target, "http://") && !strings.HasPrefix(r.Target, "https://") {
+			return nil, fmt.Errorf("remote target %q must be a http(s) url", r.Target)
+		}
+		remotes[i].Target = strings.TrimRight(r.Target, "/")
+	}
+	return remotes, nil
+}
+
+func newRemoteProxy(remotes []remote) *remoteProxy {
+	return &remoteProxy{
+		remotes: remotes,
+		client:  &http.Client{},
+		staleResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spa_remote_stale_responses_total",
+			Help: "Number of expired cached files of remotes served while refreshing them.",
+		}, []string{"prefix"}),
+		refreshFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "spa_remote_refresh_failures_total",
+			Help: "Number of failed background refreshes of cached files of remotes.",
+		}, []string{"prefix"}),
+		cache: make(map[string]remoteResponse),
+	}
+}
+
+// verifyIntegrity checks the body against a subresource integrity value like "sha384-<base64>".
+func verifyIntegrity(body []byte, integrity string) error {
+	algorithm, expected, _ := strings.Cut(integrity, "-")
+	var actual []byte
+	switch algorithm {
+	case "sha256":
+		hash := sha256.Sum256(body)
+		actual = hash[:]
+	case "sha384":
+		hash := sha512.Sum384(body)
+		actual = hash[:]
+	case "sha512":
+		hash := sha512.Sum512(body)
+		actual = hash[:]
+	default:
+		return fmt.Errorf("unsupported integrity algorithm %q", algorithm)
+	}
+	if base64.StdEncoding.EncodeToString(actual) != expected {
+		return fmt.Errorf("integrity check failed, expected %s", integrity)
+	}
+	return nil
+}
+
+// fetch returns the file from the cache or the remote. The fetch from the remote is shared by all
+// requests of the file and bounded by the timeout of the remote, while each request only waits until its
+// own context is done.
+func (p *remoteProxy) fetch(ctx context.Context, r remote, path string, query string) (remoteResponse, error) {
+	target := r.Target + path
+	if query != "" {
+		target += "?" + query
+	}
+	p.mutex.Lock()
+	cached, found := p.cache[target]
+	p.mutex.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+	if found && time.Now().Before(cached.expires.Add(time.Duration(r.StaleSeconds)*time.Second)) {
+		p.staleResponses.WithLabelValues(r.Prefix).Inc()
+		go p.refresh(context.WithoutCancel(ctx), r, path, target)
+		return cached, nil
+	}
+
+	loaded := p.loads.DoChan(target, func() (interface{}, error) {
+		// the fetch is shared, so it must not end with the request that started it
+		return p.load(context.WithoutCancel(ctx), r, path, target, found)
+	})
+	select {
+	case result := <-loaded:
+		if result.Err != nil {
+			return remoteResponse{}, result.Err
+		}
+		return result.Val.(remoteResponse), nil
+	case <-ctx.Done():
+		return remoteResponse{}, ctx.Err()
+	}
+}
+
+// refresh replaces the cached file with the current one of the remote, requests meanwhile are served
+// from the cache.
+func (p *remoteProxy) refresh(ctx context.Context, r remote, path string, target string) {
+	_, err, shared := p.loads.Do(target, func() (interface{}, error) {
+		return p.load(ctx, r, path, target, true)
+	})
+	if err != nil && !shared {
+		p.refreshFailures.WithLabelValues(r.Prefix).Inc()
+		slog.Warn("Could not refresh file from remote, serving the cached one", "target", target, "err", err)
+	}
+}
+
+// load fetches the file from the remote within the timeout of the remote.
+func (p *remoteProxy) load(ctx context.Context, r remote, path string, target string, found bool) (remoteResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return remoteResponse{}, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return remoteResponse{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return remoteResponse{}, fmt.Errorf("remote responded with status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxBytes+1))
+	if err != nil {
+		return remoteResponse{}, err
+	}
+	if len(body) > remoteMaxBytes {
+		return remoteResponse{}, fmt.Errorf("remote response exceeds %d bytes", remoteMaxBytes)
+	}
+	if integrity, found := r.Integrity[path]; found {
+		err = verifyIntegrity(body, integrity)
+		if err != nil {
+			return remoteResponse{}, err
+		}
+	}
+
+	response := remoteResponse{
+		body:        body,
+		contentType: resp.Header.Get("Content-Type"),
+		expires:     time.Now().Add(time.Duration(r.CacheSeconds) * time.Second),
+	}
+	if r.CacheSeconds > 0 {
+		p.mutex.Lock()
+		if len(p.cache) < remoteMaxCacheEntries || found {
+			p.cache[target] = response
+		}
+		p.mutex.Unlock()
+	}
+	return response, nil
+}
+
+// handler serves GET and HEAD requests below the prefix of a remote from the remote, all other requests
+// are passed to the next handler.
+func (p *remoteProxy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range p.remotes {
+			if !strings.HasPrefix(req.URL.Path, r.Prefix) {
+				continue
+			}
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				w.Header().Set("Allow", "GET, HEAD")
+				writeProblem(w, req, http.StatusMethodNotAllowed, "remotes only serve GET and HEAD requests")
+				return
+			}
+			response, err := p.fetch(req.Context(), r, "/"+strings.TrimPrefix(req.URL.Path, r.Prefix), req.URL.RawQuery)
+			if err != nil && req.Context().Err() != nil {
+				// the client went away while waiting for the remote
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				id := writeProblem(w, req, http.StatusGatewayTimeout, "the remote did not respond in time")
+				slog.Error("Could not fetch file from remote in time", "path", req.URL.Path, "requestId", id, "timeout", r.timeout())
+				return
+			}
+			if err != nil {
+				id := writeProblem(w, req, http.StatusBadGateway, "the file could not be fetched from the remote")
+				slog.Error("Could not fetch file from remote", "path", req.URL.Path, "requestId", id, "err", err)
+				return
+			}
+			w.Header().Set("Content-Type", response.contentType)
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", r.CacheSeconds))
+			w.Header().Set("Content-Length", fmt.Sprint(len(response.body)))
+			if req.Method == http.MethodGet {
+				_, _ = w.Write(response.body)
+			}
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// remoteTransport sends the GET requests of a client through the cache of the remote proxy, so the
+// documents the client fetches stay available during short outages of their origin. The settings of the
+// remote apply to every origin the client fetches from, the prefix labels the metrics.
+type remoteTransport struct {
+	proxy *remoteProxy
+	remote
+	next http.RoundTripper
+}
+
+// transport returns a transport caching the GET requests like the files of the remote, other requests are
+// sent right away.
+func (p *remoteProxy) transport(r remote) http.RoundTripper {
+	return remoteTransport{proxy: p, remote: r, next: http.DefaultTransport}
+}
+
+func (t remoteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+	r := t.remote
+	r.Target = req.URL.Scheme + "://" + req.URL.Host
+	response, err := t.proxy.fetch(req.Context(), r, req.URL.EscapedPath(), req.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {response.contentType}},
+		Body:          io.NopCloser(bytes.NewReader(response.body)),
+		ContentLength: int64(len(response.body)),
+		Request:       req,
+	}, nil
+}
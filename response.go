@@ -0,0 +1,54 @@
+package main
+
+import "net/http"
+
+// statusRecorder remembers the status code and the number of bytes of a response, so handlers wrapping
+// the file handler can act on the outcome of a request.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the original response writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+const writeChunkSize = 32 * 1024
+
+// writeContent writes the content in chunks and stops as soon as the client disconnected, instead of
+// pushing the rest of a large file into a closed connection.
+func writeContent(w http.ResponseWriter, req *http.Request, content []byte) error {
+	for len(content) > 0 {
+		err := req.Context().Err()
+		if err != nil {
+			return err
+		}
+		n := len(content)
+		if n > writeChunkSize {
+			n = writeChunkSize
+		}
+		_, err = w.Write(content[:n])
+		if err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule maps the paths matching the pattern onto the replacement, which may refer to the groups of
+// the pattern, e.g. ^/legacy/(.*)\.png$ to /images/$1.webp. Unlike a redirect, the client never sees the
+// new path.
+type rewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+
+	pattern *regexp.Regexp
+}
+
+func parseRewriteRules(rulesJSON string) ([]rewriteRule, error) {
+	var rules []rewriteRule
+	err := json.Unmarshal([]byte(rulesJSON), &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		rules[i].pattern, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule pattern %q is invalid: %w", rule.Pattern, err)
+		}
+		if !strings.HasPrefix(rule.Replacement, "/") {
+			return nil, fmt.Errorf("rewrite rule replacement %q must start with /", rule.Replacement)
+		}
+	}
+	return rules, nil
+}
+
+// rewritePath returns the path the first matching rule maps the path onto.
+func rewritePath(rules []rewriteRule, path string) (string, bool) {
+	for _, rule := range rules {
+		if rule.pattern.MatchString(path) {
+			return rule.pattern.ReplaceAllString(path, rule.Replacement), true
+		}
+	}
+	return path, false
+}
+
+// newRewriteHandler passes the requests on with the path rewritten by the first matching rule, so the file
+// of the new path is served, or the fallback to index.html if there is none. All other requests are passed
+// on unchanged.
+func newRewriteHandler(rules []rewriteRule, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path, rewritten := rewritePath(rules, req.URL.Path)
+		if !rewritten {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rewrittenURL := *req.URL
+		rewrittenURL.Path = path
+		rewrittenURL.RawPath = ""
+		rewrittenReq := req.Clone(req.Context())
+		rewrittenReq.URL = &rewrittenURL
+		next.ServeHTTP(w, rewrittenReq)
+	})
+}
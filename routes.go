@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const routingMaxBytes = 1 << 20
+
+// routes are the redirect, rewrite and proxy rules in effect.
+type routes struct {
+	redirects []redirectRule
+	rewrites  []rewriteRule
+	proxies   []proxyRule
+}
+
+// routeTable holds the routes, which an import through the admin port replaces at runtime. Every request
+// sticks to the routes in effect when it arrived.
+type routeTable struct {
+	upgradeIdleTimeout time.Duration
+	current            atomic.Pointer[routes]
+	// changed is called after an import replaced the routes, e.g. to forget the paths missing before
+	changed func()
+}
+
+func newRouteTable(current *routes, upgradeIdleTimeout time.Duration) *routeTable {
+	table := &routeTable{upgradeIdleTimeout: upgradeIdleTimeout}
+	table.current.Store(current)
+	return table
+}
+
+// replace puts the routes in effect for the requests arriving from now on.
+func (t *routeTable) replace(imported *routes) {
+	t.current.Store(imported)
+	if t.changed != nil {
+		t.changed()
+	}
+}
+
+// outer applies the redirects and then the proxy rules, in front of the mounts.
+func (t *routeTable) outer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current := t.current.Load()
+		newRedirectHandler(current.redirects, newProxyHandler(current.proxies, next)).ServeHTTP(w, req)
+	})
+}
+
+// inner applies the rewrites to the path within the mount.
+func (t *routeTable) inner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		newRewriteHandler(t.current.Load().rewrites, next).ServeHTTP(w, req)
+	})
+}
+
+// proxyPrefixes returns the prefixes of the proxy rules in effect.
+func (t *routeTable) proxyPrefixes() []string {
+	return proxyPrefixes(t.current.Load().proxies)
+}
+
+// routingDocument is the resolved rule set of the server as a single json document. The routes can be
+// imported again, the settings under readOnly only change with a restart of the server.
+type routingDocument struct {
+	Redirects  []redirectRule  `json:"redirects"`
+	Rewrites   []rewriteRule   `json:"rewrites"`
+	ProxyRules []string        `json:"proxyRules"`
+	ReadOnly   routingReadOnly `json:"readOnly"`
+}
+
+type routingReadOnly struct {
+	Mounts             []string            `json:"mounts"`
+	CachePolicy        map[string]string   `json:"cachePolicy"`
+	CSPRoutes          []cspRoute          `json:"cspRoutes"`
+	DownloadRoutes     []downloadRoute     `json:"downloadRoutes"`
+	WriteTimeoutRoutes []writeTimeoutRoute `json:"writeTimeoutRoutes"`
+	RateLimits         []rateLimitRoute    `json:"rateLimits"`
+}
+
+// normalized replaces missing lists by empty ones, so a document compares equal whether it lists no
+// routes as null or as [].
+func (r routingReadOnly) normalized() routingReadOnly {
+	if r.Mounts == nil {
+		r.Mounts = []string{}
+	}
+	if r.CachePolicy == nil {
+		r.CachePolicy = map[string]string{}
+	}
+	if r.CSPRoutes == nil {
+		r.CSPRoutes = []cspRoute{}
+	}
+	if r.DownloadRoutes == nil {
+		r.DownloadRoutes = []downloadRoute{}
+	}
+	if r.WriteTimeoutRoutes == nil {
+		r.WriteTimeoutRoutes = []writeTimeoutRoute{}
+	}
+	if r.RateLimits == nil {
+		r.RateLimits = []rateLimitRoute{}
+	}
+	return r
+}
+
+// formatProxyRule is the inverse of parseProxyRules for a single rule, with the password of the target
+// redacted.
+func formatProxyRule(rule proxyRule) string {
+	entry := rule.prefix + "=>" + rule.target.Redacted()
+	if rule.stream {
+		entry += ";stream"
+	}
+	return entry
+}
+
+func (t *routeTable) export(readOnly routingReadOnly) routingDocument {
+	current := t.current.Load()
+	document := routingDocument{
+		Redirects:  append([]redirectRule{}, current.redirects...),
+		Rewrites:   append([]rewriteRule{}, current.rewrites...),
+		ProxyRules: make([]string, 0, len(current.proxies)),
+		ReadOnly:   readOnly.normalized(),
+	}
+	for _, rule := range current.proxies {
+		document.ProxyRules = append(document.ProxyRules, formatProxyRule(rule))
+	}
+	return document
+}
+
+// parseRoutingDocument validates the routes of the document like those of the env variables.
+// The read-only settings are nil if the document has none.
+func (t *routeTable) parseRoutingDocument(documentJSON []byte) (*routes, *routingReadOnly, error) {
+	var document struct {
+		Redirects  json.RawMessage  `json:"redirects"`
+		Rewrites   json.RawMessage  `json:"rewrites"`
+		ProxyRules []string         `json:"proxyRules"`
+		ReadOnly   *routingReadOnly `json:"readOnly"`
+	}
+	err := json.Unmarshal(documentJSON, &document)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed := &routes{}
+	if len(document.Redirects) > 0 {
+		parsed.redirects, err = parseRedirectRules(string(document.Redirects))
+		if err != nil {
+			return nil, nil, fmt.Errorf("redirects: %w", err)
+		}
+	}
+	if len(document.Rewrites) > 0 {
+		parsed.rewrites, err = parseRewriteRules(string(document.Rewrites))
+		if err != nil {
+			return nil, nil, fmt.Errorf("rewrites: %w", err)
+		}
+	}
+	parsed.proxies, err = parseProxyRules(strings.Join(document.ProxyRules, ","), t.upgradeIdleTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("proxy rules: %w", err)
+	}
+	return parsed, document.ReadOnly, nil
+}
+
+// newRoutingHandler exports the rule set of the server with GET and imports the routes of a document with
+// PUT. An import is refused if its read-only
+// settings differ from those of the running server, so a document is never applied only in part.
+func newRoutingHandler(table *routeTable, readOnly routingReadOnly) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			documentJSON, err := io.ReadAll(http.MaxBytesReader(w, req.Body, routingMaxBytes))
+			if err != nil {
+				writeProblem(w, req, http.StatusRequestEntityTooLarge, fmt.Sprintf("the routing document must not exceed %d bytes", routingMaxBytes))
+				return
+			}
+			imported, importedReadOnly, err := table.parseRoutingDocument(documentJSON)
+			if err != nil {
+				writeProblem(w, req, http.StatusUnprocessableEntity, fmt.Sprintf("invalid routing document: %v", err))
+				return
+			}
+			// a document without read-only settings only replaces the routes
+			if importedReadOnly != nil && !sameJSON(importedReadOnly.normalized(), readOnly.normalized()) {
+				writeProblem(w, req, http.StatusConflict, "the read-only settings differ from those of the running server, they only change with a restart")
+				return
+			}
+			table.replace(imported)
+			principal, _ := principalOf(req)
+			slog.Info("Imported routes", "principal", principal.Name, "redirects", len(imported.redirects), "rewrites", len(imported.rewrites), "proxyRules", len(imported.proxies))
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeProblem(w, req, http.StatusMethodNotAllowed, "the routing is exported with GET and imported with PUT")
+			return
+		}
+		var body bytes.Buffer
+		encoder := json.NewEncoder(&body)
+		// the document is meant to be edited, so the => of the proxy rules stays readable
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(table.export(readOnly))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(body.Len()))
+		_, _ = w.Write(body.Bytes())
+	})
+}
+
+// sameJSON tells if both values have the same json representation.
+func sameJSON(a interface{}, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aJSON) == string(bJSON)
+}
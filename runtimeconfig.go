@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// configMaxBytes bounds a runtime config replaced through the admin port.
+const configMaxBytes = 1 << 20
+
+var errNoPreviousConfig = errors.New("there is no previous config to roll back to")
+
+// errConfigOriginsChanged refuses a config whose origins differ from those the CSP and the preconnect
+// links were derived from at startup.
+var errConfigOriginsChanged = errors.New("the origins of the config differ from those of the running server, they only change with a restart")
+
+// runtimeConfig is the config.json of the server with the one it replaced, so a bad config is rolled back
+// without a redeployment. The config is applied by loading the bundle again, like on reloads in dev mode.
+type runtimeConfig struct {
+	// apply serves the bundle with the config
+	apply func(config []byte) error
+	// fixedOrigins refuses configs with other origins, set when CSP_CONNECT_FROM_CONFIG or
+	// PRECONNECT_FROM_CONFIG derived headers from them
+	fixedOrigins bool
+	// changed is called with the version of the config in effect after a change
+	changed func(version string)
+
+	mutex    sync.Mutex
+	current  []byte
+	previous []byte
+}
+
+func newRuntimeConfig(config []byte, fixedOrigins bool, apply func(config []byte) error) *runtimeConfig {
+	slog.Info("Loaded the runtime config", "configVersion", configVersion(config))
+	return &runtimeConfig{apply: apply, fixedOrigins: fixedOrigins, changed: func(string) {}, current: config}
+}
+
+// reload serves the bundle with the config in effect again, e.g. after the bundle changed in dev mode.
+func (c *runtimeConfig) reload() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.apply(c.current)
+}
+
+// replace serves the bundle with the config and keeps the config it replaces for a rollback.
+func (c *runtimeConfig) replace(config []byte) error {
+	if !json.Valid(config) {
+		return errors.New("the config is not valid json")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.switchTo(config); err != nil {
+		return err
+	}
+	slog.Info("Replaced the runtime config", "configVersion", configVersion(c.current), "previousConfigVersion", configVersion(c.previous))
+	return nil
+}
+
+// rollback serves the previous config again, a second rollback returns to the config rolled back.
+func (c *runtimeConfig) rollback() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.previous == nil {
+		return errNoPreviousConfig
+	}
+	if err := c.switchTo(c.previous); err != nil {
+		return err
+	}
+	slog.Warn("Rolled back the runtime config", "configVersion", configVersion(c.current), "previousConfigVersion", configVersion(c.previous))
+	return nil
+}
+
+func (c *runtimeConfig) switchTo(config []byte) error {
+	if c.fixedOrigins {
+		origins, err := configOrigins(config)
+		if err != nil {
+			return err
+		}
+		currentOrigins, err := configOrigins(c.current)
+		if err != nil {
+			return err
+		}
+		sort.Strings(origins)
+		sort.Strings(currentOrigins)
+		if strings.Join(origins, " ") != strings.Join(currentOrigins, " ") {
+			return errConfigOriginsChanged
+		}
+	}
+	if err := c.apply(config); err != nil {
+		return err
+	}
+	c.previous, c.current = c.current, config
+	c.changed(configVersion(config))
+	return nil
+}
+
+// newConfigHandler shows the runtime config with GET and replaces it with PUT at the path, and rolls back
+// to the previous config with POST at the path followed by /rollback.
+func newConfigHandler(path string, config *runtimeConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		switch {
+		case req.URL.Path == path+"/rollback" && req.Method == http.MethodPost:
+			err = config.rollback()
+		case req.URL.Path == path+"/rollback":
+			w.Header().Set("Allow", http.MethodPost)
+			writeProblem(w, req, http.StatusMethodNotAllowed, "the config is rolled back with POST")
+			return
+		case req.Method == http.MethodGet:
+		case req.Method == http.MethodPut:
+			var configJSON []byte
+			configJSON, err = io.ReadAll(http.MaxBytesReader(w, req.Body, configMaxBytes))
+			if err != nil {
+				writeProblem(w, req, http.StatusRequestEntityTooLarge, fmt.Sprintf("the config must not exceed %d bytes", configMaxBytes))
+				return
+			}
+			err = config.replace(configJSON)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeProblem(w, req, http.StatusMethodNotAllowed, "the config is read with GET and replaced with PUT")
+			return
+		}
+		switch {
+		case errors.Is(err, errNoPreviousConfig) || errors.Is(err, errConfigOriginsChanged):
+			writeProblem(w, req, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			writeProblem(w, req, http.StatusUnprocessableEntity, fmt.Sprintf("invalid config: %v", err))
+			return
+		}
+
+		config.mutex.Lock()
+		status := struct {
+			ConfigVersion         string          `json:"configVersion"`
+			PreviousConfigVersion string          `json:"previousConfigVersion,omitempty"`
+			Config                json.RawMessage `json:"config"`
+		}{ConfigVersion: configVersion(config.current), Config: config.current}
+		if config.previous != nil {
+			status.PreviousConfigVersion = configVersion(config.previous)
+		}
+		config.mutex.Unlock()
+		body, _ := json.Marshal(status)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		_, _ = w.Write(body)
+	})
+}
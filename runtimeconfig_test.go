@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeConfigReplaceAndRollback(t *testing.T) {
+	server := newTestSPAServer(t, map[string]string{"CONFIG_JSON": `{"api":"https://api.example.com","theme":"light"}`})
+	admin := newConfigHandler("/config", server.config)
+	send := func(method string, path string, body string) int {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, "http://localhost"+path, strings.NewReader(body)))
+		return rec.Code
+	}
+	served := func() string {
+		rec := httptest.NewRecorder()
+		server.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://localhost/config.json", nil))
+		body, _ := io.ReadAll(rec.Result().Body)
+		return string(body)
+	}
+
+	if status := send(http.MethodPost, "/config/rollback", ""); status != http.StatusConflict {
+		t.Errorf("rollback without a previous config = %d, want %d", status, http.StatusConflict)
+	}
+	if status := send(http.MethodPut, "/config", `{"theme":`); status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid config = %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if status := send(http.MethodPut, "/config", `{"api":"https://api.example.com","theme":"dark"}`); status != http.StatusOK {
+		t.Fatalf("replace = %d, want %d", status, http.StatusOK)
+	}
+	if !strings.Contains(served(), `"dark"`) {
+		t.Errorf("the replaced config is not served: %s", served())
+	}
+	if status := send(http.MethodPost, "/config/rollback", ""); status != http.StatusOK {
+		t.Fatalf("rollback = %d, want %d", status, http.StatusOK)
+	}
+	if !strings.Contains(served(), `"light"`) {
+		t.Errorf("the previous config is not served after the rollback: %s", served())
+	}
+}
+
+func TestRuntimeConfigKeepsOriginsOfCSP(t *testing.T) {
+	server := newTestSPAServer(t, map[string]string{
+		"CONFIG_JSON":             `{"api":"https://api.example.com"}`,
+		"CSP_CONNECT_FROM_CONFIG": "true",
+	})
+	admin := newConfigHandler("/config", server.config)
+	tests := []struct {
+		name   string
+		config string
+		status int
+	}{
+		{"same origins", `{"api":"https://api.example.com/v2","debug":true}`, http.StatusOK},
+		{"new origin", `{"api":"https://evil.example.com"}`, http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "http://localhost/config", strings.NewReader(test.config)))
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+}
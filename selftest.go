@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// selfTest renders index.html and config.json with the file handler and resolves all content security
+// policies, so a broken setup fails at startup instead of with the first users.
+func selfTest(fileHandler http.Handler, csp string, cspRoutes []cspRoute) []error {
+	var failures []error
+
+	index := httptest.NewRecorder()
+	fileHandler.ServeHTTP(index, httptest.NewRequest(http.MethodGet, "/", nil))
+	if index.Code != http.StatusOK {
+		failures = append(failures, fmt.Errorf("index.html responded with status %d", index.Code))
+	} else if !strings.HasPrefix(index.Header().Get("Content-Type"), "text/html") {
+		failures = append(failures, fmt.Errorf("index.html has the content type %q", index.Header().Get("Content-Type")))
+	}
+
+	config := httptest.NewRecorder()
+	fileHandler.ServeHTTP(config, httptest.NewRequest(http.MethodGet, configFileName, nil))
+	if config.Code != http.StatusOK {
+		failures = append(failures, fmt.Errorf("config.json responded with status %d", config.Code))
+	} else if !json.Valid(config.Body.Bytes()) {
+		failures = append(failures, fmt.Errorf("config.json is not valid json"))
+	}
+
+	if csp != "false" {
+		policies := []string{csp}
+		for _, route := range cspRoutes {
+			policies = append(policies, route.policy)
+		}
+		for _, policy := range policies {
+			// unused or malformed verbs end up as %!(...) in the formatted policy
+			if resolved := fmt.Sprintf(policy, "nonce"); strings.Contains(resolved, "%!") {
+				failures = append(failures, fmt.Errorf("content security policy does not resolve: %s", resolved))
+			}
+		}
+	}
+	return failures
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	sentryhttp "github.com/getsentry/sentry-go/http"
+)
+
+const sentryFlushTimeout = 2 * time.Second
+
+func initSentry(dsn string, environment string, release string) error {
+	return sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: environment,
+		Release:     release,
+	})
+}
+
+// newSentryHandler reports panics and responses with a 5xx status to sentry. The request is attached to
+// every event, so it can be triaged next to the errors reported by the frontend.
+func newSentryHandler(next http.Handler) http.Handler {
+	sentryHandler := sentryhttp.New(sentryhttp.Options{Repanic: true})
+	return sentryHandler.Handle(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, req)
+		if recorder.status < http.StatusInternalServerError {
+			return
+		}
+		if hub := sentry.GetHubFromContext(req.Context()); hub != nil {
+			hub.CaptureMessage(fmt.Sprintf("Server responded with status %d. path: %s", recorder.status, req.URL.Path))
+		}
+	}))
+}
+
+// reportFatal sends the error to sentry and waits for the delivery, as the server is about to exit.
+// Without a configured DSN this is a no-op.
+func reportFatal(err error) {
+	sentry.CaptureException(err)
+	sentry.Flush(sentryFlushTimeout)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencySmoothing is the weight of the newest sample in the moving average of the latency, as 1/n.
+const latencySmoothing = 8
+
+// loadShedder tracks the requests in flight and the moving average of the time to the first byte of the
+// responses. When one of them exceeds its threshold, requests are answered with a tiny 503 instead of
+// letting all of them time out.
+type loadShedder struct {
+	maxInFlight int64
+	maxLatency  time.Duration
+	retryAfter  string
+	inFlight    atomic.Int64
+	latency     atomic.Int64
+}
+
+func newLoadShedder(maxInFlight uint64, maxLatency time.Duration, retryAfter uint64) *loadShedder {
+	return &loadShedder{
+		maxInFlight: int64(maxInFlight),
+		maxLatency:  maxLatency,
+		retryAfter:  fmt.Sprint(retryAfter),
+	}
+}
+
+func (s *loadShedder) overloaded(inFlight int64) bool {
+	if s.maxInFlight > 0 && inFlight > s.maxInFlight {
+		return true
+	}
+	// while the latency is too high one request at a time is still served, so the average can recover
+	return s.maxLatency > 0 && inFlight > 1 && time.Duration(s.latency.Load()) > s.maxLatency
+}
+
+func (s *loadShedder) observe(latency time.Duration) {
+	for {
+		old := s.latency.Load()
+		updated := old + (int64(latency)-old)/latencySmoothing
+		if s.latency.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+// shedWriter observes the time to the first byte of a response instead of its duration, and releases the
+// request from the requests in flight once it streams, e.g. server-sent events or streamed proxy responses.
+// Streams live for minutes and would otherwise keep the server overloaded.
+type shedWriter struct {
+	http.ResponseWriter
+	shedder  *loadShedder
+	start    time.Time
+	observed bool
+	released bool
+}
+
+func (w *shedWriter) firstByte() {
+	if !w.observed {
+		w.observed = true
+		w.shedder.observe(time.Since(w.start))
+	}
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.release()
+	}
+}
+
+func (w *shedWriter) release() {
+	if !w.released {
+		w.released = true
+		w.shedder.inFlight.Add(-1)
+	}
+}
+
+func (w *shedWriter) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		w.firstByte()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *shedWriter) Write(b []byte) (int, error) {
+	w.firstByte()
+	return w.ResponseWriter.Write(b)
+}
+
+// FlushError is called through http.ResponseController, responses flushed before they end are streams.
+func (w *shedWriter) FlushError() error {
+	w.firstByte()
+	w.release()
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the original response writer.
+func (w *shedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (s *loadShedder) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inFlight := s.inFlight.Add(1)
+		if s.overloaded(inFlight) {
+			s.inFlight.Add(-1)
+			w.Header().Set("Retry-After", s.retryAfter)
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "The server is busy, please try again shortly.", http.StatusServiceUnavailable)
+			return
+		}
+		if isUpgrade(req) {
+			// upgraded connections, e.g. websockets, live long and would keep the server overloaded
+			s.inFlight.Add(-1)
+			next.ServeHTTP(w, req)
+			return
+		}
+		writer := &shedWriter{ResponseWriter: w, shedder: s, start: time.Now()}
+		defer writer.release()
+		next.ServeHTTP(writer, req)
+		if !writer.observed {
+			s.observe(time.Since(writer.start))
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const sidecarPollInterval = 500 * time.Millisecond
+const sidecarQuitTimeout = 5 * time.Second
+
+// waitForSidecar polls the readiness url of the mesh sidecar until it reports ready. In meshes where the
+// application container may start before the sidecar proxy, this prevents serving requests that would end in 503s.
+func waitForSidecar(ctx context.Context, readyURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		status, err := pollSidecar(ctx, readyURL)
+		if err == nil && status == http.StatusOK {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("sidecar responded with status %d", status)
+		case <-time.After(sidecarPollInterval):
+		}
+	}
+}
+
+// pollSidecar asks the readiness url once, a poll takes at most the poll interval.
+func pollSidecar(ctx context.Context, readyURL string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, sidecarPollInterval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// quitSidecar asks the mesh sidecar to terminate (e.g. istio's /quitquitquit), so the pod does not keep
+// running with only the proxy left once the server stopped.
+func quitSidecar(quitURL string) {
+	// the server has stopped, so the request has a deadline of its own
+	ctx, cancel := context.WithTimeout(context.Background(), sidecarQuitTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, quitURL, nil)
+	if err != nil {
+		slog.Error("Could not ask sidecar to quit", "url", quitURL, "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Could not ask sidecar to quit", "url", quitURL, "err", err)
+		return
+	}
+	resp.Body.Close()
+	slog.Info("Asked sidecar to quit", "url", quitURL, "status", resp.StatusCode)
+}
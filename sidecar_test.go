@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitForSidecarEndsWithContext(t *testing.T) {
+	sidecar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(sidecar.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err := waitForSidecar(ctx, sidecar.URL, time.Minute)
+	if err == nil {
+		t.Fatal("waitForSidecar succeeded for a sidecar that is not ready")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("waitForSidecar returned after %s, want it to end with the context", elapsed)
+	}
+}
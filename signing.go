@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// configSigner creates JSON web signatures (RFC 7515) of the runtime config with an Ed25519 or ECDSA P-256 key.
+type configSigner struct {
+	key       crypto.Signer
+	algorithm string
+	header    string
+}
+
+// newConfigSigner parses a PKCS#8 private key in PEM format.
+func newConfigSigner(keyPEM string, keyID string) (*configSigner, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("no PEM block found in signing key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer := &configSigner{}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signer.key = k
+		signer.algorithm = "EdDSA"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only ECDSA keys on the curve P-256 are supported")
+		}
+		signer.key = k
+		signer.algorithm = "ES256"
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	header := map[string]string{"alg": signer.algorithm, "typ": "JOSE"}
+	if keyID != "" {
+		header["kid"] = keyID
+	}
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	signer.header = base64.RawURLEncoding.EncodeToString(encoded)
+	return signer, nil
+}
+
+// detached returns the JWS of the payload in compact serialization with a detached payload, i.e. with the
+// payload part left empty, as it is the body of the response.
+func (s *configSigner) detached(payload []byte) (string, error) {
+	signingInput := s.header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed size concatenation of r and s instead of ASN.1
+		signature = append(padTo32(r), padTo32(sig)...)
+	}
+	return s.header + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func padTo32(n *big.Int) []byte {
+	b := make([]byte, 32)
+	return n.FillBytes(b)
+}
+
+// configVersion identifies the content of the config, so clients can tell versions apart.
+func configVersion(config []byte) string {
+	hash := sha256.Sum256(config)
+	return fmt.Sprintf("%x", hash[:8])
+}
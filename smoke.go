@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// smokeResult is the outcome of a single check of the smoke test.
+type smokeResult struct {
+	check  string
+	failed bool
+	detail string
+}
+
+// smokeFetch gets the path relative to the base url and returns the response with its body read.
+func smokeFetch(client *http.Client, baseURL string, path string) (*http.Response, []byte, error) {
+	resp, err := client.Get(strings.TrimSuffix(baseURL, "/") + path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxBytes))
+	return resp, body, err
+}
+
+// smokeRequest sends a request with the headers to the path relative to the base url and returns the
+// response with its body read. With an Accept-Encoding header the body is not decompressed.
+func smokeRequest(client *http.Client, method string, baseURL string, path string, headers map[string]string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(baseURL, "/")+path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxBytes))
+	return resp, body, err
+}
+
+// smokeHeaders checks that HEAD, ranged and unsatisfiable requests for the asset are answered with headers
+// consistent with the full response of the same encoding.
+func smokeHeaders(client *http.Client, baseURL string, asset string, encoding string) string {
+	headers := map[string]string{"Accept-Encoding": encoding}
+	full, body, err := smokeRequest(client, http.MethodGet, baseURL, asset, headers)
+	if err != nil {
+		return err.Error()
+	}
+	if full.Header.Get("Content-Length") != fmt.Sprint(len(body)) {
+		return fmt.Sprintf("Content-Length %q of a body of %d bytes", full.Header.Get("Content-Length"), len(body))
+	}
+
+	head, _, err := smokeRequest(client, http.MethodHead, baseURL, asset, headers)
+	if err != nil {
+		return err.Error()
+	}
+	for _, name := range []string{"Content-Length", "Content-Encoding", "Content-Type", "ETag"} {
+		if head.Header.Get(name) != full.Header.Get(name) {
+			return fmt.Sprintf("HEAD %s %q differs from GET %q", name, head.Header.Get(name), full.Header.Get(name))
+		}
+	}
+	if full.Header.Get("Accept-Ranges") != "bytes" || len(body) == 0 {
+		return ""
+	}
+
+	headers["Range"] = "bytes=0-0"
+	ranged, rangedBody, err := smokeRequest(client, http.MethodGet, baseURL, asset, headers)
+	switch {
+	case err != nil:
+		return err.Error()
+	case ranged.StatusCode != http.StatusPartialContent:
+		return fmt.Sprintf("range status %d", ranged.StatusCode)
+	case ranged.Header.Get("Content-Range") != fmt.Sprintf("bytes 0-0/%d", len(body)):
+		return fmt.Sprintf("Content-Range %q of %d bytes", ranged.Header.Get("Content-Range"), len(body))
+	case ranged.Header.Get("Content-Length") != "1" || len(rangedBody) != 1:
+		return fmt.Sprintf("range Content-Length %q with %d bytes", ranged.Header.Get("Content-Length"), len(rangedBody))
+	case ranged.Header.Get("Content-Encoding") != full.Header.Get("Content-Encoding"):
+		return fmt.Sprintf("range Content-Encoding %q differs from %q", ranged.Header.Get("Content-Encoding"), full.Header.Get("Content-Encoding"))
+	}
+
+	headers["Range"] = fmt.Sprintf("bytes=%d-", len(body))
+	unsatisfiable, _, err := smokeRequest(client, http.MethodGet, baseURL, asset, headers)
+	switch {
+	case err != nil:
+		return err.Error()
+	case unsatisfiable.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		return fmt.Sprintf("unsatisfiable range status %d", unsatisfiable.StatusCode)
+	case unsatisfiable.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", len(body)):
+		return fmt.Sprintf("unsatisfiable Content-Range %q of %d bytes", unsatisfiable.Header.Get("Content-Range"), len(body))
+	case unsatisfiable.Header.Get("Content-Encoding") != "":
+		return fmt.Sprintf("unsatisfiable range with Content-Encoding %q", unsatisfiable.Header.Get("Content-Encoding"))
+	}
+	return ""
+}
+
+// smokeTest verifies a running instance: index.html with its CSP and caching headers, config.json and an
+// asset, by default the first script or stylesheet index.html loads.
+func smokeTest(client *http.Client, baseURL string, asset string, expectCSP bool) []smokeResult {
+	var results []smokeResult
+	check := func(name string, failure string) {
+		results = append(results, smokeResult{check: name, failed: failure != "", detail: failure})
+	}
+
+	resp, index, err := smokeFetch(client, baseURL, "/")
+	if err != nil {
+		check("index", err.Error())
+		return results
+	}
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		check("index", fmt.Sprintf("status %d", resp.StatusCode))
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"):
+		check("index", fmt.Sprintf("content type %q", resp.Header.Get("Content-Type")))
+	default:
+		check("index", "")
+	}
+	if expectCSP {
+		if resp.Header.Get("Content-Security-Policy") == "" {
+			check("index csp", "no Content-Security-Policy header")
+		} else {
+			check("index csp", "")
+		}
+	}
+	if resp.Header.Get("Cache-Control") == "" {
+		check("index caching", "no Cache-Control header")
+	} else {
+		check("index caching", "")
+	}
+
+	resp, config, err := smokeFetch(client, baseURL, configFileName)
+	switch {
+	case err != nil:
+		check("config", err.Error())
+	case resp.StatusCode != http.StatusOK:
+		check("config", fmt.Sprintf("status %d", resp.StatusCode))
+	case !json.Valid(config):
+		check("config", "not valid json")
+	case resp.Header.Get("Cache-Control") == "":
+		check("config", "no Cache-Control header")
+	default:
+		check("config", "")
+	}
+
+	if asset == "" {
+		var assets []string
+		for path := range criticalAssets(index) {
+			assets = append(assets, path)
+		}
+		sort.Strings(assets)
+		if len(assets) == 0 {
+			return results
+		}
+		asset = assets[0]
+	}
+	resp, _, err = smokeFetch(client, baseURL, asset)
+	switch {
+	case err != nil:
+		check("asset "+asset, err.Error())
+	case resp.StatusCode != http.StatusOK:
+		check("asset "+asset, fmt.Sprintf("status %d", resp.StatusCode))
+	case strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"):
+		check("asset "+asset, "served the fallback to index.html")
+	case resp.Header.Get("Cache-Control") == "" || strings.Contains(resp.Header.Get("Cache-Control"), "no-store"):
+		check("asset "+asset, fmt.Sprintf("not cacheable, Cache-Control %q", resp.Header.Get("Cache-Control")))
+	default:
+		check("asset "+asset, "")
+	}
+	for _, encoding := range []string{"identity", "gzip", "br"} {
+		check(fmt.Sprintf("asset %s headers (%s)", asset, encoding), smokeHeaders(client, baseURL, asset, encoding))
+	}
+	return results
+}
+
+// runSmoke runs the smoke subcommand for deployment pipelines and synthetic monitoring.
+func runSmoke(args []string) int {
+	flags := flag.NewFlagSet("smoke", flag.ExitOnError)
+	baseURL := flags.String("url", "", "base url of the running instance, e.g. https://app.example.com/")
+	asset := flags.String("asset", "", "path of the asset to check, defaults to the first script or stylesheet of index.html")
+	expectCSP := flags.Bool("csp", true, "expect a Content-Security-Policy header on index.html")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of every request")
+	_ = flags.Parse(args)
+
+	if *baseURL == "" {
+		fmt.Println("The url of the instance to smoke test is missing, e.g. smoke --url https://app.example.com/")
+		return 2
+	}
+	results := smokeTest(&http.Client{Timeout: *timeout}, *baseURL, *asset, *expectCSP)
+	failures := 0
+	for _, result := range results {
+		if result.failed {
+			failures++
+			fmt.Printf("%s: failed: %s\n", result.check, result.detail)
+		} else {
+			fmt.Printf("%s: ok\n", result.check)
+		}
+	}
+	if failures > 0 {
+		fmt.Printf("%d of %d checks failed\n", failures, len(results))
+		return 1
+	}
+	fmt.Printf("All %d checks passed\n", len(results))
+	return 0
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// bundleSource provides the files of the bundle. The embedded filesystem is the default source, other
+// sources like a directory, an archive or an object store implement the same interface.
+type bundleSource interface {
+	// list returns the paths of all files of the bundle, each starting with /
+	list() ([]string, error)
+	// open opens the file of the bundle at the path
+	open(path string) (io.ReadCloser, error)
+	// version identifies the content of the bundle
+	version() (string, error)
+	// watch calls changed whenever the content of the bundle changes, until the context is done. Sources
+	// that never change return right away.
+	watch(ctx context.Context, changed func()) error
+}
+
+// fsSource serves the files of a filesystem, e.g. the embedded bundle or a directory on disk.
+type fsSource struct {
+	fsys fs.FS
+	// dir is the resolved path of the directory on disk, empty for the embedded bundle
+	dir string
+}
+
+func newEmbeddedSource() *fsSource {
+	// the embedded directory always exists
+	bundle, _ := fs.Sub(embeddedFs, dirPrefix)
+	return &fsSource{fsys: bundle}
+}
+
+// newDirSource serves the files of a directory on disk, e.g. a build mounted into the container. Paths
+// can't escape the directory, and symlinks are only followed to files within the directory, like those
+// of a ConfigMap mount, so they can't expose other files.
+func newDirSource(dir string) (*fsSource, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &fsSource{fsys: os.DirFS(resolved), dir: resolved}, nil
+}
+
+// newBundleSource returns the source of the bundle, the static directory if there is one, otherwise the
+// embedded bundle, with the files of the overlay directory, if any, in place of its files.
+func newBundleSource(staticDir string, overlayDir string) (bundleSource, error) {
+	var source bundleSource = newEmbeddedSource()
+	if staticDir != "" {
+		dir, err := newDirSource(staticDir)
+		if err != nil {
+			return nil, err
+		}
+		source = dir
+	}
+	if overlayDir == "" {
+		return source, nil
+	}
+	overlay, err := newDirSource(overlayDir)
+	if err != nil {
+		return nil, err
+	}
+	return &overlaySource{overlay: overlay, base: source}, nil
+}
+
+func (s *fsSource) list() ([]string, error) {
+	var paths []string
+	err := fs.WalkDir(s.fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// the timestamped directories of a ConfigMap mount are reached through its symlinks
+		if d.IsDir() && strings.HasPrefix(d.Name(), "..") {
+			return fs.SkipDir
+		}
+		if d.Type().IsRegular() || d.Type()&fs.ModeSymlink != 0 && s.linksWithin(path) {
+			paths = append(paths, "/"+path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// linksWithin tells if the symlink at the path resolves to a regular file within the directory.
+func (s *fsSource) linksWithin(path string) bool {
+	if s.dir == "" {
+		return false
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(s.dir, filepath.FromSlash(path)))
+	if err != nil {
+		return false
+	}
+	relative, err := filepath.Rel(s.dir, target)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return false
+	}
+	info, err := os.Stat(target)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (s *fsSource) open(path string) (io.ReadCloser, error) {
+	return s.fsys.Open(strings.TrimPrefix(path, "/"))
+}
+
+// version hashes the paths and the content of all files.
+func (s *fsSource) version() (string, error) {
+	paths, err := s.list()
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+	hash := sha256.New()
+	for _, path := range paths {
+		file, err := s.open(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\n", path)
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// watchSettleDelay is the time without further changes after which a changed directory is reported,
+// bundlers and editors write several files at once.
+const watchSettleDelay = 200 * time.Millisecond
+
+// watch reports the changes of all files below a directory on disk. It returns right away for the embedded
+// bundle, which never changes.
+func (s *fsSource) watch(ctx context.Context, changed func()) error {
+	if s.dir == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// fsnotify watches single directories, so every directory of the tree is added
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return watcher.Add(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					_ = watcher.Add(event.Name)
+				}
+			}
+			settled = time.After(watchSettleDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-settled:
+			settled = nil
+			changed()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// overlaySource serves the files of the overlay in place of the files of the base with the same path, and
+// the files of the base missing in the overlay, e.g. to patch single files of the bundle with a ConfigMap
+// mount.
+type overlaySource struct {
+	overlay bundleSource
+	base    bundleSource
+}
+
+func (s *overlaySource) list() ([]string, error) {
+	paths, err := s.overlay.list()
+	if err != nil {
+		return nil, err
+	}
+	overlaid := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		overlaid[path] = true
+	}
+	basePaths, err := s.base.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range basePaths {
+		if !overlaid[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (s *overlaySource) open(path string) (io.ReadCloser, error) {
+	file, err := s.overlay.open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s.base.open(path)
+	}
+	return file, err
+}
+
+// version combines the versions of the overlay and the base.
+func (s *overlaySource) version() (string, error) {
+	overlayVersion, err := s.overlay.version()
+	if err != nil {
+		return "", err
+	}
+	baseVersion, err := s.base.version()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(overlayVersion+"\n"+baseVersion))), nil
+}
+
+// watch watches the overlay and the base until both returned, and returns the first error of them.
+func (s *overlaySource) watch(ctx context.Context, changed func()) error {
+	errs := make(chan error, 2)
+	go func() { errs <- s.overlay.watch(ctx, changed) }()
+	go func() { errs <- s.base.watch(ctx, changed) }()
+	err := <-errs
+	if second := <-errs; err == nil {
+		err = second
+	}
+	return err
+}
+
+// readFile reads the whole file of the bundle at the path.
+func readFile(source bundleSource, path string) ([]byte, error) {
+	file, err := source.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
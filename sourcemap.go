@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+)
+
+// sourcemapPolicy decides which clients receive the *.map files. With the policy "block" source maps are
+// never served, with "restricted" only to clients from the allowed networks or presenting the token, e.g.
+// the error-tracking service, and with "allow" to everybody.
+type sourcemapPolicy struct {
+	policy           string
+	allowedNets      []*net.IPNet
+	token            string
+	tokenHeader      string
+	trustedProxyHops int
+}
+
+func newSourcemapPolicy(policy string, allowed string, token string, tokenHeader string, trustedProxyHops int) (*sourcemapPolicy, error) {
+	if policy != "allow" && policy != "block" && policy != "restricted" {
+		return nil, fmt.Errorf("unknown source map policy %q", policy)
+	}
+	allowedNets, err := parseIPNets(allowed)
+	if err != nil {
+		return nil, err
+	}
+	return &sourcemapPolicy{
+		policy:           policy,
+		allowedNets:      allowedNets,
+		token:            token,
+		tokenHeader:      tokenHeader,
+		trustedProxyHops: trustedProxyHops,
+	}, nil
+}
+
+func isSourcemap(path string) bool {
+	return filepath.Ext(path) == ".map"
+}
+
+// permits tells if the client of the request may receive source maps.
+func (p *sourcemapPolicy) permits(req *http.Request) bool {
+	switch p.policy {
+	case "allow":
+		return true
+	case "restricted":
+		if containsIP(p.allowedNets, clientIP(req, p.trustedProxyHops)) {
+			return true
+		}
+		return p.token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get(p.tokenHeader)), []byte(p.token)) == 1
+	}
+	return false
+}
+
+// handler applies the policy to requests for *.map files. Denied requests receive a 404 to not reveal the
+// files.
+func (p *sourcemapPolicy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if isSourcemap(req.URL.Path) && !p.permits(req) {
+			http.NotFound(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSourcemapPolicy(t *testing.T) {
+	handler := newTestServer(t, map[string]string{
+		"SOURCEMAP_POLICY": "restricted",
+		"SOURCEMAP_TOKEN":  "secret",
+		"REWRITES":         `[{"pattern":"^/legacy/(.*)$","replacement":"/$1"}]`,
+		"ARCHIVE_ROUTES":   `[{"path":"/assets.zip","prefix":"/assets/"}]`,
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"denied", "/assets/main.3f2a1b9c.js.map", "", http.StatusNotFound},
+		{"permitted", "/assets/main.3f2a1b9c.js.map", "secret", http.StatusOK},
+		{"denied after a rewrite", "/legacy/assets/main.3f2a1b9c.js.map", "", http.StatusNotFound},
+		{"permitted after a rewrite", "/legacy/assets/main.3f2a1b9c.js.map", "secret", http.StatusOK},
+		{"not a source map", "/legacy/assets/main.3f2a1b9c.js", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+			if test.token != "" {
+				req.Header.Set("X-Sourcemap-Token", test.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("status = %d, want %d", rec.Code, test.status)
+			}
+		})
+	}
+
+	for _, token := range []string{"", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/assets.zip", nil)
+		if token != "" {
+			req.Header.Set("X-Sourcemap-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		withSourcemap := false
+		for _, entry := range archive.File {
+			withSourcemap = withSourcemap || entry.Name == "main.3f2a1b9c.js.map"
+		}
+		if withSourcemap != (token != "") {
+			t.Errorf("archive for token %q holds the source map: %v", token, withSourcemap)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// response classes of the file handler, in the order they are reported
+const (
+	classAsset    = "asset"
+	classIndex    = "index"
+	classFallback = "fallback"
+	classConfig   = "config"
+	// classNotModified counts revalidations answered with a 304
+	classNotModified = "not-modified"
+)
+
+var responseClasses = []string{classAsset, classIndex, classFallback, classConfig, classNotModified}
+
+// servingStats counts the responses and bytes of the file handler per class, showing how many requests are
+// served from fingerprinted immutable assets compared to the fallback to index.html. The bytes are also
+// summed per file over the current interval, to find the heaviest assets.
+type servingStats struct {
+	requests map[string]*atomic.Uint64
+	bytes    map[string]*atomic.Uint64
+
+	mutex     sync.Mutex
+	fileBytes map[string]uint64
+}
+
+type fileBytes struct {
+	path  string
+	bytes uint64
+}
+
+func newServingStats() *servingStats {
+	stats := &servingStats{
+		requests:  make(map[string]*atomic.Uint64, len(responseClasses)),
+		bytes:     make(map[string]*atomic.Uint64, len(responseClasses)),
+		fileBytes: make(map[string]uint64),
+	}
+	for _, class := range responseClasses {
+		stats.requests[class] = &atomic.Uint64{}
+		stats.bytes[class] = &atomic.Uint64{}
+	}
+	return stats
+}
+
+// record counts a response and tags the request with its class for the metrics, the path must be the one
+// of the served file, so the number of tracked paths is bounded by the bundle.
+func (s *servingStats) record(req *http.Request, class string, path string, bytes int) {
+	setRequestClass(req, class)
+	s.requests[class].Add(1)
+	s.bytes[class].Add(uint64(bytes))
+	s.mutex.Lock()
+	s.fileBytes[path] += uint64(bytes)
+	s.mutex.Unlock()
+}
+
+func snapshot(counters map[string]*atomic.Uint64) map[string]uint64 {
+	snapshot := make(map[string]uint64, len(counters))
+	for class, counter := range counters {
+		snapshot[class] = counter.Load()
+	}
+	return snapshot
+}
+
+// takeHeaviest returns the n files with the most bytes served since the last call.
+func (s *servingStats) takeHeaviest(n int) []fileBytes {
+	s.mutex.Lock()
+	files := s.fileBytes
+	s.fileBytes = make(map[string]uint64)
+	s.mutex.Unlock()
+
+	heaviest := make([]fileBytes, 0, len(files))
+	for path, bytes := range files {
+		heaviest = append(heaviest, fileBytes{path, bytes})
+	}
+	sort.Slice(heaviest, func(i, j int) bool {
+		return heaviest[i].bytes > heaviest[j].bytes
+	})
+	if len(heaviest) > n {
+		heaviest = heaviest[:n]
+	}
+	return heaviest
+}
+
+// logPeriodically logs the share of every class among the responses and bytes of each interval, and the
+// topAssets files with the most bytes served.
+func (s *servingStats) logPeriodically(interval time.Duration, topAssets int) {
+	previousRequests := snapshot(s.requests)
+	previousBytes := snapshot(s.bytes)
+	for range time.Tick(interval) {
+		currentRequests := snapshot(s.requests)
+		currentBytes := snapshot(s.bytes)
+		var total, totalBytes uint64
+		for _, class := range responseClasses {
+			total += currentRequests[class] - previousRequests[class]
+			totalBytes += currentBytes[class] - previousBytes[class]
+		}
+		if total > 0 {
+			shares := make([]string, 0, len(responseClasses))
+			for _, class := range responseClasses {
+				count := currentRequests[class] - previousRequests[class]
+				bytes := currentBytes[class] - previousBytes[class]
+				shares = append(shares, fmt.Sprintf("%s: %d (%.1f%%) %d bytes", class, count, float64(count)*100/float64(total), bytes))
+			}
+			slog.Info("Served responses", "interval", interval, "total", total, "bytes", totalBytes, "classes", strings.Join(shares, ", "))
+		}
+		if heaviest := s.takeHeaviest(topAssets); len(heaviest) > 0 {
+			entries := make([]string, 0, len(heaviest))
+			for _, file := range heaviest {
+				entries = append(entries, fmt.Sprintf("%s: %d bytes", file.path, file.bytes))
+			}
+			slog.Info("Heaviest files", "interval", interval, "files", strings.Join(entries, ", "))
+		}
+		previousRequests = currentRequests
+		previousBytes = currentBytes
+	}
+}
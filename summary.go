@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// startupSummary describes the effective setup of the server in a single machine-readable event, which
+// helps to compare the instances of a fleet during rollouts.
+type startupSummary struct {
+	Event       string            `json:"event"`
+	Listeners   []string          `json:"listeners"`
+	BundleHash  string            `json:"bundleHash"`
+	Files       int               `json:"files"`
+	TotalBytes  int               `json:"totalBytes"`
+	Features    []string          `json:"features"`
+	CachePolicy map[string]string `json:"cachePolicy"`
+}
+
+// bundleHash identifies the content of the bundle, the runtime config is not part of it.
+func bundleHash(files map[string]loadedFile) (string, error) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		if path != configFileName {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	hash := sha256.New()
+	for _, path := range paths {
+		content, err := files[path].uncompressed()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		fileHash := sha256.Sum256(content)
+		fmt.Fprintf(hash, "%s %x\n", path, fileHash)
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func logStartupSummary(summary startupSummary) {
+	summary.Event = "startup"
+	encoded, err := json.Marshal(summary)
+	if err != nil {
+		slog.Error("Could not encode startup summary", "err", err)
+		return
+	}
+	// with LOG_FORMAT=json the summary is logged as a nested object
+	slog.Info("Startup summary", "summary", json.RawMessage(encoded))
+}
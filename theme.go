@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const defaultThemeHost = "*"
+
+var titlePattern = regexp.MustCompile(`(?s)<title>.*?</title>`)
+var cssVariablePattern = regexp.MustCompile(`^--[A-Za-z0-9_-]+$`)
+
+type theme struct {
+	CSSVariables map[string]string `json:"cssVariables"`
+	Logo         string            `json:"logo"`
+	Title        string            `json:"title"`
+}
+
+// themeInjection is the html rendered from a theme once at startup.
+type themeInjection struct {
+	head  []byte
+	title []byte
+}
+
+// parseThemes parses the themes per host, the host "*" is used for all hosts without an own theme.
+func parseThemes(themesJSON string) (map[string]themeInjection, error) {
+	var themes map[string]theme
+	err := json.Unmarshal([]byte(themesJSON), &themes)
+	if err != nil {
+		return nil, err
+	}
+	injections := make(map[string]themeInjection, len(themes))
+	for host, t := range themes {
+		injection, err := renderTheme(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid theme for host %s: %w", host, err)
+		}
+		injections[strings.ToLower(host)] = injection
+	}
+	return injections, nil
+}
+
+func renderTheme(t theme) (themeInjection, error) {
+	var injection themeInjection
+	head := &bytes.Buffer{}
+	names := make([]string, 0, len(t.CSSVariables))
+	for name, value := range t.CSSVariables {
+		if !cssVariablePattern.MatchString(name) {
+			return injection, fmt.Errorf("invalid css custom property name %q", name)
+		}
+		if strings.ContainsAny(value, "<>{};") {
+			return injection, fmt.Errorf("invalid value for css custom property %s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 || t.Logo != "" {
+		// the style element receives the csp nonce like every other style element of index.html
+		head.WriteString("<style>:root{")
+		for _, name := range names {
+			fmt.Fprintf(head, "%s:%s;", name, t.CSSVariables[name])
+		}
+		if t.Logo != "" {
+			if strings.ContainsAny(t.Logo, "<>{};\"'()") {
+				return injection, fmt.Errorf("invalid logo path %q", t.Logo)
+			}
+			fmt.Fprintf(head, "--theme-logo:url(\"%s\");", t.Logo)
+		}
+		head.WriteString("}</style>")
+	}
+	if t.Logo != "" {
+		fmt.Fprintf(head, "<meta name=\"theme-logo\" content=\"%s\">", html.EscapeString(t.Logo))
+	}
+	injection.head = head.Bytes()
+	if t.Title != "" {
+		injection.title = []byte("<title>" + html.EscapeString(t.Title) + "</title>")
+	}
+	return injection, nil
+}
+
+func themeForHost(themes map[string]themeInjection, hostport string) (themeInjection, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	injection, found := themes[strings.ToLower(host)]
+	if !found {
+		injection, found = themes[defaultThemeHost]
+	}
+	return injection, found
+}
+
+// applyTheme injects the theme at the end of the head of the html document and replaces its title.
+func applyTheme(content []byte, injection themeInjection) []byte {
+	if injection.title != nil {
+		if titlePattern.Match(content) {
+			content = titlePattern.ReplaceAllLiteral(content, injection.title)
+		} else {
+			content = bytes.Replace(content, []byte("</head>"), append(append([]byte{}, injection.title...), "</head>"...), 1)
+		}
+	}
+	if len(injection.head) > 0 {
+		content = bytes.Replace(content, []byte("</head>"), append(append([]byte{}, injection.head...), "</head>"...), 1)
+	}
+	return content
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// writeTimeoutRoute overrides the write timeout of the server for all paths starting with the prefix,
+// e.g. for streaming routes. Zero seconds removes the deadline.
+type writeTimeoutRoute struct {
+	Prefix  string `json:"prefix"`
+	Seconds uint64 `json:"seconds"`
+}
+
+func parseWriteTimeoutRoutes(routesJSON string) ([]writeTimeoutRoute, error) {
+	var routes []writeTimeoutRoute
+	err := json.Unmarshal([]byte(routesJSON), &routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return nil, fmt.Errorf("write timeout route prefix %q must start with /", route.Prefix)
+		}
+	}
+	return routes, nil
+}
+
+// newWriteTimeoutHandler replaces the write deadline of the connection for requests matching a route,
+// using the first matching route.
+func newWriteTimeoutHandler(routes []writeTimeoutRoute, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, route := range routes {
+			if !strings.HasPrefix(req.URL.Path, route.Prefix) {
+				continue
+			}
+			var deadline time.Time
+			if route.Seconds > 0 {
+				deadline = time.Now().Add(time.Duration(route.Seconds) * time.Second)
+			}
+			err := http.NewResponseController(w).SetWriteDeadline(deadline)
+			if err != nil {
+				slog.Error("Could not override write timeout", "path", req.URL.Path, "err", err)
+			}
+			break
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate of the key pair files and reloads it when the files change, e.g.
+// when cert-manager rotates the certificate. The files are checked at most every certCheckInterval.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the certificate and the key file.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// getCertificate is the tls.Config.GetCertificate callback. A certificate that can not be reloaded, e.g.
+// while the files are being replaced, keeps the previous one in use.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	modTime, err := r.lastModified()
+	if err != nil || !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	err = r.load(modTime)
+	if err != nil {
+		slog.Warn("Could not reload certificate, keeping the previous one", "cert", r.certFile, "err", err)
+		return r.cert, nil
+	}
+	slog.Info("Reloaded certificate", "cert", r.certFile)
+	return r.cert, nil
+}
+
+// ticketKeyReloader encrypts the session tickets with the keys of a file shared by all instances, so a
+// client resumes its session on whichever instance it reaches, over TCP and QUIC. The file holds one base64
+// encoded 32 byte key per line, the first one encrypts new tickets and all of them decrypt tickets. The
+// keys are rotated by replacing the file, it is checked at most every certCheckInterval.
+type ticketKeyReloader struct {
+	file string
+
+	mutex sync.Mutex
+	// keys holds the keys, it is only used to encrypt and decrypt tickets
+	keys    *tls.Config
+	modTime time.Time
+	checked time.Time
+}
+
+func newTicketKeyReloader(file string) (*ticketKeyReloader, error) {
+	r := &ticketKeyReloader{file: file}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(info.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseTicketKeys parses the base64 encoded keys, one per line.
+func parseTicketKeys(content string) ([][32]byte, error) {
+	var keys [][32]byte
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("line %d is not a base64 encoded 32 byte key", i+1)
+		}
+		keys = append(keys, [32]byte(decoded))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket keys")
+	}
+	return keys, nil
+}
+
+func (r *ticketKeyReloader) load(modTime time.Time) error {
+	content, err := os.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	keys, err := parseTicketKeys(string(content))
+	if err != nil {
+		return err
+	}
+	r.keys = &tls.Config{}
+	r.keys.SetSessionTicketKeys(keys)
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// current returns the keys in effect. Keys that can not be reloaded, e.g. while the file is being
+// replaced, keep the previous ones in use.
+func (r *ticketKeyReloader) current() *tls.Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.keys
+	}
+	r.checked = time.Now()
+	info, err := os.Stat(r.file)
+	if err != nil || !info.ModTime().After(r.modTime) {
+		return r.keys
+	}
+	err = r.load(info.ModTime())
+	if err != nil {
+		slog.Warn("Could not reload session ticket keys, keeping the previous ones", "file", r.file, "err", err)
+		return r.keys
+	}
+	slog.Info("Reloaded session ticket keys", "file", r.file)
+	return r.keys
+}
+
+// configure makes the config encrypt and decrypt the session tickets with the keys of the file. The hooks
+// are kept by the clones of the config, e.g. those of the TCP and the QUIC listeners.
+func (r *ticketKeyReloader) configure(config *tls.Config) {
+	config.WrapSession = func(state tls.ConnectionState, session *tls.SessionState) ([]byte, error) {
+		return r.current().EncryptTicket(state, session)
+	}
+	config.UnwrapSession = func(identity []byte, state tls.ConnectionState) (*tls.SessionState, error) {
+		// a ticket of an unknown key is ignored and a full handshake is done
+		return r.current().DecryptTicket(identity, state)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedTicketKeysResumeOnOtherInstance(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	keysFile := filepath.Join(t.TempDir(), "ticket-keys")
+	if err := os.WriteFile(keysFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// two instances of the server sharing the keys file
+	instance := func() *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		server.TLS = &tls.Config{}
+		keys, err := newTicketKeyReloader(keysFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys.configure(server.TLS)
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	first, second := instance(), instance()
+
+	client := first.Client()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	for i, server := range []*httptest.Server{first, second} {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// a new connection, so the second request resumes the session of the first one
+		transport.CloseIdleConnections()
+		if resumed := resp.TLS.DidResume; resumed != (i == 1) {
+			t.Errorf("request %d resumed = %v", i, resumed)
+		}
+	}
+}
+
+func TestParseTicketKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		content string
+		keys    int
+	}{
+		{key + "\n", 1},
+		{"\n" + key + "\n\n" + key, 2},
+		{"", 0},
+		{base64.StdEncoding.EncodeToString(make([]byte, 16)), 0},
+		{"not base64", 0},
+	}
+	for _, test := range tests {
+		keys, err := parseTicketKeys(test.content)
+		if len(keys) != test.keys || (err == nil) != (test.keys > 0) {
+			t.Errorf("parseTicketKeys(%q) = %d keys, %v, want %d keys", test.content, len(keys), err, test.keys)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// injectVersionMeta announces the version of the bundle in a meta element of the html document, so the
+// running SPA knows which version it was loaded from.
+func injectVersionMeta(document []byte, version string) []byte {
+	meta := fmt.Sprintf(`<meta name="app-version" content="%s">`, html.EscapeString(version))
+	return bytes.Replace(document, []byte("</head>"), []byte(meta+"</head>"), 1)
+}
+
+// withVersion adds the version of the bundle to the runtime config under the key "appVersion".
+func withVersion(config []byte, version string) ([]byte, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(config, &doc)
+	if err != nil {
+		return nil, err
+	}
+	mergeJSON(doc, map[string]interface{}{"appVersion": version})
+	return json.Marshal(doc)
+}
+
+// newVersionHandler serves the version of the bundle at the path, so the SPA can poll cheaply whether a
+// newer version was deployed and prompt for a reload. All other requests are passed to the next handler.
+func newVersionHandler(path string, version string, next http.Handler) http.Handler {
+	body, _ := json.Marshal(struct {
+		Version string `json:"version"`
+	}{version})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != path {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		if req.Method != http.MethodHead {
+			_, _ = w.Write(body)
+		}
+	})
+}
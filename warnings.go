@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// newWarningHandler logs a warning for responses that take longer than slowThreshold or are larger than
+// largeThreshold bytes, to catch pathological assets early. A zero threshold disables its check.
+func newWarningHandler(slowThreshold time.Duration, largeThreshold int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := newStatusRecorder(w)
+		next.ServeHTTP(recorder, req)
+		duration := time.Since(start)
+
+		if slowThreshold > 0 && duration > slowThreshold {
+			logResponseWarning(req, "Slow request", recorder, duration)
+		}
+		if largeThreshold > 0 && recorder.bytes > largeThreshold {
+			logResponseWarning(req, "Large response", recorder, duration)
+		}
+	})
+}
+
+func logResponseWarning(req *http.Request, msg string, recorder *statusRecorder, duration time.Duration) {
+	slog.LogAttrs(req.Context(), slog.LevelWarn, msg,
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.Int("status", recorder.status),
+		slog.Duration("duration", duration),
+		slog.Int("bytes", recorder.bytes),
+	)
+}